@@ -0,0 +1,156 @@
+package mka
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// rendezvous 返回key在集群上的rendezvous hash排序, 排在前面的集群优先. seeds 是集群名字的hash, 按照集群的索引排列.
+// 集群的打分只和key以及集群的名字有关, 所以增删集群之后, 其它集群上的key不会被重新映射.
+func rendezvous(key []byte, seeds []uint64) []int {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+
+	n := len(seeds)
+	scores := make([]uint64, n)
+	order := make([]int, n)
+	for i, seed := range seeds {
+		scores[i] = mix64(sum ^ seed)
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	return order
+}
+
+// nameSeeds 返回集群名字的hash.
+func nameSeeds(names ...string) []uint64 {
+	seeds := make([]uint64, len(names))
+	for i, name := range names {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		seeds[i] = mix64(h.Sum64())
+	}
+	return seeds
+}
+
+// mix64 是splitmix64的混淆函数, 让相近的输入得到分布均匀的输出.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// affinityGroup 是一批消息中目标集群顺序相同的消息.
+type affinityGroup struct {
+	candidates []int
+	indexes    []int
+	msgs       []kafka.Message
+}
+
+// sendByKey 按照消息key的rendezvous hash排序选择集群, 把消息按照目标集群拆分后并发写入.
+func (w *Writer) sendByKey(ctx context.Context, s *writerSet, msgs []kafka.Message) error {
+	var roundRobin []int
+	var groups []*affinityGroup
+	byOrder := make(map[string]*affinityGroup)
+
+	for j, msg := range msgs {
+		var candidates []int
+		if msg.Key == nil {
+			if roundRobin == nil {
+				roundRobin = availableFirst(s, w.retry.filter(w.candidates(s, msgs)))
+			}
+			candidates = roundRobin
+		} else {
+			candidates = availableFirst(s, w.retry.filter(rendezvous(msg.Key, s.seeds)))
+		}
+
+		k := orderKey(candidates)
+		g := byOrder[k]
+		if g == nil {
+			g = &affinityGroup{candidates: candidates}
+			byOrder[k] = g
+			groups = append(groups, g)
+		}
+		g.indexes = append(g.indexes, j)
+		g.msgs = append(g.msgs, msg)
+	}
+
+	if len(groups) == 1 {
+		_, err := w.failover(ctx, s, msgs, groups[0].candidates)
+		return err
+	}
+
+	ferrs := make([]*FailoverError, len(groups))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	wg.Add(len(groups))
+	for k, g := range groups {
+		k, g := k, g
+		s.wp.Submit(func() {
+			defer wg.Done()
+			ferrs[k], errs[k] = w.failover(ctx, s, g.msgs, g.candidates)
+		})
+	}
+	wg.Wait()
+
+	failed := false
+	for _, err := range errs {
+		if err != nil {
+			failed = true
+		}
+	}
+	if !failed {
+		return nil
+	}
+
+	// 合并各个分组的结果, 每条消息对应原来的索引
+	merged := &FailoverError{Messages: make([]MessageError, len(msgs))}
+	for k, g := range groups {
+		for _, e := range ferrs[k].Attempts {
+			indexes := make([]int, len(e.Messages))
+			for m, j := range e.Messages {
+				indexes[m] = g.indexes[j]
+			}
+			e.Messages = indexes
+			merged.Attempts = append(merged.Attempts, e)
+		}
+		for m, j := range g.indexes {
+			merged.Messages[j] = ferrs[k].Messages[m]
+		}
+	}
+	return merged
+}
+
+// availableFirst 把熔断的集群移到candidates的末尾, 其它集群的相对顺序不变.
+func availableFirst(s *writerSet, candidates []int) []int {
+	order := make([]int, 0, len(candidates))
+	var unavailable []int
+	for _, i := range candidates {
+		if s.clusters[i].breaker.available() {
+			order = append(order, i)
+		} else {
+			unavailable = append(unavailable, i)
+		}
+	}
+	return append(order, unavailable...)
+}
+
+func orderKey(candidates []int) string {
+	var b strings.Builder
+	for _, i := range candidates {
+		b.WriteString(strconv.Itoa(i))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
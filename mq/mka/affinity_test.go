@@ -0,0 +1,115 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRendezvous(t *testing.T) {
+	seeds := nameSeeds("cluster-0", "cluster-1", "cluster-2")
+	counts := make([]int, 3)
+	for i := 0; i < 300; i++ {
+		key := []byte("Key-" + strconv.Itoa(i))
+		order := rendezvous(key, seeds)
+		assert.Equal(t, order, rendezvous(key, seeds))
+		assert.ElementsMatch(t, []int{0, 1, 2}, order)
+		counts[order[0]]++
+	}
+
+	for _, c := range counts {
+		assert.Greater(t, c, 50)
+	}
+
+	// 移除一个集群之后, 原来映射到其它集群的key不变
+	rest := nameSeeds("cluster-0", "cluster-2")
+	for i := 0; i < 300; i++ {
+		key := []byte("Key-" + strconv.Itoa(i))
+		switch first := rendezvous(key, seeds)[0]; first {
+		case 0:
+			assert.Equal(t, 0, rendezvous(key, rest)[0])
+		case 2:
+			assert.Equal(t, 1, rendezvous(key, rest)[0])
+		}
+	}
+}
+
+func TestWriter_KeyAffinity(t *testing.T) {
+	fakes := newFakeWriters(3)
+	w := newTestWriter(RWModeMultiRW, fakes, WithKeyAffinity(), WithBreaker(BreakerConfig{FailureThreshold: 1}))
+	defer w.Close()
+	seeds := nameSeeds("cluster-0", "cluster-1", "cluster-2")
+
+	var msgs []kafka.Message
+	for i := 0; i < 30; i++ {
+		msgs = append(msgs, kafka.Message{Key: []byte("Key-" + strconv.Itoa(i%10)), Value: []byte(strconv.Itoa(i))})
+	}
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs[:10]...))
+
+	total := 0
+	for i, f := range fakes {
+		total += f.written()
+		for _, msg := range f.msgs {
+			assert.Equal(t, i, rendezvous(msg.Key, seeds)[0])
+		}
+	}
+	assert.Equal(t, 40, total)
+
+	// 首选集群不可用时, 确定性地写入排在第二位的集群
+	key := []byte("Key-1")
+	order := rendezvous(key, seeds)
+	fakes[order[0]].setErr(errors.New("cluster is down"))
+	attempts := fakes[order[0]].attempts()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Key: key, Value: []byte("failover")}))
+	}
+	assert.Equal(t, attempts+1, fakes[order[0]].attempts())
+	assert.Equal(t, "failover", string(fakes[order[1]].msgs[len(fakes[order[1]].msgs)-1].Value))
+
+	n := 0
+	for _, msg := range fakes[order[1]].msgs {
+		if string(msg.Value) == "failover" {
+			n++
+		}
+	}
+	assert.Equal(t, 3, n)
+}
+
+func TestWriter_KeyAffinityRemoveCluster(t *testing.T) {
+	fakes := newFakeWriters(3)
+	w := newTestWriter(RWModeMultiRW, fakes, WithKeyAffinity())
+	defer w.Close()
+
+	var msgs []kafka.Message
+	for i := 0; i < 30; i++ {
+		msgs = append(msgs, kafka.Message{Key: []byte("Key-" + strconv.Itoa(i))})
+	}
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+
+	owner := make(map[string]int)
+	for i, f := range fakes {
+		for _, msg := range f.msgs {
+			owner[string(msg.Key)] = i
+		}
+	}
+
+	// 移除集群之后, 其它集群上的key仍然写入原来的集群
+	removed := fakes[1].written()
+	assert.NoError(t, w.RemoveCluster("cluster-1"))
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+	for _, i := range []int{0, 2} {
+		for _, msg := range fakes[i].msgs {
+			if owner[string(msg.Key)] != 1 {
+				assert.Equal(t, i, owner[string(msg.Key)], string(msg.Key))
+			}
+		}
+	}
+	assert.Equal(t, removed, fakes[1].written())
+	assert.Equal(t, 60, fakes[0].written()+fakes[1].written()+fakes[2].written())
+}
@@ -0,0 +1,226 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/multierr"
+)
+
+// Batch 是 ReadBatch 读取到的一批消息.
+type Batch struct {
+	r *Reader
+
+	// Clusters 是按照集群分组的消息, 按照集群的索引排列, 没有读取到消息的集群不在其中.
+	Clusters []ClusterBatch
+
+	// dropped 是读取这批消息时去重去掉的重复消息, 和这批消息一起提交.
+	dropped []Message
+}
+
+// ClusterBatch 是一批消息中来自同一个集群的消息, 按照读取的顺序排列.
+type ClusterBatch struct {
+	Cluster  int
+	Name     string
+	Messages []kafka.Message
+}
+
+// Len 返回这批消息的总数.
+func (b *Batch) Len() int {
+	n := 0
+	for _, cb := range b.Clusters {
+		n += len(cb.Messages)
+	}
+	return n
+}
+
+// Messages 返回这批消息中的所有消息, 每条消息都标记了它来自哪个集群.
+func (b *Batch) Messages() []Message {
+	msgs := make([]Message, 0, b.Len())
+	for _, cb := range b.Clusters {
+		for _, msg := range cb.Messages {
+			msgs = append(msgs, Message{Message: msg, Cluster: cb.Cluster, ClusterName: cb.Name})
+		}
+	}
+	return msgs
+}
+
+// Commit 提交这批消息的offset, 读取时去重去掉的重复消息也一起提交, 错误和 Reader.CommitMessages 相同.
+func (b *Batch) Commit(ctx context.Context) error {
+	return b.r.CommitMessages(ctx, append(b.Messages(), b.dropped...)...)
+}
+
+func newBatch(r *Reader, msgs, dropped []Message) *Batch {
+	b := &Batch{r: r, dropped: dropped}
+	byCluster := make(map[string]int)
+	for _, msg := range msgs {
+		k, ok := byCluster[msg.ClusterName]
+		if !ok {
+			k = len(b.Clusters)
+			byCluster[msg.ClusterName] = k
+			b.Clusters = append(b.Clusters, ClusterBatch{Cluster: msg.Cluster, Name: msg.ClusterName})
+		}
+		b.Clusters[k].Messages = append(b.Clusters[k].Messages, msg.Message)
+	}
+
+	sort.Slice(b.Clusters, func(i, j int) bool { return b.Clusters[i].Cluster < b.Clusters[j].Cluster })
+	return b
+}
+
+// ReadBatch 从所有集群读取一批消息, 直到读取到maxMessages条消息或者等待了maxWait, maxWait为0时不限制等待时间.
+// 和 FetchMessages 一样不会自动提交offset, 处理完之后调用 Batch.Commit 一次提交整批消息.
+//
+// 等待超时时返回已经读取到的消息, 可能是空的一批. ctx结束并且没有读取到消息时返回ctx的错误;
+// 所有集群都读取失败并且没有读取到消息时, 返回的error包含每个集群的 ClusterError. Reader 关闭之后返回 io.EOF.
+// 开启 WithStreaming 时从流式读取的channel中获取消息.
+func (r *Reader) ReadBatch(ctx context.Context, maxMessages int, maxWait time.Duration) (*Batch, error) {
+	if maxMessages <= 0 {
+		maxMessages = 1
+	}
+
+	wctx := ctx
+	if maxWait > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
+
+	var msgs, dropped []Message
+	var err error
+	if r.stream != nil {
+		msgs, dropped, err = r.stream.batch(wctx, maxMessages)
+	} else {
+		msgs, dropped, err = r.readBatch(wctx, maxMessages)
+	}
+
+	if len(msgs) == 0 && err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return newBatch(r, nil, dropped), nil
+		}
+		return nil, err
+	}
+	return newBatch(r, msgs, dropped), nil
+}
+
+// readBatch 从当前的集群列表读取一批消息, 同时返回去重去掉的重复消息.
+// 读取期间集群列表被替换, 或者读取到的消息都是重复消息时继续读取.
+func (r *Reader) readBatch(ctx context.Context, max int) (msgs, dropped []Message, err error) {
+	for {
+		set := r.acquire()
+		if set == nil {
+			return nil, dropped, io.EOF
+		}
+		read, err := r.readBatchFrom(ctx, set, max)
+		set.release()
+
+		msgs = read
+		if r.dedup != nil && len(read) > 0 {
+			var d []Message
+			msgs, d = r.dedup.split(read)
+			dropped = append(dropped, d...)
+		}
+
+		switch {
+		case len(msgs) > 0:
+			return msgs, dropped, nil
+		case ctx.Err() != nil:
+			return nil, dropped, ctx.Err()
+		case len(read) == 0 && !set.isRetired() && err != nil:
+			return nil, dropped, err
+		}
+	}
+}
+
+// readBatchFrom 从每个集群并发地读取消息, 一共最多读取max条消息. 没有读取到消息时返回所有集群读取失败的错误.
+//
+// 每个集群读取到消息之后才计数, 这样空闲的集群不会占用这一批的名额. 其它集群已经读满这一批时,
+// 多读取的消息被放回集群, 下次读取时首先返回.
+func (r *Reader) readBatchFrom(ctx context.Context, set *readerSet, max int) ([]Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 集群列表被替换时结束这一批
+	go func() {
+		select {
+		case <-set.retired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var mu sync.Mutex
+	var msgs []Message
+	var err error
+
+	var wg sync.WaitGroup
+	wg.Add(len(set.clusters))
+	for j, c := range set.clusters {
+		j, c := j, c
+		set.wp.Submit(func() {
+			defer wg.Done()
+			for {
+				msg, _, e := c.fetch(ctx, false)
+				if e != nil {
+					if ctx.Err() == nil {
+						c.record(e)
+						mu.Lock()
+						err = multierr.Append(err, ClusterError{Cluster: j, Name: c.name, Err: e})
+						mu.Unlock()
+					}
+					return
+				}
+
+				mu.Lock()
+				full := len(msgs) == max
+				if !full {
+					msgs = append(msgs, Message{Message: msg, Cluster: j, ClusterName: c.name})
+					if len(msgs) == max {
+						cancel()
+					}
+				}
+				mu.Unlock()
+
+				if full {
+					c.unread(msg)
+					return
+				}
+				c.record(nil)
+				if r.tracing != nil {
+					r.traceReceive(ctx, j, c.name, msg)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(msgs) > 0 {
+		return msgs, nil
+	}
+	return nil, err
+}
+
+// batch 从channel中获取最多max条消息, 同时返回它们之前被去重去掉的重复消息.
+func (s *stream) batch(ctx context.Context, max int) (msgs, dropped []Message, err error) {
+	for len(msgs) < max {
+		next, err := s.next(ctx)
+		if err != nil {
+			if len(msgs) > 0 {
+				return msgs, dropped, nil
+			}
+			return nil, dropped, err
+		}
+		for _, msg := range next {
+			for _, d := range msg.dropped {
+				dropped = append(dropped, Message{Message: d, Cluster: msg.Cluster, ClusterName: msg.ClusterName})
+			}
+			msg.dropped = nil
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, dropped, nil
+}
@@ -0,0 +1,137 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader_ReadBatch(t *testing.T) {
+	fakes := []*fakeReader{
+		{msgs: []kafka.Message{{Offset: 0}, {Offset: 1}, {Offset: 2}}},
+		{msgs: []kafka.Message{{Offset: 5}, {Offset: 6}}},
+	}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]}, WithReaderClusterNames("a", "b"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+
+	// 等待超时时返回所有集群已经读取到的消息
+	start := time.Now()
+	b, err := r.ReadBatch(ctx, 10, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 5, b.Len())
+	assert.Len(t, b.Clusters, 2)
+	assert.Equal(t, "a", b.Clusters[0].Name)
+	assert.Len(t, b.Clusters[0].Messages, 3)
+	assert.Equal(t, 1, b.Clusters[1].Cluster)
+	assert.Len(t, b.Clusters[1].Messages, 2)
+
+	assert.NoError(t, b.Commit(ctx))
+	assert.Len(t, fakes[0].commits(), 3)
+	assert.Len(t, fakes[1].commits(), 2)
+
+	// 没有消息时返回空的一批
+	b, err = r.ReadBatch(ctx, 10, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Len())
+	assert.Empty(t, b.Messages())
+
+	assert.NoError(t, r.Close())
+	_, err = r.ReadBatch(ctx, 10, time.Millisecond)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReader_ReadBatchMaxMessages(t *testing.T) {
+	fakes := []*fakeReader{{}, {}}
+	for i := 0; i < 10; i++ {
+		fakes[0].msgs = append(fakes[0].msgs, kafka.Message{Offset: int64(i)})
+		fakes[1].msgs = append(fakes[1].msgs, kafka.Message{Offset: int64(i)})
+	}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// 多读取的消息被放回集群, 之后的批次按顺序返回, 不会丢失
+	seen := make(map[int]int64)
+	for n := 0; n < 20; {
+		b, err := r.ReadBatch(context.Background(), 4, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, b.Len())
+		for _, msg := range b.Messages() {
+			if next, ok := seen[msg.Cluster]; ok {
+				assert.Equal(t, next+1, msg.Offset)
+			}
+			seen[msg.Cluster] = msg.Offset
+		}
+		n += b.Len()
+	}
+	assert.Equal(t, map[int]int64{0: 9, 1: 9}, seen)
+}
+
+func TestReader_ReadBatchErrors(t *testing.T) {
+	readers := []ClusterReader{
+		&failingReader{fakeReader: &fakeReader{}, err: errors.New("connection refused")},
+		&failingReader{fakeReader: &fakeReader{}, err: kafka.GroupAuthorizationFailed},
+	}
+	r, err := NewReaderFromClusters(readers)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.ReadBatch(context.Background(), 10, time.Hour)
+	var cerr ClusterError
+	assert.True(t, errors.As(err, &cerr))
+	assert.True(t, errors.Is(err, kafka.GroupAuthorizationFailed))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r2, err := NewReaderFromClusters([]ClusterReader{&fakeReader{}})
+	assert.NoError(t, err)
+	defer r2.Close()
+	_, err = r2.ReadBatch(ctx, 10, time.Hour)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestReader_ReadBatchStreaming(t *testing.T) {
+	fake := &fakeReader{msgs: make([]kafka.Message, 5)}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"), WithStreaming(StreamConfig{}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	b, err := r.ReadBatch(context.Background(), 3, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Len())
+	b, err = r.ReadBatch(context.Background(), 3, 20*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Len())
+	assert.NoError(t, b.Commit(context.Background()))
+	assert.Len(t, fake.commits(), 2)
+}
+
+func TestReader_ReadBatchStreamingDedup(t *testing.T) {
+	headers := []kafka.Header{{Key: HeaderProducerID, Value: []byte("p")}, {Key: HeaderSequence, Value: []byte("1")}}
+	fake := &fakeReader{msgs: []kafka.Message{{Offset: 0, Headers: headers}, {Offset: 1, Headers: headers}, {Offset: 2}}}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"),
+		WithStreaming(StreamConfig{}), WithDedup(DedupConfig{}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	b, err := r.ReadBatch(context.Background(), 2, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Len())
+
+	// 去重去掉的消息和批次中的消息一起提交
+	assert.NoError(t, b.Commit(context.Background()))
+	var offsets []int64
+	for _, msg := range fake.commits() {
+		offsets = append(offsets, msg.Offset)
+	}
+	assert.ElementsMatch(t, []int64{0, 1, 2}, offsets)
+}
@@ -0,0 +1,216 @@
+package mka
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState 表示某个kafka集群熔断器的状态.
+type BreakerState int32
+
+const (
+	// BreakerClosed 熔断器关闭, 集群正常参与选择.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen 熔断器打开, 选择集群时跳过该集群.
+	BreakerOpen
+	// BreakerHalfOpen 熔断器半开, 只允许试探写入以判断集群是否已经恢复.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig 是熔断器的配置, 零值字段使用默认值.
+type BreakerConfig struct {
+	// FailureThreshold 连续失败多少次后打开熔断器, 默认为5.
+	FailureThreshold int
+	// OpenTimeout 熔断器打开多久之后进入半开状态, 默认为30秒.
+	OpenTimeout time.Duration
+	// HalfOpenSuccesses 半开状态下连续成功多少次试探写入后关闭熔断器, 默认为1.
+	HalfOpenSuccesses int
+}
+
+const (
+	defaultFailureThreshold  = 5
+	defaultOpenTimeout       = 30 * time.Second
+	defaultHalfOpenSuccesses = 1
+
+	// latencyWeight 是计算延迟指数移动平均时新样本的权重.
+	latencyWeight = 0.2
+)
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = defaultFailureThreshold
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = defaultOpenTimeout
+	}
+	if c.HalfOpenSuccesses <= 0 {
+		c.HalfOpenSuccesses = defaultHalfOpenSuccesses
+	}
+	return c
+}
+
+// ClusterHealth 是某个kafka集群健康状况的快照.
+type ClusterHealth struct {
+	// Cluster 是集群在配置中的索引.
+	Cluster int
+	// Name 是集群的名字.
+	Name string
+	// State 是熔断器当前的状态.
+	State BreakerState
+
+	// Successes 和 Failures 是写入成功和失败的累计次数.
+	Successes int64
+	Failures  int64
+	// ConsecutiveFailures 是最近连续失败的次数.
+	ConsecutiveFailures int
+	// Latency 是写入延迟的指数移动平均值.
+	Latency time.Duration
+
+	// LastError 是最近一次写入失败的错误.
+	LastError error
+	// LastFailure 是最近一次写入失败的时间.
+	LastFailure time.Time
+	// OpenedAt 是熔断器最近一次打开的时间.
+	OpenedAt time.Time
+}
+
+// breaker 记录单个集群的健康状况, 并实现 closed -> open -> half-open 的熔断状态机.
+type breaker struct {
+	mu     sync.Mutex
+	config BreakerConfig
+	now    func() time.Time
+
+	state               BreakerState
+	consecutiveFailures int
+	halfOpenSuccesses   int
+	trial               bool // 半开状态下是否有试探写入正在进行
+
+	successes   int64
+	failures    int64
+	latency     time.Duration
+	lastErr     error
+	lastFailure time.Time
+	openedAt    time.Time
+}
+
+func newBreaker(config BreakerConfig) *breaker {
+	return &breaker{
+		config: config.withDefaults(),
+		now:    time.Now,
+	}
+}
+
+// allow 判断是否可以向该集群写入, trial 表示本次写入是半开状态下的试探写入.
+// 熔断器打开超过 OpenTimeout 后进入半开状态, 半开状态下同一时间只允许一个试探写入.
+// ok 为true后, 调用方必须把 trial 传给 record 或者 release.
+func (b *breaker) allow() (trial, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.config.OpenTimeout {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		b.halfOpenSuccesses = 0
+		b.trial = true
+		return true, true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false, false
+		}
+		b.trial = true
+		return true, true
+	default:
+		return false, true
+	}
+}
+
+// available 判断集群是否可以参与选择, 和 allow 不同, 它不会改变熔断器的状态.
+// 打开超过 OpenTimeout 的熔断器被认为是可用的, 以便进行试探写入.
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state != BreakerOpen || b.now().Sub(b.openedAt) >= b.config.OpenTimeout
+}
+
+// record 记录一次写入的结果和耗时. 只有获得试探写入机会的写入才释放它,
+// 熔断器关闭时开始的写入在半开状态下完成不会让另一个试探写入同时进行.
+func (b *breaker) record(trial bool, err error, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		b.trial = false
+	}
+	if b.latency == 0 {
+		b.latency = latency
+	} else {
+		b.latency += time.Duration(latencyWeight * float64(latency-b.latency))
+	}
+
+	if err == nil {
+		b.successes++
+		b.consecutiveFailures = 0
+		if b.state == BreakerHalfOpen {
+			b.halfOpenSuccesses++
+			if b.halfOpenSuccesses >= b.config.HalfOpenSuccesses {
+				b.state = BreakerClosed
+			}
+		}
+		return
+	}
+
+	b.failures++
+	b.consecutiveFailures++
+	b.lastErr = err
+	b.lastFailure = b.now()
+
+	if b.state == BreakerHalfOpen || b.consecutiveFailures >= b.config.FailureThreshold {
+		b.state = BreakerOpen
+		b.openedAt = b.lastFailure
+	}
+}
+
+// release 放弃 allow 获得的写入机会, 不改变集群的健康状况.
+// 一般用于调用方取消了写入的情况.
+func (b *breaker) release(trial bool) {
+	if !trial {
+		return
+	}
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+func (b *breaker) health(cluster int) ClusterHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return ClusterHealth{
+		Cluster:             cluster,
+		State:               b.state,
+		Successes:           b.successes,
+		Failures:            b.failures,
+		ConsecutiveFailures: b.consecutiveFailures,
+		Latency:             b.latency,
+		LastError:           b.lastErr,
+		LastFailure:         b.lastFailure,
+		OpenedAt:            b.openedAt,
+	}
+}
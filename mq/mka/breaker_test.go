@@ -0,0 +1,101 @@
+package mka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(BreakerConfig{FailureThreshold: 3, OpenTimeout: time.Second})
+	b.now = func() time.Time { return now }
+
+	errWrite := errors.New("write failed")
+	for i := 0; i < 3; i++ {
+		trial, ok := b.allow()
+		assert.True(t, ok)
+		assert.False(t, trial)
+		b.record(trial, errWrite, time.Millisecond)
+	}
+	assert.Equal(t, BreakerOpen, b.health(0).State)
+	_, ok := b.allow()
+	assert.False(t, ok)
+
+	// 超时后进入半开状态, 同一时间只允许一个试探写入
+	now = now.Add(time.Second)
+	trial, ok := b.allow()
+	assert.True(t, ok)
+	assert.True(t, trial)
+	assert.Equal(t, BreakerHalfOpen, b.health(0).State)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	// 试探失败, 重新打开
+	b.record(trial, errWrite, time.Millisecond)
+	assert.Equal(t, BreakerOpen, b.health(0).State)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	// 试探成功, 关闭熔断器
+	now = now.Add(time.Second)
+	trial, ok = b.allow()
+	assert.True(t, ok)
+	b.record(trial, nil, time.Millisecond)
+
+	h := b.health(2)
+	assert.Equal(t, 2, h.Cluster)
+	assert.Equal(t, BreakerClosed, h.State)
+	assert.Equal(t, int64(1), h.Successes)
+	assert.Equal(t, int64(4), h.Failures)
+	assert.Equal(t, 0, h.ConsecutiveFailures)
+	assert.Equal(t, errWrite, h.LastError)
+	assert.Equal(t, time.Millisecond, h.Latency)
+}
+
+func TestBreaker_Release(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Second})
+	b.now = func() time.Time { return now }
+
+	trial, ok := b.allow()
+	assert.True(t, ok)
+	b.record(trial, errors.New("write failed"), time.Millisecond)
+
+	now = now.Add(time.Second)
+	trial, ok = b.allow()
+	assert.True(t, ok)
+	b.release(trial)
+
+	assert.Equal(t, BreakerHalfOpen, b.health(0).State)
+	_, ok = b.allow()
+	assert.True(t, ok)
+}
+
+func TestBreaker_TrialOwner(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Second})
+	b.now = func() time.Time { return now }
+
+	// 熔断器关闭时开始的写入
+	early, ok := b.allow()
+	assert.True(t, ok)
+	failed, _ := b.allow()
+	b.record(failed, errors.New("write failed"), time.Millisecond)
+
+	now = now.Add(time.Second)
+	trial, ok := b.allow()
+	assert.True(t, ok)
+	assert.True(t, trial)
+
+	// 之前开始的写入在半开状态下被取消, 不释放试探写入的机会
+	b.release(early)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	b.release(trial)
+	_, ok = b.allow()
+	assert.True(t, ok)
+}
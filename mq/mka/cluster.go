@@ -0,0 +1,413 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	// ErrUnknownCluster 表示没有找到指定名字或者索引的kafka集群.
+	ErrUnknownCluster = errors.New("mka: unknown kafka cluster")
+	// ErrDuplicateCluster 表示已经存在同名的kafka集群.
+	ErrDuplicateCluster = errors.New("mka: duplicate kafka cluster")
+	// ErrLastCluster 表示不能移除最后一个kafka集群.
+	ErrLastCluster = errors.New("mka: cannot remove the last kafka cluster")
+)
+
+// writerCluster 是 Writer 中的单个kafka集群.
+type writerCluster struct {
+	name    string
+	config  kafka.WriterConfig
+	writer  ClusterWriter
+	breaker *breaker
+
+	// fallbacks 记录这个集群作为备选集群被写入的次数.
+	fallbacks int64
+	// latencies 记录最近写入成功的延迟, 用来计算对冲的阈值. 不需要时为nil.
+	latencies *latencyWindow
+	// admin 用于探测集群是否健康.
+	admin kafkaAdmin
+}
+
+// writerSet 是 Writer 某一时刻的集群列表, 创建之后不再改变.
+// 集群的索引就是它在这个列表中的位置, 增删集群时会创建新的 writerSet.
+type writerSet struct {
+	clusters []*writerCluster
+	wp       *workerpool.WorkerPool
+	// seeds 是每个集群名字的hash, 用于key亲和的rendezvous hash.
+	seeds []uint64
+
+	// inflight 记录正在使用这个集群列表的写入, calls 是它们的个数.
+	inflight sync.WaitGroup
+	calls    int64
+}
+
+func newWriterSet(clusters []*writerCluster) *writerSet {
+	names := make([]string, len(clusters))
+	for i, c := range clusters {
+		names[i] = c.name
+	}
+
+	return &writerSet{
+		clusters: clusters,
+		wp:       workerpool.New(len(clusters)),
+		seeds:    nameSeeds(names...),
+	}
+}
+
+func (s *writerSet) index(name string) int {
+	for i, c := range s.clusters {
+		if c.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *writerSet) health(i int) ClusterHealth {
+	c := s.clusters[i]
+	h := c.breaker.health(i)
+	h.Name = c.name
+	return h
+}
+
+// acquire 返回当前的集群列表, 使用完之后必须调用它的 release. Writer 已经关闭时返回nil.
+func (w *Writer) acquire() *writerSet {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return nil
+	}
+
+	s := w.set
+	s.inflight.Add(1)
+	atomic.AddInt64(&s.calls, 1)
+	return s
+}
+
+func (s *writerSet) release() {
+	atomic.AddInt64(&s.calls, -1)
+	s.inflight.Done()
+}
+
+// current 返回当前的集群列表, 只用于读取状态.
+func (w *Writer) current() *writerSet {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.set
+}
+
+// Clusters 返回所有kafka集群的名字, 按照集群的索引排列.
+func (w *Writer) Clusters() []string {
+	s := w.current()
+	names := make([]string, len(s.clusters))
+	for i, c := range s.clusters {
+		names[i] = c.name
+	}
+	return names
+}
+
+// AddCluster 在运行时增加一个kafka集群, 它排在已有集群的后面, name不能和已有的集群重复.
+//
+// 正在进行的写入仍然使用原来的集群列表, 之后的写入会使用新的集群列表.
+// AddCluster 等待使用原来集群列表的写入完成之后才返回.
+func (w *Writer) AddCluster(name string, config kafka.WriterConfig) error {
+	writer := kafka.NewWriter(config)
+	if err := w.addCluster(name, config, writer); err != nil {
+		writer.Close()
+		return err
+	}
+	return nil
+}
+
+// AddClusterWriter 和 AddCluster 一样, 但是使用给定的 ClusterWriter 作为新集群的writer.
+func (w *Writer) AddClusterWriter(name string, writer ClusterWriter) error {
+	return w.addCluster(name, kafka.WriterConfig{}, writer)
+}
+
+func (w *Writer) addCluster(name string, config kafka.WriterConfig, writer ClusterWriter) error {
+	return w.update(func(s *writerSet) ([]*writerCluster, error) {
+		if s.index(name) >= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateCluster, name)
+		}
+
+		clusters := make([]*writerCluster, len(s.clusters), len(s.clusters)+1)
+		copy(clusters, s.clusters)
+		return append(clusters, &writerCluster{
+			name:      name,
+			config:    config,
+			writer:    writer,
+			breaker:   newBreaker(w.breakerConfig),
+			latencies: w.hedge.newLatencyWindow(),
+		}), nil
+	})
+}
+
+// RemoveCluster 在运行时移除名字为name的kafka集群, 排在它后面的集群的索引会减一.
+//
+// 之后的写入不再使用这个集群, RemoveCluster 等待正在使用它的写入完成之后关闭它的writer,
+// 关闭时会把已经提交的消息写完.
+func (w *Writer) RemoveCluster(name string) error {
+	var removed *writerCluster
+	err := w.update(func(s *writerSet) ([]*writerCluster, error) {
+		i := s.index(name)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCluster, name)
+		}
+		if len(s.clusters) == 1 {
+			return nil, ErrLastCluster
+		}
+
+		removed = s.clusters[i]
+		clusters := make([]*writerCluster, 0, len(s.clusters)-1)
+		clusters = append(clusters, s.clusters[:i]...)
+		return append(clusters, s.clusters[i+1:]...), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	removed.admin.closeIdle()
+	return removed.writer.Close()
+}
+
+// update 用change返回的集群列表替换当前的集群列表, 然后等待使用原来集群列表的写入完成,
+// 停止原来的worker pool.
+func (w *Writer) update(change func(s *writerSet) ([]*writerCluster, error)) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+
+	old := w.set
+	clusters, err := change(old)
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+
+	w.set = newWriterSet(clusters)
+	if w.failback != nil {
+		w.resizeFailback(old, w.set)
+	}
+	w.mu.Unlock()
+
+	old.inflight.Wait()
+	old.wp.StopWait()
+	return nil
+}
+
+// resizeFailback 在集群列表改变之后调整主备切换的状态机, 调用时必须持有锁.
+func (w *Writer) resizeFailback(old, s *writerSet) {
+	remap := func(i int) int { return s.index(old.clusters[i].name) }
+
+	var probe func(ctx context.Context) error
+	if w.failbackConfig.Probe == nil && remap(0) != 0 {
+		probe = defaultProbe(s.clusters[0])
+		// 原来的主集群不再被探测
+		old.clusters[0].admin.closeIdle()
+	}
+	w.failback.resize(len(s.clusters), remap, probe)
+}
+
+// readerCluster 是 Reader 中的单个kafka集群.
+type readerCluster struct {
+	name   string
+	config kafka.ReaderConfig
+	reader ClusterReader
+
+	// messages 和 errors 记录从这个集群读取到的消息数和错误数.
+	messages int64
+	errors   int64
+	// failing 表示这个集群最近一次读取失败, lastMessage 是最近一次读取到消息的时间.
+	failing     int32
+	lastMessage int64
+
+	gate pauseGate
+	// pending 是通过 FetchMessage 读取但是没有返回给调用方的消息, 下次读取这个集群时首先返回.
+	pendingMu sync.Mutex
+	pending   []pendingMessage
+
+	// lagFunc 是计算这个集群lag的方法, 第一次计算时确定.
+	lagOnce sync.Once
+	lagFunc func(ctx context.Context) (int64, error)
+	// admin 用于计算consumer group的lag.
+	admin kafkaAdmin
+}
+
+// readerSet 是 Reader 某一时刻的集群列表, 创建之后不再改变.
+type readerSet struct {
+	clusters []*readerCluster
+	wp       *workerpool.WorkerPool
+
+	// inflight 记录正在使用这个集群列表的读取, calls 是它们的个数.
+	inflight sync.WaitGroup
+	calls    int64
+	// retired 在这个集群列表被替换时关闭, 通知正在进行的读取换用新的集群列表.
+	retired chan struct{}
+}
+
+// record 记录一次读取的结果.
+func (c *readerCluster) record(err error) {
+	if err != nil {
+		atomic.AddInt64(&c.errors, 1)
+		atomic.StoreInt32(&c.failing, 1)
+		return
+	}
+
+	atomic.AddInt64(&c.messages, 1)
+	atomic.StoreInt32(&c.failing, 0)
+	atomic.StoreInt64(&c.lastMessage, time.Now().UnixNano())
+}
+
+func newReaderSet(clusters []*readerCluster) *readerSet {
+	return &readerSet{
+		clusters: clusters,
+		wp:       workerpool.New(len(clusters)),
+		retired:  make(chan struct{}),
+	}
+}
+
+func (s *readerSet) index(name string) int {
+	for i, c := range s.clusters {
+		if c.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *readerSet) isRetired() bool {
+	select {
+	case <-s.retired:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire 返回当前的集群列表, 使用完之后必须调用它的 release. Reader 已经关闭时返回nil.
+func (r *Reader) acquire() *readerSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return nil
+	}
+
+	s := r.set
+	s.inflight.Add(1)
+	atomic.AddInt64(&s.calls, 1)
+	return s
+}
+
+func (s *readerSet) release() {
+	atomic.AddInt64(&s.calls, -1)
+	s.inflight.Done()
+}
+
+func (r *Reader) current() *readerSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.set
+}
+
+// Clusters 返回所有kafka集群的名字, 按照集群的索引排列.
+func (r *Reader) Clusters() []string {
+	s := r.current()
+	names := make([]string, len(s.clusters))
+	for i, c := range s.clusters {
+		names[i] = c.name
+	}
+	return names
+}
+
+// AddCluster 在运行时增加一个kafka集群, 它排在已有集群的后面, name不能和已有的集群重复.
+//
+// 正在进行的 ReadMessage 会被打断, 然后使用新的集群列表继续读取.
+func (r *Reader) AddCluster(name string, config kafka.ReaderConfig) error {
+	reader := kafka.NewReader(config)
+	err := r.addCluster(name, config, reader)
+	if err != nil {
+		reader.Close()
+	}
+	return err
+}
+
+// AddClusterReader 和 AddCluster 一样, 但是使用给定的 ClusterReader 作为新集群的reader.
+func (r *Reader) AddClusterReader(name string, reader ClusterReader) error {
+	return r.addCluster(name, kafka.ReaderConfig{}, reader)
+}
+
+func (r *Reader) addCluster(name string, config kafka.ReaderConfig, reader ClusterReader) error {
+	return r.update(func(s *readerSet) ([]*readerCluster, error) {
+		if s.index(name) >= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateCluster, name)
+		}
+
+		clusters := make([]*readerCluster, len(s.clusters), len(s.clusters)+1)
+		copy(clusters, s.clusters)
+		return append(clusters, &readerCluster{name: name, config: config, reader: reader}), nil
+	})
+}
+
+// RemoveCluster 在运行时移除名字为name的kafka集群, 排在它后面的集群的索引会减一.
+//
+// 正在进行的 ReadMessage 会被打断, 然后使用新的集群列表继续读取.
+// RemoveCluster 等待正在进行的读取换用新的集群列表之后关闭被移除集群的reader.
+func (r *Reader) RemoveCluster(name string) error {
+	var removed *readerCluster
+	err := r.update(func(s *readerSet) ([]*readerCluster, error) {
+		i := s.index(name)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCluster, name)
+		}
+		if len(s.clusters) == 1 {
+			return nil, ErrLastCluster
+		}
+
+		removed = s.clusters[i]
+		clusters := make([]*readerCluster, 0, len(s.clusters)-1)
+		clusters = append(clusters, s.clusters[:i]...)
+		return append(clusters, s.clusters[i+1:]...), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	removed.admin.closeIdle()
+	return removed.reader.Close()
+}
+
+func (r *Reader) update(change func(s *readerSet) ([]*readerCluster, error)) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+
+	old := r.set
+	clusters, err := change(old)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.set = newReaderSet(clusters)
+	r.mu.Unlock()
+
+	if r.stream != nil {
+		r.stream.sync()
+	}
+	close(old.retired)
+	old.inflight.Wait()
+	old.wp.StopWait()
+	return nil
+}
@@ -0,0 +1,170 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter_AddRemoveCluster(t *testing.T) {
+	fakes := newFakeWriters(2)
+	w := newTestWriter(RWModeMirror, fakes, WithWriterClusterNames("a", "b"))
+	defer w.Close()
+
+	added := &fakeWriter{}
+	assert.NoError(t, w.addCluster("c", kafka.WriterConfig{}, added))
+	assert.Equal(t, []string{"a", "b", "c"}, w.Clusters())
+
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("1")}))
+	assert.Equal(t, 1, added.written())
+
+	assert.NoError(t, w.RemoveCluster("a"))
+	assert.Equal(t, []string{"b", "c"}, w.Clusters())
+	assert.True(t, fakes[0].closed)
+	assert.Equal(t, "b", w.Health(0).Name)
+
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("2")}))
+	assert.Equal(t, 1, fakes[0].written())
+	assert.Equal(t, 2, fakes[1].written())
+	assert.Equal(t, 2, added.written())
+}
+
+func TestWriter_UpdateClustersErrors(t *testing.T) {
+	w := newTestWriter(RWModeMultiRW, newFakeWriters(2))
+
+	assert.True(t, errors.Is(w.addCluster("cluster-1", kafka.WriterConfig{}, &fakeWriter{}), ErrDuplicateCluster))
+	assert.True(t, errors.Is(w.RemoveCluster("unknown"), ErrUnknownCluster))
+	assert.NoError(t, w.RemoveCluster("cluster-0"))
+	assert.Equal(t, ErrLastCluster, w.RemoveCluster("cluster-1"))
+
+	w.Close()
+	assert.Error(t, w.addCluster("new", kafka.WriterConfig{}, &fakeWriter{}))
+}
+
+func TestWriter_DuplicateClusterNames(t *testing.T) {
+	fakes := newFakeWriters(2)
+	_, err := newWriter(RWModeMultiRW, make([]kafka.WriterConfig, 2), []ClusterWriter{fakes[0], fakes[1]}, WithWriterClusterNames("a", "a"))
+	assert.True(t, errors.Is(err, ErrDuplicateCluster))
+
+	// NewWriter 和 NewReader 在同样的情况下panic
+	configs := []kafka.WriterConfig{{Brokers: []string{"127.0.0.1:1"}, Topic: "test"}, {Brokers: []string{"127.0.0.1:2"}, Topic: "test"}}
+	assert.PanicsWithError(t, "mka: duplicate kafka cluster: a", func() { NewWriter(RWModeMultiRW, configs, WithWriterClusterNames("a", "a")) })
+	assert.PanicsWithError(t, ErrNoCluster.Error(), func() { NewReader(nil) })
+}
+
+func TestWriter_UpdateClustersWhileWriting(t *testing.T) {
+	w := newTestWriter(RWModeMultiRW, newFakeWriters(2))
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := w.WriteMessages(ctx, kafka.Message{Key: []byte("k"), Value: []byte("v")})
+				if ctx.Err() != nil {
+					return
+				}
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	for k := 0; k < 20; k++ {
+		assert.NoError(t, w.addCluster("extra", kafka.WriterConfig{}, &fakeWriter{}))
+		assert.NoError(t, w.RemoveCluster("extra"))
+	}
+	cancel()
+	wg.Wait()
+
+	assert.Equal(t, []string{"cluster-0", "cluster-1"}, w.Clusters())
+}
+
+func TestWriter_RemovePrimaryResetsFailback(t *testing.T) {
+	fakes := newFakeWriters(3)
+	fakes[0].setErr(errors.New("primary is down"))
+
+	var events []BackupEvent
+	var mu sync.Mutex
+	w := newTestWriter(RWModeBackup, fakes, WithFailback(FailbackConfig{
+		FailoverThreshold: 1,
+		ProbeInterval:     time.Hour,
+		Probe:             func(ctx context.Context) error { return errors.New("down") },
+		OnEvent: func(e BackupEvent) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		},
+	}))
+	defer w.Close()
+
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("v")}))
+	state, _ := w.BackupState()
+	assert.Equal(t, BackupStateFailedOver, state)
+
+	// 移除主集群之后原来的第一个从集群成为主集群
+	assert.NoError(t, w.RemoveCluster("cluster-0"))
+	state, active := w.BackupState()
+	assert.Equal(t, BackupStatePrimary, state)
+	assert.Equal(t, 0, active)
+
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("v")}))
+	assert.Equal(t, "cluster-1", w.Clusters()[0])
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, BackupStatePrimary, events[len(events)-1].To)
+}
+
+func TestReader_AddRemoveCluster(t *testing.T) {
+	r := NewReader([]kafka.ReaderConfig{
+		{Brokers: []string{"127.0.0.1:1"}, Topic: "test", MaxWait: 10 * time.Millisecond},
+		{Brokers: []string{"127.0.0.1:2"}, Topic: "test", MaxWait: 10 * time.Millisecond},
+	}, WithReaderClusterNames("a", "b"))
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ReadMessage(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// 正在进行的读取被打断之后换用新的集群列表, RemoveCluster 不需要等到读取超时
+	start := time.Now()
+	assert.NoError(t, r.RemoveCluster("a"))
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, []string{"b"}, r.Clusters())
+
+	assert.NoError(t, r.AddCluster("c", kafka.ReaderConfig{Brokers: []string{"127.0.0.1:3"}, Topic: "test"}))
+	assert.Equal(t, []string{"b", "c"}, r.Clusters())
+	assert.True(t, errors.Is(r.AddCluster("c", kafka.ReaderConfig{Brokers: []string{"127.0.0.1:3"}, Topic: "test"}), ErrDuplicateCluster))
+
+	cancel()
+	<-done
+}
+
+func TestReader_UnknownClusterIndex(t *testing.T) {
+	r, err := NewReaderFromClusters([]ClusterReader{&fakeReader{}}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// 集群被移除之后原来的索引无效
+	assert.NoError(t, r.AddClusterReader("b", &fakeReader{}))
+	assert.NoError(t, r.SetOffset(1, kafka.FirstOffset))
+	assert.NoError(t, r.RemoveCluster("b"))
+
+	assert.ErrorIs(t, r.SetOffset(1, kafka.FirstOffset), ErrUnknownCluster)
+	assert.ErrorIs(t, r.SetOffsetAt(context.Background(), 1, time.Now()), ErrUnknownCluster)
+	_, err = r.ReadLag(context.Background(), -1)
+	assert.ErrorIs(t, err, ErrUnknownCluster)
+}
@@ -0,0 +1,92 @@
+package mka
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// HeaderContentType 是记录消息值编码格式的header.
+const HeaderContentType = "mka-content-type"
+
+// Codec 负责消息值的编码和解码.
+type Codec interface {
+	// ContentType 是编码格式的名字, 写入时记录在消息的 HeaderContentType header中.
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal 把data解码到v中, v是指向目标值的指针.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec 使用JSON编码消息的值.
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec 使用gob编码消息的值, 每条消息单独编码, 所以每条消息都带有类型信息.
+type GobCodec struct{}
+
+func (GobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ProtobufCodec 使用protobuf编码消息的值, 值的类型必须实现 proto.Message.
+// 解码时v可以是 proto.Message, 也可以是指向 proto.Message 指针的指针, 这时会创建新的消息.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("mka: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	// v是 **T 时为 *T 分配新的消息
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		elem := rv.Elem()
+		if elem.IsNil() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		if m, ok := elem.Interface().(proto.Message); ok {
+			return proto.Unmarshal(data, m)
+		}
+	}
+	return fmt.Errorf("mka: %T is not a proto.Message", v)
+}
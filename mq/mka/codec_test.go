@@ -0,0 +1,168 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/multierr"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeReader 是测试用的单集群reader, 依次返回msgs中的消息, 读完之后阻塞直到ctx结束.
+type fakeReader struct {
+	mu        sync.Mutex
+	msgs      []kafka.Message
+	committed []kafka.Message
+	commitErr error
+}
+
+func (r *fakeReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.msgs) > 0 {
+		msg := r.msgs[0]
+		r.msgs = r.msgs[1:]
+		r.mu.Unlock()
+		return msg, nil
+	}
+	r.mu.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	return r.ReadMessage(ctx)
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.commitErr != nil {
+		return r.commitErr
+	}
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *fakeReader) Close() error                                       { return nil }
+func (r *fakeReader) Stats() kafka.ReaderStats                           { return kafka.ReaderStats{} }
+func (r *fakeReader) Lag() int64                                         { return 0 }
+func (r *fakeReader) Offset() int64                                      { return 0 }
+func (r *fakeReader) ReadLag(ctx context.Context) (int64, error)         { return 0, nil }
+func (r *fakeReader) SetOffset(offset int64) error                       { return nil }
+func (r *fakeReader) SetOffsetAt(ctx context.Context, t time.Time) error { return nil }
+
+type event struct {
+	ID   int
+	Name string
+}
+
+func TestCodec(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		data, err := codec.Marshal(event{ID: 1, Name: "a"})
+		assert.NoError(t, err)
+
+		var e event
+		assert.NoError(t, codec.Unmarshal(data, &e), codec.ContentType())
+		assert.Equal(t, event{ID: 1, Name: "a"}, e, codec.ContentType())
+	}
+
+	codec := ProtobufCodec{}
+	data, err := codec.Marshal(wrapperspb.String("a"))
+	assert.NoError(t, err)
+
+	var v *wrapperspb.StringValue
+	assert.NoError(t, codec.Unmarshal(data, &v))
+	assert.Equal(t, "a", v.GetValue())
+
+	_, err = codec.Marshal(event{})
+	assert.Error(t, err)
+	assert.Error(t, codec.Unmarshal(data, &event{}))
+}
+
+func TestTypedWriterReader(t *testing.T) {
+	fakes := newFakeWriters(1)
+	w := NewTypedWriter[event](newTestWriter(RWModeMultiRW, fakes), JSONCodec{})
+	defer w.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, w.Write(ctx, event{ID: 1, Name: "a"}))
+	assert.NoError(t, w.WriteMessages(ctx, TypedMessage[event]{
+		Key:     []byte("k"),
+		Value:   event{ID: 2, Name: "b"},
+		Headers: []kafka.Header{{Key: HeaderContentType, Value: []byte("text/plain")}, {Key: "h", Value: []byte("v")}},
+	}))
+
+	written := fakes[0].msgs
+	assert.Len(t, written, 2)
+	assert.Equal(t, "application/json", contentType(written[0]))
+	assert.Equal(t, "application/json", contentType(written[1]))
+	assert.Len(t, written[1].Headers, 2)
+
+	// 没有header的消息使用默认的codec, 其它格式按header选择codec
+	gob, err := GobCodec{}.Marshal(event{ID: 3, Name: "c"})
+	assert.NoError(t, err)
+	noHeader, err := JSONCodec{}.Marshal(event{ID: 4, Name: "d"})
+	assert.NoError(t, err)
+	msgs := append(written,
+		kafka.Message{Value: gob, Headers: []kafka.Header{{Key: HeaderContentType, Value: []byte("application/x-gob")}}},
+		kafka.Message{Value: noHeader},
+	)
+
+	rr, err := NewReaderFromClusters([]ClusterReader{&fakeReader{msgs: msgs}}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	r := NewTypedReader[event](rr, JSONCodec{}, GobCodec{})
+	defer r.Close()
+
+	var got []event
+	for len(got) < 4 {
+		typed, err := r.ReadMessage(ctx)
+		assert.NoError(t, err)
+		for _, m := range typed {
+			assert.Equal(t, "a", m.Raw.ClusterName)
+			got = append(got, m.Value)
+		}
+	}
+	assert.Equal(t, []event{{1, "a"}, {2, "b"}, {3, "c"}, {4, "d"}}, got)
+}
+
+func TestTypedReader_DecodeError(t *testing.T) {
+	pb, err := proto.Marshal(wrapperspb.String("a"))
+	assert.NoError(t, err)
+
+	msgs := []kafka.Message{
+		{Topic: "test", Offset: 7, Value: pb, Headers: []kafka.Header{{Key: HeaderContentType, Value: []byte("application/x-protobuf")}}},
+		{Topic: "test", Offset: 8, Value: []byte("{")},
+	}
+	rr, err := NewReaderFromClusters([]ClusterReader{&fakeReader{msgs: msgs}}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	r := NewTypedReader[event](rr, JSONCodec{})
+	defer r.Close()
+
+	var errs []error
+	for len(errs) < 2 {
+		typed, err := r.ReadMessage(context.Background())
+		assert.Empty(t, typed)
+		errs = append(errs, multierr.Errors(err)...)
+	}
+
+	var derr *DecodeError
+	assert.True(t, errors.As(errs[0], &derr))
+	assert.True(t, errors.Is(errs[0], ErrUnexpectedContentType))
+	assert.Equal(t, "application/x-protobuf", derr.ContentType)
+	assert.Equal(t, "a", derr.Message.ClusterName)
+	assert.Equal(t, int64(7), derr.Message.Offset)
+
+	assert.True(t, errors.As(errs[1], &derr))
+	assert.False(t, errors.Is(errs[1], ErrUnexpectedContentType))
+	assert.Equal(t, "", derr.ContentType)
+	assert.Equal(t, int64(8), derr.Message.Offset)
+	assert.Contains(t, derr.Error(), "cluster a")
+}
@@ -0,0 +1,61 @@
+package mka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/multierr"
+)
+
+// CommitMessages 提交 FetchMessages 返回的消息的offset.
+//
+// 消息按照 Message.ClusterName 提交到读取它的集群, 所以集群被增删导致索引变化之后仍然可以提交.
+// 不同集群的提交并发进行; 提交失败时返回的error包含每个失败集群的 ClusterError,
+// 集群已经被移除时 ClusterError 包装 ErrUnknownCluster. Reader 关闭之后返回 io.ErrClosedPipe.
+// 不使用consumer group的 *kafka.Reader 没有需要提交的offset, 提交到这样的集群总是成功.
+func (r *Reader) CommitMessages(ctx context.Context, msgs ...Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	set := r.acquire()
+	if set == nil {
+		return io.ErrClosedPipe
+	}
+	defer set.release()
+
+	// 按照集群分组, 保持每个集群中消息的顺序
+	var names []string
+	byCluster := make(map[string][]kafka.Message)
+	for _, msg := range msgs {
+		if _, ok := byCluster[msg.ClusterName]; !ok {
+			names = append(names, msg.ClusterName)
+		}
+		byCluster[msg.ClusterName] = append(byCluster[msg.ClusterName], msg.Message)
+	}
+
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for k, name := range names {
+		i := set.index(name)
+		if i < 0 {
+			errs[k] = ClusterError{Cluster: -1, Name: name, Err: fmt.Errorf("%w: %s", ErrUnknownCluster, name)}
+			continue
+		}
+
+		k, c, kmsgs := k, set.clusters[i], byCluster[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.commit(ctx, kmsgs...); err != nil {
+				errs[k] = ClusterError{Cluster: i, Name: c.name, Err: err}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return multierr.Combine(errs...)
+}
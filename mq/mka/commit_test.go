@@ -0,0 +1,61 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader_FetchCommit(t *testing.T) {
+	fakes := []*fakeReader{
+		{msgs: []kafka.Message{{Offset: 1, Value: []byte("a1")}, {Offset: 2, Value: []byte("a2")}}},
+		{msgs: []kafka.Message{{Offset: 7, Value: []byte("b7")}}},
+	}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]}, WithReaderClusterNames("a", "b"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	var fetched []Message
+	for len(fetched) < 3 {
+		msgs, err := r.FetchMessages(ctx)
+		assert.NoError(t, err)
+		fetched = append(fetched, msgs...)
+	}
+
+	assert.NoError(t, r.CommitMessages(ctx, fetched...))
+	assert.Len(t, fakes[0].committed, 2)
+	assert.Len(t, fakes[1].committed, 1)
+	assert.Equal(t, int64(7), fakes[1].committed[0].Offset)
+	assert.NoError(t, r.CommitMessages(ctx))
+
+	// 提交到已经被移除的集群和提交失败的集群
+	fakes[1].commitErr = kafka.RebalanceInProgress
+	err = r.CommitMessages(ctx,
+		Message{ClusterName: "c", Message: kafka.Message{Offset: 1}},
+		Message{ClusterName: "b", Message: kafka.Message{Offset: 8}},
+	)
+	assert.True(t, errors.Is(err, ErrUnknownCluster))
+	assert.True(t, errors.Is(err, kafka.RebalanceInProgress))
+
+	var cerr ClusterError
+	assert.True(t, errors.As(err, &cerr))
+	assert.Equal(t, "c", cerr.Name)
+
+	assert.NoError(t, r.Close())
+	assert.Equal(t, io.ErrClosedPipe, r.CommitMessages(ctx, fetched...))
+}
+
+func TestReader_CommitPartitionReader(t *testing.T) {
+	// 不使用consumer group的 kafka.Reader, 创建时不会连接broker
+	kr := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{"localhost:9092"}, Topic: "t", Partition: 0})
+	r, err := NewReaderFromClusters([]ClusterReader{kr}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.NoError(t, r.CommitMessages(context.Background(), Message{ClusterName: "a", Message: kafka.Message{Offset: 1}}))
+}
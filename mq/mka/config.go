@@ -0,0 +1,582 @@
+package mka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"go.uber.org/multierr"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultEnvPrefix 是 LoadConfig 读取环境变量覆盖配置时使用的前缀.
+const DefaultEnvPrefix = "MKA"
+
+// Config 是 mka 的声明式配置, 可以从YAML或者JSON文件加载,
+// 然后通过 NewWriterFromConfig 和 NewReaderFromConfig 创建 Writer 和 Reader.
+type Config struct {
+	// Mode 是写入模式, 可以是 multi-rw、backup 或者 mirror, 默认为 multi-rw.
+	Mode string `yaml:"mode" json:"mode"`
+	// Topic 是默认的topic, 集群可以单独设置自己的topic.
+	Topic string `yaml:"topic" json:"topic"`
+	// Region 是本地的区域. 设置之后, 同一区域的集群排在其它集群的前面,
+	// 所以主备模式下优先选择同一区域的集群作为主集群.
+	Region string `yaml:"region" json:"region"`
+	// ClientID 是连接kafka时使用的客户端ID.
+	ClientID string `yaml:"client_id" json:"client_id"`
+
+	Clusters []ClusterConfig `yaml:"clusters" json:"clusters"`
+	Failover FailoverConfig  `yaml:"failover" json:"failover"`
+	Writer   WriterSettings  `yaml:"writer" json:"writer"`
+	Reader   ReaderSettings  `yaml:"reader" json:"reader"`
+}
+
+// ClusterConfig 是单个kafka集群的配置.
+type ClusterConfig struct {
+	// Name 是集群的名字, 不能为空并且不能重复.
+	Name string `yaml:"name" json:"name"`
+	// Region 是集群所在的区域.
+	Region  string   `yaml:"region" json:"region"`
+	Brokers []string `yaml:"brokers" json:"brokers"`
+	// Topic 覆盖 Config.Topic.
+	Topic string `yaml:"topic" json:"topic"`
+
+	TLS  *TLSConfig  `yaml:"tls" json:"tls"`
+	SASL *SASLConfig `yaml:"sasl" json:"sasl"`
+
+	DialTimeout  Duration `yaml:"dial_timeout" json:"dial_timeout"`
+	ReadTimeout  Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout Duration `yaml:"write_timeout" json:"write_timeout"`
+}
+
+// TLSConfig 是连接kafka集群的TLS配置.
+type TLSConfig struct {
+	// CAFile 是校验服务端证书的CA证书文件, 为空时使用系统的CA.
+	CAFile string `yaml:"ca_file" json:"ca_file"`
+	// CertFile 和 KeyFile 是客户端证书, 需要同时设置.
+	CertFile           string `yaml:"cert_file" json:"cert_file"`
+	KeyFile            string `yaml:"key_file" json:"key_file"`
+	ServerName         string `yaml:"server_name" json:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+// SASLConfig 是连接kafka集群的SASL认证配置.
+type SASLConfig struct {
+	// Mechanism 可以是 plain、scram-sha-256 或者 scram-sha-512.
+	Mechanism string `yaml:"mechanism" json:"mechanism"`
+	Username  string `yaml:"username" json:"username"`
+	Password  string `yaml:"password" json:"password"`
+}
+
+// FailoverConfig 是写入失败时切换集群和熔断的配置, 零值字段使用默认值.
+type FailoverConfig struct {
+	MaxAttempts    int      `yaml:"max_attempts" json:"max_attempts"`
+	Backoff        Duration `yaml:"backoff" json:"backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff" json:"max_backoff"`
+	AttemptTimeout Duration `yaml:"attempt_timeout" json:"attempt_timeout"`
+
+	FailureThreshold int      `yaml:"failure_threshold" json:"failure_threshold"`
+	OpenTimeout      Duration `yaml:"open_timeout" json:"open_timeout"`
+
+	// Ack 是镜像模式下的确认策略, 可以是 all、majority 或者集群数, 默认为 all.
+	Ack string `yaml:"ack" json:"ack"`
+}
+
+// WriterSettings 是所有集群共用的kafka-go writer配置, 零值字段使用kafka-go的默认值.
+type WriterSettings struct {
+	BatchSize    int      `yaml:"batch_size" json:"batch_size"`
+	BatchBytes   int      `yaml:"batch_bytes" json:"batch_bytes"`
+	BatchTimeout Duration `yaml:"batch_timeout" json:"batch_timeout"`
+	// RequiredAcks 可以是 none、one 或者 all, 默认为 all.
+	RequiredAcks string `yaml:"required_acks" json:"required_acks"`
+	MaxAttempts  int    `yaml:"max_attempts" json:"max_attempts"`
+}
+
+// ReaderSettings 是所有集群共用的kafka-go reader配置, 零值字段使用kafka-go的默认值.
+type ReaderSettings struct {
+	GroupID   string   `yaml:"group_id" json:"group_id"`
+	Partition int      `yaml:"partition" json:"partition"`
+	MinBytes  int      `yaml:"min_bytes" json:"min_bytes"`
+	MaxBytes  int      `yaml:"max_bytes" json:"max_bytes"`
+	MaxWait   Duration `yaml:"max_wait" json:"max_wait"`
+	// StartOffset 可以是 first 或者 last, 默认为 first.
+	StartOffset    string   `yaml:"start_offset" json:"start_offset"`
+	CommitInterval Duration `yaml:"commit_interval" json:"commit_interval"`
+}
+
+// Duration 是可以用 "1s"、"500ms" 这样的字符串配置的 time.Duration.
+type Duration time.Duration
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalYAML 实现 yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+// MarshalYAML 实现 yaml.Marshaler.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalJSON 实现 json.Unmarshaler, 数字被当作纳秒.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = Duration(n)
+		return nil
+	}
+	return d.parse(s)
+}
+
+// MarshalJSON 实现 json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig 从YAML或者JSON文件加载配置, 扩展名为.json的文件按照JSON解析, 其它文件按照YAML解析.
+// 加载之后使用前缀为 DefaultEnvPrefix 的环境变量覆盖配置, 并校验配置.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("mka config: %w", err)
+	}
+
+	var config *Config
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		config, err = ParseJSONConfig(data)
+	} else {
+		config, err = ParseYAMLConfig(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config.ApplyEnv(DefaultEnvPrefix)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ParseYAMLConfig 解析YAML格式的配置, 不会校验配置.
+func ParseYAMLConfig(data []byte) (*Config, error) {
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("mka config: %w", err)
+	}
+	return &config, nil
+}
+
+// ParseJSONConfig 解析JSON格式的配置, 不会校验配置.
+func ParseJSONConfig(data []byte) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("mka config: %w", err)
+	}
+	return &config, nil
+}
+
+// ApplyEnv 使用环境变量覆盖配置. 支持的环境变量有:
+//
+//	<prefix>_MODE, <prefix>_TOPIC, <prefix>_REGION, <prefix>_GROUP_ID
+//	<prefix>_<NAME>_BROKERS (逗号分隔), <prefix>_<NAME>_TOPIC
+//	<prefix>_<NAME>_SASL_MECHANISM, <prefix>_<NAME>_SASL_USERNAME, <prefix>_<NAME>_SASL_PASSWORD
+//
+// 其中NAME是集群名字的大写形式, 字母和数字之外的字符被替换为下划线.
+func (c *Config) ApplyEnv(prefix string) {
+	c.applyEnv(prefix, os.LookupEnv)
+}
+
+func (c *Config) applyEnv(prefix string, lookup func(key string) (string, bool)) {
+	env := func(dst *string, keys ...string) {
+		if v, ok := lookup(envKey(prefix, keys...)); ok {
+			*dst = v
+		}
+	}
+
+	env(&c.Mode, "MODE")
+	env(&c.Topic, "TOPIC")
+	env(&c.Region, "REGION")
+	env(&c.Reader.GroupID, "GROUP_ID")
+
+	for i := range c.Clusters {
+		cc := &c.Clusters[i]
+		if v, ok := lookup(envKey(prefix, cc.Name, "BROKERS")); ok {
+			cc.Brokers = splitList(v)
+		}
+		env(&cc.Topic, cc.Name, "TOPIC")
+
+		var sc SASLConfig
+		if cc.SASL != nil {
+			sc = *cc.SASL
+		}
+		env(&sc.Mechanism, cc.Name, "SASL_MECHANISM")
+		env(&sc.Username, cc.Name, "SASL_USERNAME")
+		env(&sc.Password, cc.Name, "SASL_PASSWORD")
+		if sc != (SASLConfig{}) {
+			cc.SASL = &sc
+		}
+	}
+}
+
+func envKey(prefix string, keys ...string) string {
+	parts := append([]string{prefix}, keys...)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.Join(parts, "_"))
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Validate 校验配置, 返回的错误包含所有不合法的配置项.
+func (c *Config) Validate() error {
+	var err error
+	fail := func(format string, args ...interface{}) {
+		err = multierr.Append(err, fmt.Errorf("mka config: "+format, args...))
+	}
+
+	if _, e := c.rwmode(); e != nil {
+		fail("%v", e)
+	}
+	if _, e := c.ackPolicy(); e != nil {
+		fail("%v", e)
+	}
+	if len(c.Clusters) == 0 {
+		fail("no kafka cluster is configured")
+	}
+
+	names := make(map[string]int)
+	for i, cc := range c.Clusters {
+		field := fmt.Sprintf("clusters[%d]", i)
+		if cc.Name == "" {
+			fail("%s: name is empty", field)
+		} else if j, ok := names[cc.Name]; ok {
+			fail("%s: name %q is already used by clusters[%d]", field, cc.Name, j)
+		} else {
+			names[cc.Name] = i
+			field = fmt.Sprintf("%s (%s)", field, cc.Name)
+		}
+
+		if len(cc.Brokers) == 0 {
+			fail("%s: brokers is empty", field)
+		}
+		if cc.Topic == "" && c.Topic == "" {
+			fail("%s: topic is empty", field)
+		}
+		if cc.TLS != nil && (cc.TLS.CertFile == "") != (cc.TLS.KeyFile == "") {
+			fail("%s: tls cert_file and key_file must be set together", field)
+		}
+		if cc.SASL != nil {
+			if _, e := cc.SASL.mechanism(); e != nil {
+				fail("%s: %v", field, e)
+			}
+		}
+	}
+
+	if _, e := requiredAcks(c.Writer.RequiredAcks); e != nil {
+		fail("writer: %v", e)
+	}
+	if _, e := startOffset(c.Reader.StartOffset); e != nil {
+		fail("reader: %v", e)
+	}
+
+	return err
+}
+
+func (c *Config) rwmode() (RWMode, error) {
+	switch strings.ToLower(c.Mode) {
+	case "", "multi-rw", "multirw":
+		return RWModeMultiRW, nil
+	case "backup":
+		return RWModeBackup, nil
+	case "mirror":
+		return RWModeMirror, nil
+	default:
+		return 0, fmt.Errorf("unknown mode %q, must be multi-rw, backup or mirror", c.Mode)
+	}
+}
+
+func (c *Config) ackPolicy() (AckPolicy, error) {
+	switch strings.ToLower(c.Failover.Ack) {
+	case "", "all":
+		return AckAll, nil
+	case "majority":
+		return AckMajority, nil
+	}
+
+	k, err := strconv.Atoi(c.Failover.Ack)
+	if err != nil || k <= 0 {
+		return nil, fmt.Errorf("invalid failover ack %q, must be all, majority or a positive number", c.Failover.Ack)
+	}
+	return AckAtLeast(k), nil
+}
+
+func requiredAcks(s string) (kafka.RequiredAcks, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return kafka.RequireAll, nil
+	case "one":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	default:
+		return 0, fmt.Errorf("invalid required_acks %q, must be none, one or all", s)
+	}
+}
+
+func startOffset(s string) (int64, error) {
+	switch strings.ToLower(s) {
+	case "", "first":
+		return kafka.FirstOffset, nil
+	case "last":
+		return kafka.LastOffset, nil
+	default:
+		return 0, fmt.Errorf("invalid start_offset %q, must be first or last", s)
+	}
+}
+
+func (c *SASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch strings.ToLower(c.Mechanism) {
+	case "", "plain":
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	default:
+		return nil, fmt.Errorf("unknown sasl mechanism %q, must be plain, scram-sha-256 or scram-sha-512", c.Mechanism)
+	}
+}
+
+func (c *TLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// clusters 返回按照区域排序之后的集群, 和 Config.Region 相同区域的集群排在前面.
+func (c *Config) clusters() []ClusterConfig {
+	clusters := append([]ClusterConfig(nil), c.Clusters...)
+	if c.Region != "" {
+		sort.SliceStable(clusters, func(i, j int) bool {
+			return clusters[i].Region == c.Region && clusters[j].Region != c.Region
+		})
+	}
+	return clusters
+}
+
+func (c *Config) dialer(cc ClusterConfig) (*kafka.Dialer, error) {
+	dialer := &kafka.Dialer{
+		ClientID:  c.ClientID,
+		Timeout:   time.Duration(cc.DialTimeout),
+		DualStack: true,
+	}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = 10 * time.Second
+	}
+
+	if cc.TLS != nil {
+		config, err := cc.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("mka config: cluster %s: tls: %w", cc.Name, err)
+		}
+		dialer.TLS = config
+	}
+
+	if cc.SASL != nil {
+		mechanism, err := cc.SASL.mechanism()
+		if err != nil {
+			return nil, fmt.Errorf("mka config: cluster %s: sasl: %w", cc.Name, err)
+		}
+		dialer.SASLMechanism = mechanism
+	}
+
+	return dialer, nil
+}
+
+func (c *Config) topic(cc ClusterConfig) string {
+	if cc.Topic != "" {
+		return cc.Topic
+	}
+	return c.Topic
+}
+
+// WriterConfigs 校验配置并返回每个集群的 kafka.WriterConfig 和集群的名字.
+func (c *Config) WriterConfigs() ([]kafka.WriterConfig, []string, error) {
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	acks, _ := requiredAcks(c.Writer.RequiredAcks)
+
+	var configs []kafka.WriterConfig
+	var names []string
+	for _, cc := range c.clusters() {
+		dialer, err := c.dialer(cc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		config := kafka.WriterConfig{
+			Brokers:      cc.Brokers,
+			Topic:        c.topic(cc),
+			Dialer:       dialer,
+			ReadTimeout:  time.Duration(cc.ReadTimeout),
+			WriteTimeout: time.Duration(cc.WriteTimeout),
+			BatchSize:    c.Writer.BatchSize,
+			BatchBytes:   c.Writer.BatchBytes,
+			BatchTimeout: time.Duration(c.Writer.BatchTimeout),
+			RequiredAcks: int(acks),
+			MaxAttempts:  c.Writer.MaxAttempts,
+		}
+		if err := config.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("mka config: cluster %s: %w", cc.Name, err)
+		}
+
+		configs = append(configs, config)
+		names = append(names, cc.Name)
+	}
+
+	return configs, names, nil
+}
+
+// ReaderConfigs 校验配置并返回每个集群的 kafka.ReaderConfig 和集群的名字.
+func (c *Config) ReaderConfigs() ([]kafka.ReaderConfig, []string, error) {
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	offset, _ := startOffset(c.Reader.StartOffset)
+
+	var configs []kafka.ReaderConfig
+	var names []string
+	for _, cc := range c.clusters() {
+		dialer, err := c.dialer(cc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		config := kafka.ReaderConfig{
+			Brokers:        cc.Brokers,
+			Topic:          c.topic(cc),
+			GroupID:        c.Reader.GroupID,
+			Partition:      c.Reader.Partition,
+			Dialer:         dialer,
+			MinBytes:       c.Reader.MinBytes,
+			MaxBytes:       c.Reader.MaxBytes,
+			MaxWait:        time.Duration(c.Reader.MaxWait),
+			StartOffset:    offset,
+			CommitInterval: time.Duration(c.Reader.CommitInterval),
+		}
+		if err := config.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("mka config: cluster %s: %w", cc.Name, err)
+		}
+
+		configs = append(configs, config)
+		names = append(names, cc.Name)
+	}
+
+	return configs, names, nil
+}
+
+// NewWriterFromConfig 根据配置创建 Writer, 配置不合法时返回错误而不是panic.
+// opts 在配置之后应用, 可以覆盖配置中的选项.
+func NewWriterFromConfig(config Config, opts ...WriterOption) (*Writer, error) {
+	configs, names, err := config.WriterConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	rwmode, _ := config.rwmode()
+	ackPolicy, _ := config.ackPolicy()
+	f := config.Failover
+	opts = append([]WriterOption{
+		WithWriterClusterNames(names...),
+		WithAckPolicy(ackPolicy),
+		WithBreaker(BreakerConfig{
+			FailureThreshold: f.FailureThreshold,
+			OpenTimeout:      time.Duration(f.OpenTimeout),
+		}),
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    f.MaxAttempts,
+			Backoff:        time.Duration(f.Backoff),
+			MaxBackoff:     time.Duration(f.MaxBackoff),
+			AttemptTimeout: time.Duration(f.AttemptTimeout),
+		}),
+	}, opts...)
+
+	return newKafkaWriter(rwmode, configs, opts...)
+}
+
+// NewReaderFromConfig 根据配置创建 Reader, 配置不合法时返回错误而不是panic.
+// opts 在配置之后应用, 可以覆盖配置中的选项.
+func NewReaderFromConfig(config Config, opts ...ReaderOption) (*Reader, error) {
+	configs, names, err := config.ReaderConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]ReaderOption{WithReaderClusterNames(names...)}, opts...)
+	return newKafkaReader(configs, opts...)
+}
@@ -0,0 +1,195 @@
+package mka
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testYAMLConfig = `
+mode: backup
+topic: orders
+region: us-east
+client_id: svc
+clusters:
+  - name: west
+    region: us-west
+    brokers: [west-1:9092, west-2:9092]
+    sasl:
+      mechanism: scram-sha-512
+      username: u
+      password: p
+  - name: east
+    region: us-east
+    brokers: [east-1:9092]
+    topic: orders-east
+    dial_timeout: 3s
+    tls:
+      insecure_skip_verify: true
+failover:
+  max_attempts: 3
+  backoff: 100ms
+  failure_threshold: 2
+  open_timeout: 10s
+writer:
+  batch_size: 10
+  required_acks: one
+reader:
+  group_id: g
+  max_wait: 500ms
+  start_offset: last
+`
+
+func TestParseYAMLConfig(t *testing.T) {
+	config, err := ParseYAMLConfig([]byte(testYAMLConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, "backup", config.Mode)
+	assert.Len(t, config.Clusters, 2)
+	assert.Equal(t, Duration(3*time.Second), config.Clusters[1].DialTimeout)
+	assert.Equal(t, Duration(100*time.Millisecond), config.Failover.Backoff)
+
+	configs, names, err := config.WriterConfigs()
+	if !assert.NoError(t, err) {
+		return
+	}
+	// 和本地同一区域的集群排在前面
+	assert.Equal(t, []string{"east", "west"}, names)
+	assert.Equal(t, "orders-east", configs[0].Topic)
+	assert.Equal(t, "orders", configs[1].Topic)
+	assert.Equal(t, 3*time.Second, configs[0].Dialer.Timeout)
+	assert.NotNil(t, configs[0].Dialer.TLS)
+	assert.Equal(t, "SCRAM-SHA-512", configs[1].Dialer.SASLMechanism.Name())
+	assert.Equal(t, int(kafka.RequireOne), configs[0].RequiredAcks)
+
+	rconfigs, _, err := config.ReaderConfigs()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "g", rconfigs[0].GroupID)
+		assert.Equal(t, kafka.LastOffset, rconfigs[0].StartOffset)
+		assert.Equal(t, 500*time.Millisecond, rconfigs[0].MaxWait)
+	}
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	config, err := ParseJSONConfig([]byte(`{
+		"mode": "mirror",
+		"topic": "t",
+		"clusters": [{"name": "a", "brokers": ["a:9092"]}, {"name": "b", "brokers": ["b:9092"]}],
+		"failover": {"ack": "majority", "attempt_timeout": "2s", "backoff": 1000}
+	}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, Duration(2*time.Second), config.Failover.AttemptTimeout)
+	assert.Equal(t, Duration(1000), config.Failover.Backoff)
+
+	_, err = ParseJSONConfig([]byte(`{"failover": {"backoff": true}}`))
+	assert.Error(t, err)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.EqualError(t, (&Config{}).Validate(), "mka config: no kafka cluster is configured")
+
+	config := Config{
+		Mode: "active-active",
+		Clusters: []ClusterConfig{
+			{Name: "a", Brokers: []string{"a:9092"}},
+			{Name: "a"},
+			{Brokers: []string{"c:9092"}, SASL: &SASLConfig{Mechanism: "gssapi"}},
+		},
+		Failover: FailoverConfig{Ack: "-1"},
+	}
+	err := config.Validate()
+	if assert.Error(t, err) {
+		msg := err.Error()
+		assert.Contains(t, msg, `unknown mode "active-active"`)
+		assert.Contains(t, msg, `invalid failover ack "-1"`)
+		assert.Contains(t, msg, `clusters[1]: name "a" is already used by clusters[0]`)
+		assert.Contains(t, msg, `clusters[1]: brokers is empty`)
+		assert.Contains(t, msg, `clusters[2]: name is empty`)
+		assert.Contains(t, msg, `clusters[0] (a): topic is empty`)
+		assert.Contains(t, msg, `unknown sasl mechanism "gssapi"`)
+	}
+}
+
+func TestConfig_ApplyEnv(t *testing.T) {
+	config, err := ParseYAMLConfig([]byte(testYAMLConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	env := map[string]string{
+		"APP_TOPIC":              "payments",
+		"APP_WEST_BROKERS":       "w1:9092, w2:9092,",
+		"APP_EAST_SASL_USERNAME": "east-user",
+		"APP_EAST_SASL_PASSWORD": "secret",
+	}
+	config.applyEnv("APP", func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	})
+
+	assert.Equal(t, "payments", config.Topic)
+	assert.Equal(t, []string{"w1:9092", "w2:9092"}, config.Clusters[0].Brokers)
+	assert.Equal(t, "u", config.Clusters[0].SASL.Username)
+	assert.Equal(t, &SASLConfig{Username: "east-user", Password: "secret"}, config.Clusters[1].SASL)
+	assert.Equal(t, "APP_MY_CLUSTER_1_BROKERS", envKey("APP", "my-cluster.1", "BROKERS"))
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mka.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(testYAMLConfig), 0o644))
+
+	t.Setenv("MKA_MODE", "mirror")
+	config, err := LoadConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mirror", config.Mode)
+	}
+
+	path = filepath.Join(dir, "mka.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"clusters": []}`), 0o644))
+	_, err = LoadConfig(path)
+	assert.EqualError(t, err, "mka config: no kafka cluster is configured")
+
+	_, err = LoadConfig(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestNewWriterFromConfig(t *testing.T) {
+	_, err := NewWriterFromConfig(Config{})
+	assert.Error(t, err)
+
+	config, _ := ParseYAMLConfig([]byte(testYAMLConfig))
+	w, err := NewWriterFromConfig(*config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	assert.Equal(t, RWModeBackup, w.rwmode)
+	assert.Equal(t, []string{"east", "west"}, w.Clusters())
+	assert.Equal(t, 3, w.retry.MaxAttempts)
+	assert.Equal(t, 2, w.breakerConfig.FailureThreshold)
+}
+
+func TestNewReaderFromConfig(t *testing.T) {
+	config, _ := ParseYAMLConfig([]byte(testYAMLConfig))
+	config.Reader.Partition = 1
+	_, err := NewReaderFromConfig(*config)
+	assert.Error(t, err, "GroupID and Partition cannot both be set")
+
+	config.Reader.Partition = 0
+	r, err := NewReaderFromConfig(*config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"east", "west"}, r.Clusters())
+		r.Close()
+	}
+}
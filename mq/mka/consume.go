@@ -0,0 +1,480 @@
+package mka
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// consumeQueueSize 是 Consume 每个worker等待处理的消息数上限.
+	consumeQueueSize = 16
+	// defaultCommitTimeout 是 Consume 每次提交offset的默认超时时间.
+	defaultCommitTimeout = 10 * time.Second
+)
+
+// Handler 处理 Consume 读取到的消息. 返回错误时消息会按照重试策略重新处理.
+type Handler interface {
+	Handle(ctx context.Context, msg Message) error
+}
+
+// HandlerFunc 把函数转换为 Handler.
+type HandlerFunc func(ctx context.Context, msg Message) error
+
+// Handle 调用f(ctx, msg).
+func (f HandlerFunc) Handle(ctx context.Context, msg Message) error {
+	return f(ctx, msg)
+}
+
+// Ordering 是 Consume 并发处理消息时保证的顺序.
+type Ordering int
+
+const (
+	// OrderByPartition 保证同一个集群的同一个分区中的消息按照读取的顺序处理, 这是默认的顺序.
+	OrderByPartition Ordering = iota
+	// OrderByKey 保证key相同的消息按照读取的顺序处理, 不管它们来自哪个集群. 没有key的消息按照分区保证顺序.
+	OrderByKey
+	// OrderNone 不保证处理的顺序.
+	OrderNone
+)
+
+// PanicError 是 Handler panic 时返回的错误.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("mka: handler panic: %v", e.Value)
+}
+
+// HandlerError 表示消息重试之后仍然处理失败, Errs 是每次处理的错误.
+type HandlerError struct {
+	Message Message
+	Errs    []error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("mka: handle message %s/%d@%d from cluster %s failed after %d attempts: %v",
+		e.Message.Topic, e.Message.Partition, e.Message.Offset, e.Message.ClusterName, len(e.Errs), e.Errs[len(e.Errs)-1])
+}
+
+func (e *HandlerError) Unwrap() []error {
+	return e.Errs
+}
+
+// ConsumeHooks 是 Consume 的生命周期回调, 为nil的回调不会被调用.
+type ConsumeHooks struct {
+	// OnStart 在开始读取消息之前调用.
+	OnStart func()
+	// OnStop 在 Consume 返回之前调用, err 是 Consume 将要返回的错误.
+	OnStop func(err error)
+	// OnError 在处理消息、读取消息、提交offset或者写入dead-letter sink失败时调用,
+	// 读取失败时msg为nil. 它会被多个worker并发调用.
+	OnError func(msg *Message, err error)
+}
+
+// ConsumeOption 是 Consume 的可选配置.
+type ConsumeOption func(*consumer)
+
+// WithConcurrency 设置并发处理消息的worker数, 默认为1.
+func WithConcurrency(n int) ConsumeOption {
+	return func(c *consumer) {
+		if n > 0 {
+			c.concurrency = n
+		}
+	}
+}
+
+// WithOrdering 设置并发处理时保证的顺序, 默认为 OrderByPartition.
+func WithOrdering(ordering Ordering) ConsumeOption {
+	return func(c *consumer) {
+		c.ordering = ordering
+	}
+}
+
+// WithHandlerRetry 设置消息处理失败时的重试策略. MaxAttempts 是每条消息最多处理的次数, 默认为1, 不重试;
+// AttemptTimeout 是每次处理的超时时间. Clusters 不起作用.
+func WithHandlerRetry(policy RetryPolicy) ConsumeOption {
+	return func(c *consumer) {
+		c.retry = policy
+	}
+}
+
+// WithConsumeDeadLetter 设置重试之后仍然处理失败的消息写入的dead-letter sink.
+// 消息带有 HeaderDeadLetterTopic、HeaderDeadLetterTime header, 以及每次处理失败的 HeaderDeadLetterError header.
+// 写入sink之后消息的offset会被提交. Consume 返回时不会关闭sink.
+func WithConsumeDeadLetter(sink DeadLetterSink) ConsumeOption {
+	return func(c *consumer) {
+		c.deadLetter = sink
+	}
+}
+
+// WithCommitTimeout 设置 Consume 每次提交offset的超时时间, 默认为10秒.
+// Consume 停止之后仍然会提交已经完成的消息, 超时保证broker没有响应时 Consume 也能返回.
+func WithCommitTimeout(d time.Duration) ConsumeOption {
+	return func(c *consumer) {
+		if d > 0 {
+			c.commitTimeout = d
+		}
+	}
+}
+
+// WithConsumeHooks 设置 Consume 的生命周期回调.
+func WithConsumeHooks(hooks ConsumeHooks) ConsumeOption {
+	return func(c *consumer) {
+		c.hooks = hooks
+	}
+}
+
+// consumer 是一次 Consume 的状态.
+type consumer struct {
+	r       *Reader
+	handler Handler
+
+	concurrency int
+	ordering    Ordering
+	retry       RetryPolicy
+	deadLetter  DeadLetterSink
+	hooks       ConsumeHooks
+	// commitTimeout 是每次提交offset的超时时间.
+	commitTimeout time.Duration
+
+	offsets offsetTracker
+	// fetchPolicy 是读取失败之后重试的等待策略.
+	fetchPolicy RetryPolicy
+
+	// cancel 停止读取, err 是导致停止的第一个错误.
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	err    error
+}
+
+// Consume 使用 FetchMessages 从r读取消息并交给handler处理, 直到ctx结束、r被关闭或者出现无法处理的消息.
+//
+// 消息由 WithConcurrency 个worker并发处理, 按照 WithOrdering 保证顺序. handler返回错误或者panic时,
+// 消息按照 WithHandlerRetry 重新处理, 仍然失败时写入 WithConsumeDeadLetter 设置的sink;
+// 没有设置sink或者写入失败时 Consume 停止, 返回 *HandlerError.
+// 消息处理成功或者写入sink之后才会提交offset, 并且只有分区中之前的消息都完成之后才会提交.
+//
+// ctx结束时 Consume 停止读取, 等待正在处理的消息完成, 没有处理的消息不会提交, 然后返回ctx的错误.
+// r被关闭时返回nil.
+func Consume(ctx context.Context, r *Reader, handler Handler, opts ...ConsumeOption) error {
+	c := &consumer{
+		r:             r,
+		handler:       handler,
+		concurrency:   1,
+		commitTimeout: defaultCommitTimeout,
+		offsets:       offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)},
+		fetchPolicy:   RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 5 * time.Second, Jitter: 0.2},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c.run(ctx)
+}
+
+func (c *consumer) run(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	c.cancel = cancel
+
+	if c.hooks.OnStart != nil {
+		c.hooks.OnStart()
+	}
+
+	queues := make([]chan *tracked, c.concurrency)
+	var wg sync.WaitGroup
+	for i := range queues {
+		q := make(chan *tracked, consumeQueueSize)
+		queues[i] = q
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range q {
+				c.process(ctx, t)
+			}
+		}()
+	}
+
+	c.fetch(ctx, queues)
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+
+	err := c.failure()
+	if err == nil {
+		err = parent.Err()
+	}
+	if c.hooks.OnStop != nil {
+		c.hooks.OnStop(err)
+	}
+	return err
+}
+
+// fetch 读取消息并分发给worker, 直到ctx结束或者reader被关闭.
+func (c *consumer) fetch(ctx context.Context, queues []chan *tracked) {
+	var next uint64
+	failures := 0
+	for {
+		msgs, err := c.r.FetchMessages(ctx)
+		if ctx.Err() != nil || err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			c.onError(nil, err)
+			failures++
+			if c.fetchPolicy.wait(ctx, failures) != nil {
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		for _, msg := range msgs {
+			t := c.offsets.add(msg)
+			next++
+			select {
+			case queues[c.queue(msg, next, len(queues))] <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// queue 返回处理msg的worker, 需要保证顺序的消息总是交给同一个worker.
+func (c *consumer) queue(msg Message, next uint64, n int) int {
+	if n == 1 {
+		return 0
+	}
+	if c.ordering == OrderNone {
+		return int(next % uint64(n))
+	}
+
+	h := fnv.New32a()
+	if c.ordering == OrderByKey && len(msg.Key) > 0 {
+		h.Write(msg.Key)
+	} else {
+		var partition [8]byte
+		binary.BigEndian.PutUint64(partition[:], uint64(msg.Partition))
+		h.Write([]byte(msg.ClusterName))
+		h.Write([]byte(msg.Topic))
+		h.Write(partition[:])
+	}
+	return int(h.Sum32() % uint32(n))
+}
+
+// process 处理一条消息, 处理成功或者写入dead-letter sink之后提交offset.
+// Consume 停止之后不再处理还在队列中的消息, 被停止打断的消息也不会写入sink.
+func (c *consumer) process(ctx context.Context, t *tracked) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if herr := c.handle(ctx, t.msg); herr != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := c.deadLetterMessage(ctx, herr); err != nil {
+			if ctx.Err() == nil {
+				c.fail(err)
+			}
+			return
+		}
+	}
+
+	c.commit(t)
+}
+
+// handle 按照重试策略处理消息, 最终失败时返回 *HandlerError.
+func (c *consumer) handle(ctx context.Context, msg Message) *HandlerError {
+	attempts := c.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var errs []error
+	for attempt := 1; ; attempt++ {
+		err := c.call(ctx, msg)
+		if err == nil {
+			return nil
+		}
+
+		c.onError(&msg, err)
+		errs = append(errs, err)
+		if attempt >= attempts || c.retry.wait(ctx, attempt) != nil {
+			return &HandlerError{Message: msg, Errs: errs}
+		}
+	}
+}
+
+// call 调用handler处理一次消息, handler的panic被转换为 *PanicError.
+func (c *consumer) call(ctx context.Context, msg Message) (err error) {
+	if c.retry.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.retry.AttemptTimeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	return c.handler.Handle(ctx, msg)
+}
+
+// deadLetterMessage 把处理失败的消息写入dead-letter sink, 没有设置sink或者写入失败时返回错误.
+func (c *consumer) deadLetterMessage(ctx context.Context, herr *HandlerError) error {
+	if c.deadLetter == nil {
+		return herr
+	}
+
+	reasons := make([]string, len(herr.Errs))
+	for i, err := range herr.Errs {
+		reasons[i] = err.Error()
+	}
+	dead := deadLetterMessage(herr.Message.Message, reasons, []byte(time.Now().Format(time.RFC3339Nano)))
+
+	if err := c.deadLetter.WriteMessages(ctx, dead); err != nil {
+		err = fmt.Errorf("%w: dead letter: %w", herr, err)
+		c.onError(&herr.Message, err)
+		return err
+	}
+	return nil
+}
+
+// commit 标记消息已经完成, 提交分区中已经完成的连续消息中最后一条的offset.
+// Consume 停止之后仍然会提交已经完成的消息, 每次提交最多等待 commitTimeout.
+func (c *consumer) commit(t *tracked) {
+	c.offsets.complete(t, func(msg Message) {
+		ctx, cancel := context.WithTimeout(context.Background(), c.commitTimeout)
+		defer cancel()
+		if err := c.r.CommitMessages(ctx, msg); err != nil {
+			c.onError(&msg, err)
+		}
+	})
+}
+
+func (c *consumer) onError(msg *Message, err error) {
+	if c.hooks.OnError != nil {
+		c.hooks.OnError(msg, err)
+	}
+}
+
+// fail 记录第一个无法处理的错误并停止 Consume.
+func (c *consumer) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+func (c *consumer) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// partitionKey 标识一个集群中topic的一个分区.
+type partitionKey struct {
+	cluster   string
+	topic     string
+	partition int
+}
+
+// tracked 是已经读取还没有提交的消息.
+type tracked struct {
+	msg       Message
+	partition *partitionOffsets
+	done      bool
+}
+
+// partitionOffsets 按照读取的顺序记录一个分区中还没有提交的消息.
+type partitionOffsets struct {
+	key     partitionKey
+	pending []*tracked
+	// commits 是正在提交这个分区的offset的worker数, 没有消息也没有提交时从 offsetTracker 中删除这个分区.
+	commits int
+
+	// commitMu 保证同一个分区的提交依次进行, committed 是最后提交的offset.
+	commitMu  sync.Mutex
+	committed int64
+	hasCommit bool
+}
+
+// offsetTracker 记录每个分区中已经读取的消息, 只提交之前的消息都已经完成的消息,
+// 这样并发处理时offset也不会越过还没有完成的消息.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+func (o *offsetTracker) add(msg Message) *tracked {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := partitionKey{cluster: msg.ClusterName, topic: msg.Topic, partition: msg.Partition}
+	p := o.partitions[key]
+	if p == nil {
+		p = &partitionOffsets{key: key}
+		o.partitions[key] = p
+	}
+
+	t := &tracked{msg: msg, partition: p}
+	p.pending = append(p.pending, t)
+	return t
+}
+
+// complete 标记t已经完成. 分区开头有连续完成的消息时, 对其中最后一条消息调用commit.
+// 分区的消息都已经提交之后把它从 offsetTracker 中删除, 之后读取到这个分区的消息时重新创建.
+func (o *offsetTracker) complete(t *tracked, commit func(Message)) {
+	p := t.partition
+
+	o.mu.Lock()
+	t.done = true
+	var last *tracked
+	for len(p.pending) > 0 && p.pending[0].done {
+		last = p.pending[0]
+		p.pending[0] = nil
+		p.pending = p.pending[1:]
+	}
+	if last != nil {
+		p.commits++
+	}
+	o.mu.Unlock()
+
+	if last == nil {
+		return
+	}
+
+	p.commitMu.Lock()
+	// 并发完成的worker可能后提交较小的offset, 跳过它们
+	if !p.hasCommit || last.msg.Offset > p.committed {
+		commit(last.msg)
+		p.committed = last.msg.Offset
+		p.hasCommit = true
+	}
+	p.commitMu.Unlock()
+
+	// 还有提交在进行时不能删除, 否则新创建的分区可能先提交较大的offset
+	o.mu.Lock()
+	p.commits--
+	if len(p.pending) == 0 && p.commits == 0 && o.partitions[p.key] == p {
+		delete(o.partitions, p.key)
+	}
+	o.mu.Unlock()
+}
@@ -0,0 +1,247 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func (r *fakeReader) commits() []kafka.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]kafka.Message(nil), r.committed...)
+}
+
+// lastCommitted 返回每个分区最后提交的offset.
+func lastCommitted(msgs []kafka.Message) map[int]int64 {
+	last := make(map[int]int64)
+	for _, msg := range msgs {
+		if o, ok := last[msg.Partition]; !ok || msg.Offset > o {
+			last[msg.Partition] = msg.Offset
+		}
+	}
+	return last
+}
+
+func partitionMessages(partitions, n int) []kafka.Message {
+	var msgs []kafka.Message
+	for i := 0; i < n; i++ {
+		for p := 0; p < partitions; p++ {
+			msgs = append(msgs, kafka.Message{Topic: "test", Partition: p, Offset: int64(i), Value: []byte(strconv.Itoa(i))})
+		}
+	}
+	return msgs
+}
+
+func TestConsume(t *testing.T) {
+	fake := &fakeReader{msgs: partitionMessages(4, 25)}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := make(map[int][]int64)
+	var started, stopped int32
+	var stopErr error
+	handler := HandlerFunc(func(ctx context.Context, msg Message) error {
+		time.Sleep(time.Duration(msg.Offset%3) * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		seen[msg.Partition] = append(seen[msg.Partition], msg.Offset)
+		if len(seen[0])+len(seen[1])+len(seen[2])+len(seen[3]) == 100 {
+			cancel()
+		}
+		return nil
+	})
+
+	err = Consume(ctx, r, handler, WithConcurrency(4), WithConsumeHooks(ConsumeHooks{
+		OnStart: func() { atomic.AddInt32(&started, 1) },
+		OnStop: func(err error) {
+			atomic.AddInt32(&stopped, 1)
+			stopErr = err
+		},
+	}))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, stopErr)
+	assert.Equal(t, int32(1), started)
+	assert.Equal(t, int32(1), stopped)
+
+	// 同一个分区的消息按照顺序处理
+	for p := 0; p < 4; p++ {
+		assert.Len(t, seen[p], 25)
+		for i, o := range seen[p] {
+			assert.Equal(t, int64(i), o)
+		}
+	}
+	assert.Equal(t, map[int]int64{0: 24, 1: 24, 2: 24, 3: 24}, lastCommitted(fake.commits()))
+}
+
+func TestConsume_RetryAndDeadLetter(t *testing.T) {
+	fake := &fakeReader{msgs: []kafka.Message{
+		{Topic: "test", Offset: 0, Value: []byte("panic")},
+		{Topic: "test", Offset: 1, Value: []byte("bad")},
+		{Topic: "test", Offset: 2, Value: []byte("ok")},
+	}}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	dlq := &fakeWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var panicked int32
+	var errs []error
+	handler := HandlerFunc(func(ctx context.Context, msg Message) error {
+		switch string(msg.Value) {
+		case "panic":
+			if atomic.AddInt32(&panicked, 1) == 1 {
+				panic("boom")
+			}
+		case "bad":
+			return errors.New("invalid message")
+		case "ok":
+			cancel()
+		}
+		return nil
+	})
+
+	err = Consume(ctx, r, handler,
+		WithHandlerRetry(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}),
+		WithConsumeDeadLetter(NewKafkaDeadLetterSink(dlq, "dlq")),
+		WithConsumeHooks(ConsumeHooks{OnError: func(msg *Message, err error) { errs = append(errs, err) }}),
+	)
+	assert.Equal(t, context.Canceled, err)
+
+	var perr *PanicError
+	assert.True(t, errors.As(errs[0], &perr))
+	assert.Equal(t, "boom", perr.Value)
+	assert.NotEmpty(t, perr.Stack)
+	assert.Len(t, errs, 3)
+
+	assert.Equal(t, 1, dlq.written())
+	dead := dlq.msgs[0]
+	assert.Equal(t, "dlq", dead.Topic)
+	assert.Equal(t, "bad", string(dead.Value))
+	assert.Equal(t, []string{"test"}, headerValues(dead, HeaderDeadLetterTopic))
+	assert.Equal(t, []string{"invalid message", "invalid message"}, headerValues(dead, HeaderDeadLetterError))
+	assert.Equal(t, map[int]int64{0: 2}, lastCommitted(fake.commits()))
+}
+
+func TestConsume_HandlerError(t *testing.T) {
+	fake := &fakeReader{msgs: []kafka.Message{
+		{Topic: "test", Offset: 0, Value: []byte("ok")},
+		{Topic: "test", Offset: 1, Value: []byte("bad")},
+		{Topic: "test", Offset: 2, Value: []byte("ok")},
+	}}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	sentinel := errors.New("invalid message")
+	err = Consume(context.Background(), r, HandlerFunc(func(ctx context.Context, msg Message) error {
+		if string(msg.Value) == "bad" {
+			return sentinel
+		}
+		return nil
+	}))
+
+	var herr *HandlerError
+	assert.True(t, errors.As(err, &herr))
+	assert.True(t, errors.Is(err, sentinel))
+	assert.Equal(t, int64(1), herr.Message.Offset)
+	assert.Equal(t, "a", herr.Message.ClusterName)
+	assert.Contains(t, err.Error(), "test/0@1")
+
+	// 失败的消息和之后的消息都没有提交
+	assert.Equal(t, map[int]int64{0: 0}, lastCommitted(fake.commits()))
+}
+
+func TestConsume_ReaderClosed(t *testing.T) {
+	r, err := NewReaderFromClusters([]ClusterReader{&fakeReader{}})
+	assert.NoError(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Close()
+	}()
+	assert.NoError(t, Consume(context.Background(), r, HandlerFunc(func(ctx context.Context, msg Message) error { return nil })))
+}
+
+func TestOffsetTracker(t *testing.T) {
+	o := offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+	var tracked []*tracked
+	for i := 0; i < 4; i++ {
+		tracked = append(tracked, o.add(Message{ClusterName: "a", Message: kafka.Message{Offset: int64(i)}}))
+	}
+
+	var committed []int64
+	commit := func(msg Message) { committed = append(committed, msg.Offset) }
+
+	// 前面的消息没有完成时不提交
+	o.complete(tracked[1], commit)
+	o.complete(tracked[3], commit)
+	assert.Empty(t, committed)
+
+	o.complete(tracked[0], commit)
+	assert.Equal(t, []int64{1}, committed)
+	o.complete(tracked[2], commit)
+	assert.Equal(t, []int64{1, 3}, committed)
+
+	// 分区的消息都已经提交之后不再保留这个分区
+	assert.Empty(t, o.partitions)
+	o.complete(o.add(Message{ClusterName: "a", Message: kafka.Message{Offset: 4}}), commit)
+	assert.Equal(t, []int64{1, 3, 4}, committed)
+	assert.Empty(t, o.partitions)
+}
+
+// hungCommitReader 的提交一直阻塞到ctx结束.
+type hungCommitReader struct {
+	*fakeReader
+}
+
+func (r *hungCommitReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestConsume_CommitTimeout(t *testing.T) {
+	r, err := NewReaderFromClusters([]ClusterReader{&hungCommitReader{fakeReader: &fakeReader{msgs: partitionMessages(1, 1)}}})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var errs int32
+	done := make(chan error, 1)
+	go func() {
+		done <- Consume(ctx, r, HandlerFunc(func(ctx context.Context, msg Message) error {
+			cancel()
+			return nil
+		}), WithCommitTimeout(20*time.Millisecond), WithConsumeHooks(ConsumeHooks{
+			OnError: func(msg *Message, err error) {
+				if errors.Is(err, context.DeadlineExceeded) {
+					atomic.AddInt32(&errs, 1)
+				}
+			},
+		}))
+	}()
+
+	// broker没有响应时提交超时, Consume 仍然可以返回
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Consume blocked on a hung commit")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&errs))
+}
@@ -0,0 +1,322 @@
+package mka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ErrDeadLettered 表示所有kafka集群都写入失败, 消息已经写入dead-letter sink.
+// 返回的error同时包装了原来的写入错误, 可以通过 errors.As 获取 *FailoverError 等错误.
+var ErrDeadLettered = errors.New("mka: messages are dead-lettered")
+
+const (
+	// HeaderDeadLetterTopic 记录dead-letter消息原来的topic.
+	HeaderDeadLetterTopic = "mka-dlq-topic"
+	// HeaderDeadLetterError 记录一次失败的写入, 每个失败的集群或者每次失败的尝试对应一个header.
+	HeaderDeadLetterError = "mka-dlq-error"
+	// HeaderDeadLetterTime 记录消息写入dead-letter sink的时间, 格式为RFC3339Nano.
+	HeaderDeadLetterTime = "mka-dlq-time"
+)
+
+// DeadLetterSink 接收所有kafka集群都写入失败的消息.
+// 消息带有 HeaderDeadLetterTopic、HeaderDeadLetterError 和 HeaderDeadLetterTime header,
+// 消息的 Time 保持写入时的值.
+type DeadLetterSink interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// WithDeadLetter 设置dead-letter sink.
+// 所有kafka集群都写入失败, 并且消息没有写入spool时, 消息被写入sink,
+// WriteMessages 返回同时包装了 ErrDeadLettered 和原来错误的error; 写入sink失败时返回同时包装了原来错误和sink错误的error.
+// Writer 关闭时会关闭sink.
+func WithDeadLetter(sink DeadLetterSink) WriterOption {
+	return func(w *Writer) {
+		w.deadLetter = sink
+	}
+}
+
+// kafkaDeadLetterSink 把dead-letter消息写入kafka的topic.
+type kafkaDeadLetterSink struct {
+	writer ClusterWriter
+	topic  string
+}
+
+// NewKafkaDeadLetterSink 返回把dead-letter消息写入topic的sink, writer可以是另一个集群的 kafka.Writer.
+// writer的配置中已经设置了topic时, topic必须为空.
+func NewKafkaDeadLetterSink(writer ClusterWriter, topic string) DeadLetterSink {
+	return &kafkaDeadLetterSink{writer: writer, topic: topic}
+}
+
+func (s *kafkaDeadLetterSink) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	out := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		out[i] = msg
+		out[i].Topic = s.topic
+	}
+	return s.writer.WriteMessages(ctx, out...)
+}
+
+func (s *kafkaDeadLetterSink) Close() error {
+	return s.writer.Close()
+}
+
+// fileDeadLetterSink 把dead-letter消息追加到本地文件, 使用和spool相同的记录格式.
+type fileDeadLetterSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileDeadLetterSink 返回把dead-letter消息追加到本地文件path的sink, 每次写入之后都会调用fsync.
+// 文件中的消息可以通过 ReadDeadLetterFile 读取.
+func NewFileDeadLetterSink(path string) (DeadLetterSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeadLetterSink{f: f}, nil
+}
+
+func (s *fileDeadLetterSink) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	var buf []byte
+	for _, msg := range msgs {
+		buf = appendRecord(buf, encodeMessage(msg))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return io.ErrClosedPipe
+	}
+	if _, err := s.f.Write(buf); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// ReadDeadLetterFile 读取 NewFileDeadLetterSink 写入的所有消息.
+// 文件结尾只写了一半的记录会被忽略, 中间损坏的记录返回错误.
+func ReadDeadLetterFile(path string) ([]kafka.Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []kafka.Message
+	var off int64
+	r := bufio.NewReader(f)
+	for {
+		payload, n, err := readRecord(r)
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err == nil {
+			var msg kafka.Message
+			if msg, err = decodeMessage(payload); err == nil {
+				msgs = append(msgs, msg)
+				off += int64(n)
+				continue
+			}
+		}
+
+		// 崩溃时写了一半的最后一条记录
+		if isTail(f, off, info.Size()) {
+			return msgs, nil
+		}
+		return msgs, fmt.Errorf("mka: read dead-letter file %s at offset %d: %w", path, off, err)
+	}
+}
+
+// isTail 判断从off开始的损坏记录是否是文件中的最后一条记录.
+func isTail(f *os.File, off, size int64) bool {
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return true
+	}
+	return off+recordHeaderSize+int64(binary.BigEndian.Uint32(header[:])) >= size
+}
+
+// RestoreDeadLetter 去掉dead-letter消息的 mka-dlq-* header, 恢复原来的topic.
+// 其它header, 包括去重使用的producer ID和序号, 保持不变.
+func RestoreDeadLetter(msg kafka.Message) kafka.Message {
+	headers := make([]kafka.Header, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case HeaderDeadLetterTopic:
+			msg.Topic = string(h.Value)
+		case HeaderDeadLetterError, HeaderDeadLetterTime:
+		default:
+			headers = append(headers, h)
+		}
+	}
+	if len(headers) == 0 {
+		headers = nil
+	}
+
+	msg.Headers = headers
+	msg.Partition = 0
+	msg.Offset = 0
+	msg.HighWaterMark = 0
+	return msg
+}
+
+// ReplayDeadLetters 通过 WriteMessages 重新写入dead-letter消息, 消息会先经过 RestoreDeadLetter 的处理.
+// 开启了 WithProducerID 时, 消息保留原来的producer ID和序号, 所以reader仍然可以去重.
+func (w *Writer) ReplayDeadLetters(ctx context.Context, msgs ...kafka.Message) error {
+	restored := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		restored[i] = RestoreDeadLetter(msg)
+	}
+	return w.WriteMessages(ctx, restored...)
+}
+
+// deadLetterMessages 把写入失败的消息写入dead-letter sink, 成功时返回包装了 ErrDeadLettered 的错误.
+// 写入sink也失败时, 返回的error同时包装原来的错误和sink的错误. 和spool一样, 调用方取消的写入不会写入sink.
+func (w *Writer) deadLetterMessages(ctx context.Context, msgs []kafka.Message, err error) error {
+	if w.deadLetter == nil || ctx.Err() != nil {
+		return err
+	}
+
+	failed := failedMessages(msgs, err)
+	reasons := deadLetterReasons(err)
+	now := []byte(time.Now().Format(time.RFC3339Nano))
+
+	dead := make([]kafka.Message, len(failed))
+	for i, msg := range failed {
+		dead[i] = deadLetterMessage(msg, reasons, now)
+	}
+
+	if derr := w.deadLetter.WriteMessages(ctx, dead...); derr != nil {
+		return fmt.Errorf("%w; dead letter: %w", err, derr)
+	}
+	return fmt.Errorf("%w: %w", ErrDeadLettered, err)
+}
+
+// deadLetterMessage 返回msg对应的dead-letter消息, reasons 中的每个错误描述是一个 HeaderDeadLetterError header.
+func deadLetterMessage(msg kafka.Message, reasons []string, now []byte) kafka.Message {
+	headers := make([]kafka.Header, len(msg.Headers), len(msg.Headers)+len(reasons)+2)
+	copy(headers, msg.Headers)
+	headers = append(headers, kafka.Header{Key: HeaderDeadLetterTopic, Value: []byte(msg.Topic)})
+	for _, reason := range reasons {
+		headers = append(headers, kafka.Header{Key: HeaderDeadLetterError, Value: []byte(reason)})
+	}
+	headers = append(headers, kafka.Header{Key: HeaderDeadLetterTime, Value: now})
+
+	return kafka.Message{
+		Topic:   msg.Topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+		Time:    msg.Time,
+	}
+}
+
+// deadLetterReasons 返回每个失败的集群或者每次失败的尝试的错误描述.
+func deadLetterReasons(err error) []string {
+	var ferr *FailoverError
+	var merr *MirrorError
+	var cerrs []ClusterError
+	switch {
+	case errors.As(err, &ferr):
+		cerrs = ferr.Attempts
+	case errors.As(err, &merr):
+		cerrs = merr.Errors
+	}
+
+	if len(cerrs) == 0 {
+		return []string{err.Error()}
+	}
+
+	reasons := make([]string, len(cerrs))
+	for i, e := range cerrs {
+		reasons[i] = e.Error()
+	}
+	return reasons
+}
+
+// hasFatal 判断是否有消息因为致命的错误写入失败.
+func hasFatal(msgs []kafka.Message, err error) bool {
+	var ferr *FailoverError
+	if !errors.As(err, &ferr) || len(ferr.Messages) != len(msgs) {
+		return IsFatal(err)
+	}
+
+	for _, e := range ferr.Messages {
+		if e.Err != nil && IsFatal(e.Err) {
+			return true
+		}
+	}
+	return false
+}
+
+// failedMessages 返回err中记录的写入失败的消息, 无法区分时返回所有消息.
+func failedMessages(msgs []kafka.Message, err error) []kafka.Message {
+	var failed []kafka.Message
+	for _, j := range failedIndexes(len(msgs), err) {
+		failed = append(failed, msgs[j])
+	}
+	return failed
+}
+
+// failedIndexes 返回n条消息中写入失败的消息的索引, 无法区分时返回所有消息.
+// 镜像模式下写入成功的集群数没有达到 AckPolicy 要求的消息算作失败.
+func failedIndexes(n int, err error) []int {
+	var ferr *FailoverError
+	var merr *MirrorError
+	var werr WriteErrors
+
+	var failed []int
+	switch {
+	case errors.As(err, &ferr) && len(ferr.Messages) == n:
+		for j, e := range ferr.Messages {
+			if e.Err != nil {
+				failed = append(failed, j)
+			}
+		}
+	case errors.As(err, &merr):
+		for j := 0; j < n; j++ {
+			if len(merr.ackedBy(j)) < merr.Required {
+				failed = append(failed, j)
+			}
+		}
+	case errors.As(err, &werr) && len(werr) == n:
+		for j, e := range werr {
+			if e != nil {
+				failed = append(failed, j)
+			}
+		}
+	default:
+		for j := 0; j < n; j++ {
+			failed = append(failed, j)
+		}
+	}
+	return failed
+}
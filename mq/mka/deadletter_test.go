@@ -0,0 +1,119 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func headerValues(msg kafka.Message, key string) []string {
+	var values []string
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			values = append(values, string(h.Value))
+		}
+	}
+	return values
+}
+
+func TestWriter_DeadLetterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq")
+	sink, err := NewFileDeadLetterSink(path)
+	assert.NoError(t, err)
+
+	fakes := newFakeWriters(2)
+	w := newTestWriter(RWModeBackup, fakes, WithDeadLetter(sink), WithProducerID("p1"))
+	defer w.Close()
+
+	fakes[0].setErr(errors.New("down"))
+	fakes[1].fail = func(msg kafka.Message) error {
+		if string(msg.Value) == "1" {
+			return errors.New("too large")
+		}
+		return nil
+	}
+
+	err = w.WriteMessages(context.Background(),
+		kafka.Message{Topic: "test", Value: []byte("0")},
+		kafka.Message{Topic: "test", Value: []byte("1")},
+	)
+	assert.True(t, errors.Is(err, ErrDeadLettered))
+	var ferr *FailoverError
+	assert.True(t, errors.As(err, &ferr))
+	assert.Equal(t, 1, fakes[1].written())
+
+	// 只有写入失败的消息进入dead-letter sink
+	msgs, err := ReadDeadLetterFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "1", string(msgs[0].Value))
+	assert.Equal(t, []string{"test"}, headerValues(msgs[0], HeaderDeadLetterTopic))
+	assert.Len(t, headerValues(msgs[0], HeaderDeadLetterError), 2)
+	assert.Len(t, headerValues(msgs[0], HeaderDeadLetterTime), 1)
+
+	// 重放时恢复topic, 保留producer ID和序号
+	fakes[0].setErr(nil)
+	assert.NoError(t, w.ReplayDeadLetters(context.Background(), msgs...))
+	replayed := fakes[0].msgs
+	assert.Len(t, replayed, 1)
+	assert.Equal(t, "test", replayed[0].Topic)
+	assert.Empty(t, headerValues(replayed[0], HeaderDeadLetterTopic))
+	assert.Equal(t, dedupKey(msgs[0]), dedupKey(replayed[0]))
+}
+
+func TestReadDeadLetterFile_Truncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq")
+	sink, err := NewFileDeadLetterSink(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.WriteMessages(context.Background(),
+		kafka.Message{Value: []byte("0")},
+		kafka.Message{Value: []byte("1")},
+	))
+	assert.NoError(t, sink.Close())
+	assert.Equal(t, io.ErrClosedPipe, sink.WriteMessages(context.Background(), kafka.Message{}))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-1))
+
+	msgs, err := ReadDeadLetterFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+}
+
+func TestWriter_DeadLetterKafka(t *testing.T) {
+	dlq := &fakeWriter{}
+	fakes := newFakeWriters(2)
+	w := newTestWriter(RWModeMirror, fakes, WithDeadLetter(NewKafkaDeadLetterSink(dlq, "dlq")))
+
+	for _, f := range fakes {
+		f.setErr(errors.New("down"))
+	}
+	err := w.WriteMessages(context.Background(), kafka.Message{Topic: "test", Value: []byte("0")})
+	assert.True(t, errors.Is(err, ErrDeadLettered))
+	var merr *MirrorError
+	assert.True(t, errors.As(err, &merr))
+
+	assert.Len(t, dlq.msgs, 1)
+	assert.Equal(t, "dlq", dlq.msgs[0].Topic)
+	assert.Equal(t, []string{"test"}, headerValues(dlq.msgs[0], HeaderDeadLetterTopic))
+	assert.Len(t, headerValues(dlq.msgs[0], HeaderDeadLetterError), 2)
+
+	// sink也写入失败时, 原来的错误和sink的错误都可以判断
+	errDLQ := errors.New("dlq down")
+	dlq.setErr(errDLQ)
+	err = w.WriteMessages(context.Background(), kafka.Message{Topic: "test", Value: []byte("1")})
+	assert.False(t, errors.Is(err, ErrDeadLettered))
+	assert.True(t, errors.As(err, &merr))
+	assert.True(t, errors.Is(err, errDLQ))
+	assert.Len(t, dlq.msgs, 1)
+
+	assert.NoError(t, w.Close())
+	assert.True(t, dlq.closed)
+}
@@ -0,0 +1,196 @@
+package mka
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// HeaderProducerID 是记录producer ID的消息header.
+	HeaderProducerID = "mka-producer-id"
+	// HeaderSequence 是记录producer内单调递增序号的消息header.
+	HeaderSequence = "mka-seq"
+)
+
+// WithProducerID 为写入的每条消息加上producer ID和单调递增的序号两个header,
+// Reader 可以通过 WithDedup 根据它们去掉切换集群重发导致的重复消息.
+//
+// 序号从Writer创建时的纳秒时间戳开始递增, 所以重启之后使用同一个producer ID也不会和之前的序号重复.
+// 已经带有producer ID header的消息不会被重新标记.
+func WithProducerID(id string) WriterOption {
+	return func(w *Writer) {
+		w.producerID = id
+		w.seq = uint64(time.Now().UnixNano())
+	}
+}
+
+// stamp 返回加上producer ID和序号header的消息副本, 不修改调用方的消息.
+func (w *Writer) stamp(msgs []kafka.Message) []kafka.Message {
+	stamped := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		stamped[i] = msg
+		if producerID(msg) != "" {
+			continue
+		}
+
+		seq := atomic.AddUint64(&w.seq, 1)
+		headers := make([]kafka.Header, len(msg.Headers), len(msg.Headers)+2)
+		copy(headers, msg.Headers)
+		stamped[i].Headers = append(headers,
+			kafka.Header{Key: HeaderProducerID, Value: []byte(w.producerID)},
+			kafka.Header{Key: HeaderSequence, Value: []byte(strconv.FormatUint(seq, 10))},
+		)
+	}
+	return stamped
+}
+
+func producerID(msg kafka.Message) string {
+	for _, h := range msg.Headers {
+		if h.Key == HeaderProducerID {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// dedupKey 返回消息的producer ID和序号组成的去重key, 没有这两个header时返回空字符串.
+func dedupKey(msg kafka.Message) string {
+	var id, seq []byte
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case HeaderProducerID:
+			id = h.Value
+		case HeaderSequence:
+			seq = h.Value
+		}
+	}
+	if id == nil || seq == nil {
+		return ""
+	}
+	return string(id) + "/" + string(seq)
+}
+
+// DedupConfig 是 Reader 去重的配置, 零值字段使用默认值.
+type DedupConfig struct {
+	// Window 是去重的时间窗口, 超过这个时间的消息不再参与去重, 默认为10分钟.
+	Window time.Duration
+	// MaxEntries 是去重索引最多保存的消息数, 超过时淘汰最早的消息, 默认为100000.
+	MaxEntries int
+}
+
+// DedupStats 是 Reader 去重的统计数据.
+type DedupStats struct {
+	// Hits 是被去掉的重复消息数.
+	Hits int64
+	// Entries 是去重索引当前保存的消息数.
+	Entries int
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// dedupIndex 是一个有大小上限和时间窗口的去重索引, 按照消息第一次出现的时间淘汰.
+type dedupIndex struct {
+	mu     sync.Mutex
+	config DedupConfig
+	now    func() time.Time
+
+	entries map[string]*list.Element
+	order   *list.List
+	hits    int64
+}
+
+func newDedupIndex(config DedupConfig) *dedupIndex {
+	if config.Window <= 0 {
+		config.Window = 10 * time.Minute
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 100000
+	}
+
+	return &dedupIndex{
+		config:  config,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// seen 判断key是否在时间窗口内出现过, 没有出现过时把它加入索引.
+func (d *dedupIndex) seen(key string) bool {
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// 淘汰超过时间窗口的消息
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.seen) < d.config.Window {
+			break
+		}
+		d.order.Remove(e)
+		delete(d.entries, entry.key)
+	}
+
+	if _, ok := d.entries[key]; ok {
+		d.hits++
+		return true
+	}
+
+	d.entries[key] = d.order.PushBack(&dedupEntry{key: key, seen: now})
+	if d.order.Len() > d.config.MaxEntries {
+		e := d.order.Front()
+		d.order.Remove(e)
+		delete(d.entries, e.Value.(*dedupEntry).key)
+	}
+	return false
+}
+
+// filter 去掉msgs中的重复消息, 没有producer ID和序号的消息总是保留.
+func (d *dedupIndex) filter(msgs []Message) []Message {
+	kept, _ := d.split(msgs)
+	return kept
+}
+
+// split 把msgs分成保留的消息和去掉的重复消息.
+func (d *dedupIndex) split(msgs []Message) (kept, dropped []Message) {
+	for _, msg := range msgs {
+		if key := dedupKey(msg.Message); key == "" || !d.seen(key) {
+			kept = append(kept, msg)
+		} else {
+			dropped = append(dropped, msg)
+		}
+	}
+	return kept, dropped
+}
+
+func (d *dedupIndex) stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DedupStats{Hits: d.hits, Entries: d.order.Len()}
+}
+
+// WithDedup 开启根据producer ID和序号header去重, 去掉 Writer 切换集群重发导致的重复消息.
+// Writer 需要通过 WithProducerID 标记消息.
+func WithDedup(config DedupConfig) ReaderOption {
+	return func(r *Reader) {
+		r.dedup = newDedupIndex(config)
+	}
+}
+
+// DedupStats 返回去重的统计数据, 没有开启去重时返回零值.
+func (r *Reader) DedupStats() DedupStats {
+	if r.dedup == nil {
+		return DedupStats{}
+	}
+	return r.dedup.stats()
+}
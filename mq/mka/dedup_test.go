@@ -0,0 +1,83 @@
+package mka
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter_ProducerID(t *testing.T) {
+	fakes := newFakeWriters(1)
+	w := newTestWriter(RWModeMultiRW, fakes, WithProducerID("p1"))
+	defer w.Close()
+
+	msgs := []kafka.Message{
+		{Value: []byte("0"), Headers: []kafka.Header{{Key: "k", Value: []byte("v")}}},
+		{Value: []byte("1")},
+	}
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+	assert.NoError(t, w.WriteMessages(context.Background(), fakes[0].msgs[0]))
+
+	// 不修改调用方的消息
+	assert.Len(t, msgs[0].Headers, 1)
+	assert.Nil(t, msgs[1].Headers)
+
+	written := fakes[0].msgs
+	assert.Len(t, written, 3)
+	assert.Equal(t, "k", written[0].Headers[0].Key)
+	assert.Equal(t, "p1", producerID(written[0]))
+	assert.Equal(t, "p1", producerID(written[1]))
+
+	seq0, err := strconv.ParseUint(string(written[0].Headers[2].Value), 10, 64)
+	assert.NoError(t, err)
+	seq1, err := strconv.ParseUint(string(written[1].Headers[1].Value), 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, seq0+1, seq1)
+
+	// 已经标记过的消息不会重新标记
+	assert.Equal(t, dedupKey(written[0]), dedupKey(written[2]))
+}
+
+func TestDedupIndex(t *testing.T) {
+	now := time.Now()
+	d := newDedupIndex(DedupConfig{Window: time.Minute, MaxEntries: 2})
+	d.now = func() time.Time { return now }
+
+	assert.False(t, d.seen("p1/1"))
+	assert.True(t, d.seen("p1/1"))
+	assert.False(t, d.seen("p1/2"))
+
+	// 超过上限时淘汰最早的消息
+	assert.False(t, d.seen("p1/3"))
+	assert.False(t, d.seen("p1/1"))
+
+	// 超过时间窗口的消息被淘汰
+	now = now.Add(time.Minute)
+	assert.False(t, d.seen("p1/3"))
+
+	assert.Equal(t, DedupStats{Hits: 1, Entries: 1}, d.stats())
+}
+
+func TestDedupIndex_Filter(t *testing.T) {
+	d := newDedupIndex(DedupConfig{})
+
+	stamped := func(seq string) Message {
+		return Message{Message: kafka.Message{Headers: []kafka.Header{
+			{Key: HeaderProducerID, Value: []byte("p1")},
+			{Key: HeaderSequence, Value: []byte(seq)},
+		}}}
+	}
+	plain := Message{Message: kafka.Message{Value: []byte("plain")}}
+
+	msgs := d.filter([]Message{stamped("1"), plain, stamped("1"), stamped("2")})
+	assert.Len(t, msgs, 3)
+	assert.Equal(t, []byte("plain"), msgs[1].Value)
+
+	msgs = d.filter([]Message{stamped("2"), plain})
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, int64(2), d.stats().Hits)
+}
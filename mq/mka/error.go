@@ -1,7 +1,103 @@
 package mka
 
-import "fmt"
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
 
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	// ErrRetriable 表示暂时的错误, 稍后重试或者换一个集群重试可能成功.
+	ErrRetriable = errors.New("mka: retriable error")
+	// ErrFatal 表示重试不能解决的错误, 比如认证失败、topic不存在和消息太大.
+	ErrFatal = errors.New("mka: fatal error")
+)
+
+// fatalErrors 是重试不能解决的kafka错误码.
+// kafka认为 UnknownTopicOrPartition 是可以重试的, 但是对于写入方来说它通常意味着topic没有创建.
+var fatalErrors = map[kafka.Error]bool{
+	kafka.UnknownTopicOrPartition:            true,
+	kafka.MessageSizeTooLarge:                true,
+	kafka.InvalidTopic:                       true,
+	kafka.RecordListTooLarge:                 true,
+	kafka.InvalidRequiredAcks:                true,
+	kafka.TopicAuthorizationFailed:           true,
+	kafka.GroupAuthorizationFailed:           true,
+	kafka.ClusterAuthorizationFailed:         true,
+	kafka.UnsupportedSASLMechanism:           true,
+	kafka.IllegalSASLState:                   true,
+	kafka.UnsupportedVersion:                 true,
+	kafka.TransactionalIDAuthorizationFailed: true,
+	kafka.BrokerAuthorizationFailed:          true,
+	kafka.SASLAuthenticationFailed:           true,
+	kafka.DelegationTokenAuthorizationFailed: true,
+	kafka.InvalidRecord:                      true,
+}
+
+// Classify 返回err的分类: ErrFatal 或者 ErrRetriable, err为nil时返回nil.
+//
+// 包含多个错误的err, 比如 *FailoverError, 只要其中有一个错误可以重试就是可以重试的,
+// 因为换一个集群或者稍后重试仍然可能成功. 无法识别的错误都被认为是可以重试的.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == ErrFatal || err == ErrRetriable {
+		return err
+	}
+
+	switch x := err.(type) {
+	case kafka.Error:
+		if fatalErrors[x] || !x.Temporary() {
+			return ErrFatal
+		}
+		return ErrRetriable
+	case kafka.MessageTooLargeError, x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+		return ErrFatal
+	case kafka.WriteErrors:
+		return classifyAll(x)
+	case interface{ Unwrap() []error }:
+		return classifyAll(x.Unwrap())
+	case interface{ Unwrap() error }:
+		if e := x.Unwrap(); e != nil {
+			return Classify(e)
+		}
+	}
+	return ErrRetriable
+}
+
+// classifyAll 在errs中有可以重试的错误或者没有任何错误时返回 ErrRetriable.
+func classifyAll(errs []error) error {
+	fatal := false
+	for _, e := range errs {
+		switch Classify(e) {
+		case ErrRetriable:
+			return ErrRetriable
+		case ErrFatal:
+			fatal = true
+		}
+	}
+
+	if fatal {
+		return ErrFatal
+	}
+	return ErrRetriable
+}
+
+// IsFatal 判断err是否是重试不能解决的错误.
+func IsFatal(err error) bool {
+	return Classify(err) == ErrFatal
+}
+
+// IsRetriable 判断err是否是可以重试的错误.
+func IsRetriable(err error) bool {
+	return Classify(err) == ErrRetriable
+}
+
+// WriteErrors 和 kafka.WriteErrors 一样, 每个元素对应一条消息的写入结果.
 type WriteErrors []error
 
 // Count counts the number of non-nil errors in err.
@@ -18,15 +114,14 @@ func (err WriteErrors) Count() int {
 }
 
 func (err WriteErrors) Error() string {
-	var errors []error
+	var msgs []string
 
 	n := 0
-	for _, e := range err {
-		e := e
+	for i, e := range err {
 		if e != nil {
 			n++
 			if n < 3 {
-				errors = append(errors, e)
+				msgs = append(msgs, fmt.Sprintf("message %d: %v", i, e))
 			}
 		}
 	}
@@ -36,9 +131,157 @@ func (err WriteErrors) Error() string {
 	}
 
 	if n == 1 {
-		return fmt.Sprintf("kafka write errors (%d/%d), error: %v", n, len(err), errors[0])
+		return fmt.Sprintf("kafka write errors (%d/%d), error: %s", n, len(err), msgs[0])
 	}
 
-	return fmt.Sprintf("kafka write errors (%d/%d), the first two errors: %v; %v", n, len(err), errors[0], errors[1])
+	return fmt.Sprintf("kafka write errors (%d/%d), the first two errors: %s; %s", n, len(err), msgs[0], msgs[1])
+}
+
+// Unwrap 返回所有不为nil的错误.
+func (err WriteErrors) Unwrap() []error {
+	var errs []error
+	for _, e := range err {
+		if e != nil {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
 
+// ClusterError 记录某个kafka集群的写入或者读取错误.
+type ClusterError struct {
+	// Cluster 是集群在集群列表中的索引.
+	Cluster int
+	// Name 是集群的名字.
+	Name string
+	// Attempt 是第几次尝试写入, 从1开始. 镜像模式和读取时为0.
+	Attempt int
+	// Messages 是这次写入的消息在 WriteMessages 参数中的索引, 读取时为nil.
+	Messages []int
+	Err      error
+}
+
+func (err ClusterError) Error() string {
+	cluster := clusterLabel(err.Cluster, err.Name)
+	if err.Attempt > 0 {
+		return fmt.Sprintf("attempt %d, %s: %v", err.Attempt, cluster, err.Err)
+	}
+	return fmt.Sprintf("%s: %v", cluster, err.Err)
+}
+
+// Unwrap 返回原来的错误和它的分类, 所以 errors.Is(err, ErrFatal) 可以判断错误树中是否有致命的错误.
+func (err ClusterError) Unwrap() []error {
+	return []error{err.Err, Classify(err.Err)}
+}
+
+func clusterLabel(i int, name string) string {
+	if name == "" {
+		return fmt.Sprintf("cluster %d", i)
+	}
+	return fmt.Sprintf("cluster %d (%s)", i, name)
+}
+
+// MirrorError 表示镜像模式下写入成功的集群数没有达到 AckPolicy 的要求.
+// Errors 记录了每个写入失败的集群和它的错误, 已经不可能达到要求时还没有完成写入的集群不在其中.
+type MirrorError struct {
+	Required int
+	Acked    int
+	Errors   []ClusterError
+
+	// acked 是所有消息都写入成功的集群的名字.
+	acked []string
+}
+
+// ackedBy 返回第j条消息写入成功的集群: 所有消息都写入成功的集群, 以及只有部分消息写入失败并且不包括这条消息的集群.
+func (err *MirrorError) ackedBy(j int) []string {
+	acked := err.acked
+	for _, e := range err.Errors {
+		var werr WriteErrors
+		if errors.As(e.Err, &werr) && j < len(werr) && werr[j] == nil {
+			acked = append(acked[:len(acked):len(acked)], e.Name)
+		}
+	}
+	return acked
+}
+
+func (err *MirrorError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "kafka mirror write acked by %d clusters, %d required", err.Acked, err.Required)
+	for i, e := range err.Errors {
+		if i == 0 {
+			b.WriteString(", errors: ")
+		} else {
+			b.WriteString("; ")
+		}
+		b.WriteString(e.Error())
+	}
+	return b.String()
+}
+
+// Unwrap 返回每个写入失败的集群的 ClusterError.
+func (err *MirrorError) Unwrap() []error {
+	errs := make([]error, len(err.Errors))
+	for i, e := range err.Errors {
+		errs[i] = e
+	}
+	return errs
+}
+
+// MessageError 记录一条消息最终写入的集群, 或者最后一次写入失败的错误.
+type MessageError struct {
+	// Cluster 是消息最终写入的集群; Err 不为nil时, 是最后一次尝试写入的集群.
+	// 没有尝试写入任何集群时为-1.
+	Cluster int
+	// Name 是 Cluster 的名字.
+	Name string
+	Err  error
+}
+
+// FailoverError 表示切换集群重试之后仍然有消息没有写入成功.
+// Messages 和写入的消息一一对应, Attempts 按照顺序记录了每次失败的尝试.
+type FailoverError struct {
+	Messages []MessageError
+	Attempts []ClusterError
+}
+
+// Count 返回没有写入成功的消息数.
+func (err *FailoverError) Count() int {
+	n := 0
+
+	for _, e := range err.Messages {
+		if e.Err != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (err *FailoverError) Error() string {
+	for _, e := range err.Messages {
+		if e.Err != nil {
+			return fmt.Sprintf("kafka failover write errors (%d/%d) after %d attempts, the first error: %s: %v",
+				err.Count(), len(err.Messages), len(err.Attempts), clusterLabel(e.Cluster, e.Name), e.Err)
+		}
+	}
+
+	return fmt.Sprintf("kafka failover write errors (0/%d) after %d attempts", len(err.Messages), len(err.Attempts))
+}
+
+// Unwrap 返回每次失败的尝试的 ClusterError. 没有尝试写入任何集群时, 返回消息没有写入的原因.
+func (err *FailoverError) Unwrap() []error {
+	errs := make([]error, 0, len(err.Attempts))
+	for _, e := range err.Attempts {
+		errs = append(errs, e)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	for _, e := range err.Messages {
+		if e.Err != nil {
+			return []error{e.Err}
+		}
+	}
+	return nil
 }
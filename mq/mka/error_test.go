@@ -0,0 +1,120 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingReader 的读取总是返回err.
+type failingReader struct {
+	*fakeReader
+	err error
+}
+
+func (r *failingReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	return kafka.Message{}, r.err
+}
+
+func (r *failingReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	return kafka.Message{}, r.err
+}
+
+func TestClassify(t *testing.T) {
+	assert.Nil(t, Classify(nil))
+	assert.True(t, IsRetriable(errors.New("connection reset")))
+	assert.True(t, IsRetriable(kafka.RequestTimedOut))
+	assert.True(t, IsFatal(kafka.SASLAuthenticationFailed))
+	assert.True(t, IsFatal(kafka.UnknownTopicOrPartition))
+	assert.True(t, IsFatal(fmt.Errorf("write: %w", kafka.MessageTooLargeError{})))
+	assert.True(t, IsFatal(WriteErrors{nil, kafka.MessageSizeTooLarge}))
+
+	// 有一个可以重试的错误就是可以重试的
+	ferr := &FailoverError{Attempts: []ClusterError{
+		{Cluster: 0, Attempt: 1, Err: kafka.TopicAuthorizationFailed},
+		{Cluster: 1, Attempt: 2, Err: kafka.LeaderNotAvailable},
+	}}
+	assert.True(t, IsRetriable(ferr))
+	assert.True(t, errors.Is(ferr, ErrFatal))
+	assert.True(t, errors.Is(ferr, ErrRetriable))
+
+	ferr.Attempts[1].Err = kafka.TopicAuthorizationFailed
+	assert.True(t, IsFatal(ferr))
+	assert.False(t, errors.Is(ferr, ErrRetriable))
+}
+
+func TestWriter_ErrorTree(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("primary is down"))
+	fakes[1].fail = func(msg kafka.Message) error {
+		if string(msg.Value) == "2" {
+			return kafka.MessageTooLargeError{Message: msg}
+		}
+		return nil
+	}
+
+	w := newTestWriter(RWModeBackup, fakes, WithWriterClusterNames("a", "b"))
+	defer w.Close()
+
+	err := w.WriteMessages(context.Background(),
+		kafka.Message{Value: []byte("0")},
+		kafka.Message{Value: []byte("1")},
+		kafka.Message{Value: []byte("2")},
+	)
+
+	var ferr *FailoverError
+	assert.True(t, errors.As(err, &ferr))
+	assert.Equal(t, "a", ferr.Attempts[0].Name)
+	assert.Equal(t, []int{0, 1, 2}, ferr.Attempts[0].Messages)
+	assert.Equal(t, "b", ferr.Attempts[1].Name)
+	assert.Equal(t, []int{0, 1, 2}, ferr.Attempts[1].Messages)
+	assert.Equal(t, "b", ferr.Messages[2].Name)
+
+	var tooLarge kafka.MessageTooLargeError
+	assert.True(t, errors.As(err, &tooLarge))
+	assert.Equal(t, "2", string(tooLarge.Message.Value))
+	assert.True(t, errors.Is(err, ErrFatal))
+	assert.True(t, IsRetriable(err))
+	assert.True(t, hasFatal(make([]kafka.Message, 3), err))
+	assert.Contains(t, err.Error(), "cluster 1 (b)")
+}
+
+func TestWriter_FatalSkipsSpool(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(kafka.TopicAuthorizationFailed)
+	fakes[1].setErr(kafka.TopicAuthorizationFailed)
+
+	w := newTestWriter(RWModeMultiRW, fakes, WithSpool(SpoolConfig{Dir: t.TempDir()}))
+	defer w.Close()
+
+	err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("0")})
+	assert.NotEqual(t, ErrSpooled, err)
+	assert.True(t, IsFatal(err))
+	assert.Equal(t, int64(0), w.SpoolStats().Spooled)
+
+	fakes[1].setErr(errors.New("timeout"))
+	assert.Equal(t, ErrSpooled, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("1")}))
+}
+
+func TestReader_ClusterErrors(t *testing.T) {
+	readers := []ClusterReader{
+		&failingReader{fakeReader: &fakeReader{}, err: kafka.GroupAuthorizationFailed},
+		&failingReader{fakeReader: &fakeReader{}, err: errors.New("connection refused")},
+	}
+	r, err := NewReaderFromClusters(readers, WithReaderClusterNames("a", "b"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.ReadMessage(context.Background())
+
+	var cerr ClusterError
+	assert.True(t, errors.As(err, &cerr))
+	assert.Contains(t, []string{"a", "b"}, cerr.Name)
+	assert.True(t, errors.Is(err, kafka.GroupAuthorizationFailed))
+	assert.True(t, errors.Is(err, ErrFatal))
+	assert.True(t, IsRetriable(err))
+}
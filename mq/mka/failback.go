@@ -0,0 +1,412 @@
+package mka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// BackupState 是主备模式下故障切换状态机的状态.
+type BackupState int32
+
+const (
+	// BackupStatePrimary 正常状态, 优先写入主集群.
+	BackupStatePrimary BackupState = iota
+	// BackupStateFailedOver 主集群连续失败, 已经切换到从集群, 后台探测主集群是否恢复.
+	BackupStateFailedOver
+	// BackupStateRecovering 探测到主集群已经恢复, 等待它持续健康一段时间后切回主集群.
+	BackupStateRecovering
+)
+
+func (s BackupState) String() string {
+	switch s {
+	case BackupStatePrimary:
+		return "primary"
+	case BackupStateFailedOver:
+		return "failed-over"
+	case BackupStateRecovering:
+		return "recovering"
+	default:
+		return "unknown"
+	}
+}
+
+// BackupEvent 描述了一次故障切换状态机的状态转换.
+type BackupEvent struct {
+	From BackupState
+	To   BackupState
+	// Active 是状态转换之后优先写入的集群.
+	Active int
+	Time   time.Time
+	// Err 是引起状态转换的错误, 回切时为nil.
+	Err error
+}
+
+// FailbackConfig 是主备模式下自动切换和回切的配置, 零值字段使用默认值.
+type FailbackConfig struct {
+	// FailoverThreshold 主集群连续失败多少次之后切换到从集群, 默认为3.
+	FailoverThreshold int
+	// ProbeInterval 是切换之后探测主集群的间隔, 默认为5秒.
+	ProbeInterval time.Duration
+	// ProbeTimeout 是每次探测的超时时间, 默认为5秒.
+	ProbeTimeout time.Duration
+	// HealthyPeriod 是主集群需要持续健康多久才切回主集群, 默认为30秒.
+	HealthyPeriod time.Duration
+
+	// Probe 探测主集群是否健康, 为nil时向主集群发送metadata请求.
+	Probe func(ctx context.Context) error
+	// OnEvent 在每次状态转换时被调用, 不应该阻塞.
+	OnEvent func(BackupEvent)
+}
+
+func (c FailbackConfig) withDefaults() FailbackConfig {
+	if c.FailoverThreshold <= 0 {
+		c.FailoverThreshold = 3
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = 5 * time.Second
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = 5 * time.Second
+	}
+	if c.HealthyPeriod <= 0 {
+		c.HealthyPeriod = 30 * time.Second
+	}
+	return c
+}
+
+// WithFailback 开启主备模式下的自动切换和回切, 只在 RWModeBackup 下生效, 并且会代替 WithSelector 设置的策略.
+//
+// 主集群连续失败 FailoverThreshold 次之后切换到一个从集群, 之后的写入优先写入这个从集群,
+// 同时在后台定期探测主集群, 主集群持续健康 HealthyPeriod 之后切回主集群.
+func WithFailback(config FailbackConfig) WriterOption {
+	return func(w *Writer) {
+		w.failbackConfig = &config
+	}
+}
+
+// BackupState 返回主备模式下故障切换状态机当前的状态和优先写入的集群.
+// 没有开启 WithFailback 时总是返回 BackupStatePrimary 和 0.
+func (w *Writer) BackupState() (BackupState, int) {
+	if w.failback == nil {
+		return BackupStatePrimary, 0
+	}
+	return w.failback.current()
+}
+
+// failback 是主备模式下的故障切换状态机, 它作为 ClusterSelector 决定写入集群的顺序.
+type failback struct {
+	config FailbackConfig
+	n      int
+	// available 返回当前每个集群是否可用. 它会获取 Writer 的锁, 所以不能在持有mu时调用.
+	available func() []bool
+	done      <-chan struct{}
+	wg        *sync.WaitGroup
+
+	mu           sync.Mutex
+	probeFunc    func(ctx context.Context) error
+	state        BackupState
+	active       int
+	failures     int
+	healthySince time.Time
+	idx          int
+	// probing 表示探测主集群的goroutine正在运行, 同一时间只有一个.
+	probing bool
+}
+
+func newFailback(config FailbackConfig, n int, available func() []bool, done <-chan struct{}, wg *sync.WaitGroup) *failback {
+	return &failback{
+		config:    config.withDefaults(),
+		probeFunc: config.Probe,
+		n:         n,
+		available: available,
+		done:      done,
+		wg:        wg,
+	}
+}
+
+func (f *failback) current() (BackupState, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state, f.active
+}
+
+// Select 正常状态下主集群排在第一位, 从集群轮询排在后面;
+// 切换之后当前的从集群排在第一位, 其它从集群在后面, 主集群排在最后.
+func (f *failback) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	f.mu.Lock()
+	state, active, n := f.state, f.active, f.n
+	f.idx++
+	idx := f.idx
+	f.mu.Unlock()
+
+	order := make([]int, 0, n)
+	if state == BackupStatePrimary {
+		order = append(order, 0)
+		for i := 0; i < n-1; i++ {
+			order = append(order, 1+(idx+i)%(n-1))
+		}
+		return order
+	}
+
+	order = append(order, active)
+	for i := 1; i < n; i++ {
+		if i != active {
+			order = append(order, i)
+		}
+	}
+	return append(order, 0)
+}
+
+// Observe 统计主集群连续失败的次数, 达到阈值后切换到从集群; 当前的从集群写入失败时切换到下一个从集群.
+func (f *failback) Observe(cluster int, err error, latency time.Duration) {
+	var available []bool
+	if err != nil {
+		available = f.available()
+	}
+
+	f.mu.Lock()
+	if f.n < 2 {
+		f.mu.Unlock()
+		return
+	}
+
+	var events []BackupEvent
+	switch {
+	case f.state == BackupStatePrimary && cluster == 0:
+		if err == nil {
+			f.failures = 0
+			break
+		}
+
+		f.failures++
+		if f.failures >= f.config.FailoverThreshold {
+			f.failures = 0
+			events = append(events, f.transition(BackupStateFailedOver, f.nextBackup(0, available), err))
+			if !f.probing && !f.stopped() {
+				f.probing = true
+				f.wg.Add(1)
+				go f.probe()
+			}
+		}
+	case f.state != BackupStatePrimary && cluster == f.active && err != nil:
+		// 当前的从集群也失败了, 换一个从集群, 状态不变
+		if next := f.nextBackup(f.active, available); next != f.active {
+			events = append(events, f.transition(f.state, next, err))
+		}
+	}
+
+	f.mu.Unlock()
+
+	f.emit(events)
+}
+
+// resize 在集群列表改变之后调整状态机, remap 把原来的索引映射为新的索引, 集群被移除时返回-1.
+// 主集群改变或者当前的从集群被移除时回到正常状态; probe 不为nil时代替原来的探测函数.
+func (f *failback) resize(n int, remap func(i int) int, probe func(ctx context.Context) error) {
+	f.mu.Lock()
+
+	f.n = n
+	if probe != nil {
+		f.probeFunc = probe
+	}
+
+	var events []BackupEvent
+	primaryChanged := remap(0) != 0
+	if primaryChanged {
+		f.failures = 0
+	}
+	if f.state != BackupStatePrimary {
+		if active := remap(f.active); primaryChanged || active < 0 {
+			events = append(events, f.transition(BackupStatePrimary, 0, nil))
+		} else {
+			f.active = active
+		}
+	}
+
+	f.mu.Unlock()
+
+	f.emit(events)
+}
+
+// nextBackup 返回from之后第一个可用的从集群, 没有可用的从集群时返回from之后的下一个从集群.
+// available 是调用 Observe 时集群的可用状态, 集群列表在这之后改变时它的长度可能和n不同.
+func (f *failback) nextBackup(from int, available []bool) int {
+	for k := 0; k < f.n-1; k++ {
+		i := 1 + (from+k)%(f.n-1)
+		if i != from && i < len(available) && available[i] {
+			return i
+		}
+	}
+
+	if f.n == 2 {
+		return 1
+	}
+	return 1 + from%(f.n-1)
+}
+
+// transition 切换状态, 调用时必须持有锁.
+func (f *failback) transition(to BackupState, active int, err error) BackupEvent {
+	e := BackupEvent{From: f.state, To: to, Active: active, Time: time.Now(), Err: err}
+	f.state = to
+	f.active = active
+	return e
+}
+
+func (f *failback) emit(events []BackupEvent) {
+	if f.config.OnEvent == nil {
+		return
+	}
+	for _, e := range events {
+		f.config.OnEvent(e)
+	}
+}
+
+// stopped 返回 Writer 是否已经关闭, 调用时必须持有mu. Writer 关闭之后不再启动探测的goroutine.
+func (f *failback) stopped() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop 在 done 关闭之后调用, 等待正在检查 done 的 Observe 结束,
+// 保证 Writer 开始等待 wg 之后不会再启动探测的goroutine.
+func (f *failback) stop() {
+	f.mu.Lock()
+	f.mu.Unlock()
+}
+
+// probe 定期探测主集群, 主集群持续健康 HealthyPeriod 之后切回主集群.
+// 状态机被重置之后又切换到从集群时, 原来的goroutine继续探测, 不会启动新的goroutine.
+func (f *failback) probe() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.config.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		state, probe := f.state, f.probeFunc
+		if state == BackupStatePrimary {
+			// 集群列表改变时状态机被重置到了正常状态
+			f.probing = false
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), f.config.ProbeTimeout)
+		err := probe(ctx)
+		cancel()
+
+		now := time.Now()
+		var events []BackupEvent
+		f.mu.Lock()
+		switch {
+		case err != nil && f.state == BackupStateRecovering:
+			events = append(events, f.transition(BackupStateFailedOver, f.active, err))
+		case err == nil && f.state == BackupStateFailedOver:
+			f.healthySince = now
+			events = append(events, f.transition(BackupStateRecovering, f.active, nil))
+		}
+
+		failedBack := false
+		if err == nil && f.state == BackupStateRecovering && now.Sub(f.healthySince) >= f.config.HealthyPeriod {
+			events = append(events, f.transition(BackupStatePrimary, 0, nil))
+			f.probing = false
+			failedBack = true
+		}
+		f.mu.Unlock()
+
+		f.emit(events)
+		if failedBack {
+			return
+		}
+	}
+}
+
+// ClusterProber 可以由 ClusterWriter 实现, 用来探测它代表的集群是否健康.
+// 没有设置 FailbackConfig.Probe 时, 如果主集群的writer实现了这个接口就使用它探测主集群,
+// 否则向主集群发送metadata请求.
+type ClusterProber interface {
+	Probe(ctx context.Context) error
+}
+
+func defaultProbe(c *writerCluster) func(ctx context.Context) error {
+	if p, ok := c.writer.(ClusterProber); ok {
+		return p.Probe
+	}
+	return metadataProbe(c.admin.get(c.config.Brokers, c.config.Dialer), c.config)
+}
+
+// kafkaAdmin 是集群用于metadata, offset等请求的 kafka.Client, 第一次使用时创建.
+// 集群被移除或者关闭时调用 closeIdle 关闭它的空闲连接.
+type kafkaAdmin struct {
+	mu        sync.Mutex
+	client    *kafka.Client
+	transport *kafka.Transport
+}
+
+// get 返回连接brokers的 kafka.Client, 使用dialer的TLS和SASL配置.
+func (a *kafkaAdmin) get(brokers []string, dialer *kafka.Dialer) *kafka.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client
+	}
+
+	a.transport = &kafka.Transport{}
+	if d := dialer; d != nil {
+		a.transport.Dial = d.DialFunc
+		a.transport.ClientID = d.ClientID
+		a.transport.TLS = d.TLS
+		a.transport.SASL = d.SASLMechanism
+	}
+	a.client = &kafka.Client{
+		Addr:      kafka.TCP(brokers...),
+		Transport: a.transport,
+	}
+	return a.client
+}
+
+// closeIdle 关闭 kafka.Client 的空闲连接, 没有创建过时什么也不做.
+func (a *kafkaAdmin) closeIdle() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.transport != nil {
+		a.transport.CloseIdleConnections()
+	}
+}
+
+// metadataProbe 返回一个通过metadata请求探测集群是否健康的函数.
+func metadataProbe(client *kafka.Client, config kafka.WriterConfig) func(ctx context.Context) error {
+	var topics []string
+	if config.Topic != "" {
+		topics = []string{config.Topic}
+	}
+
+	return func(ctx context.Context) error {
+		resp, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+		if err != nil {
+			return err
+		}
+		for _, t := range resp.Topics {
+			if t.Error != nil {
+				return t.Error
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,223 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter_Failback(t *testing.T) {
+	errDown := errors.New("primary is down")
+
+	var primaryDown int32 = 1
+	var mu sync.Mutex
+	var events []BackupEvent
+
+	fakes := newFakeWriters(3)
+	fakes[0].setErr(errDown)
+
+	w := newTestWriter(RWModeBackup, fakes, WithFailback(FailbackConfig{
+		FailoverThreshold: 2,
+		ProbeInterval:     5 * time.Millisecond,
+		HealthyPeriod:     20 * time.Millisecond,
+		Probe: func(ctx context.Context) error {
+			if atomic.LoadInt32(&primaryDown) == 1 {
+				return errDown
+			}
+			return nil
+		},
+		OnEvent: func(e BackupEvent) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		},
+	}))
+	defer w.Close()
+
+	msg := kafka.Message{Value: []byte("hello")}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, w.WriteMessages(context.Background(), msg))
+	}
+
+	// 切换之后不再先写主集群
+	assert.Equal(t, 2, fakes[0].attempts())
+	state, active := w.BackupState()
+	assert.Equal(t, BackupStateFailedOver, state)
+	assert.Equal(t, 1, active)
+	assert.Equal(t, 5, fakes[1].written()+fakes[2].written())
+
+	// 主集群恢复之后, 持续健康一段时间再切回主集群
+	fakes[0].setErr(nil)
+	atomic.StoreInt32(&primaryDown, 0)
+	assert.Eventually(t, func() bool {
+		state, _ := w.BackupState()
+		return state == BackupStatePrimary
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, w.WriteMessages(context.Background(), msg))
+	assert.Equal(t, 1, fakes[0].written())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, events, 3)
+	assert.Equal(t, BackupEvent{From: BackupStatePrimary, To: BackupStateFailedOver, Active: 1, Time: events[0].Time, Err: errDown}, events[0])
+	assert.Equal(t, BackupStateRecovering, events[1].To)
+	assert.Equal(t, BackupStatePrimary, events[2].To)
+	assert.Equal(t, 0, events[2].Active)
+}
+
+func TestFailback_NextBackup(t *testing.T) {
+	var wg sync.WaitGroup
+	available := []bool{true, true, false, true}
+	f := newFailback(FailbackConfig{}, 4, func() []bool { return available }, nil, &wg)
+
+	assert.Equal(t, 1, f.nextBackup(0, available))
+	assert.Equal(t, 3, f.nextBackup(1, available))
+	assert.Equal(t, 1, f.nextBackup(3, available))
+	// 集群列表变短之后超出范围的集群不可用, 没有可用的从集群时使用下一个从集群
+	assert.Equal(t, 2, f.nextBackup(1, available[:2]))
+
+	state, _ := f.current()
+	assert.Equal(t, BackupStatePrimary, state)
+	assert.Equal(t, 0, f.Select(nil, nil)[0])
+
+	f.mu.Lock()
+	f.transition(BackupStateFailedOver, 3, nil)
+	f.mu.Unlock()
+	assert.Equal(t, []int{3, 1, 2, 0}, f.Select(nil, nil))
+}
+
+func TestWriter_FailbackConcurrentResize(t *testing.T) {
+	errDown := errors.New("cluster is down")
+	fakes := newFakeWriters(3)
+	for _, f := range fakes {
+		f.setErr(errDown)
+	}
+
+	w := newTestWriter(RWModeBackup, fakes, WithFailback(FailbackConfig{
+		FailoverThreshold: 1,
+		ProbeInterval:     time.Millisecond,
+		Probe:             func(ctx context.Context) error { return errDown },
+	}))
+	defer w.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					_ = w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+				}
+			}()
+		}
+
+		// 所有集群都失败时并发地增删集群
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				extra := &fakeWriter{}
+				extra.setErr(errDown)
+				assert.NoError(t, w.AddClusterWriter("extra", extra))
+				assert.NoError(t, w.RemoveCluster("extra"))
+			}
+		}()
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock between writes and cluster changes")
+	}
+}
+
+func TestFailback_SingleProber(t *testing.T) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	var running, maxRunning int32
+	errDown := errors.New("primary is down")
+	config := FailbackConfig{
+		FailoverThreshold: 1,
+		ProbeInterval:     time.Millisecond,
+		Probe: func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			return errDown
+		},
+	}
+	available := func() []bool { return []bool{false, true, true} }
+	f := newFailback(config, 3, available, done, &wg)
+
+	// 当前的从集群被移除时状态机被重置, 之后再次切换也只有一个探测的goroutine
+	for i := 0; i < 5; i++ {
+		f.Observe(0, errDown, 0)
+		state, active := f.current()
+		assert.Equal(t, BackupStateFailedOver, state)
+		f.resize(3, func(j int) int {
+			if j == active {
+				return -1
+			}
+			return j
+		}, nil)
+	}
+	f.Observe(0, errDown, 0)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+}
+
+func TestFailback_ObserveAfterClose(t *testing.T) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errDown := errors.New("primary is down")
+	config := FailbackConfig{FailoverThreshold: 1, Probe: func(ctx context.Context) error { return errDown }}
+	f := newFailback(config, 2, func() []bool { return []bool{false, true} }, done, &wg)
+
+	close(done)
+	f.stop()
+
+	// 关闭之后切换状态但是不再启动探测的goroutine
+	f.Observe(0, errDown, 0)
+	state, _ := f.current()
+	assert.Equal(t, BackupStateFailedOver, state)
+	f.mu.Lock()
+	assert.False(t, f.probing)
+	f.mu.Unlock()
+	wg.Wait()
+}
+
+func TestKafkaAdmin(t *testing.T) {
+	var a kafkaAdmin
+	// 没有创建过 kafka.Client 时什么也不做
+	a.closeIdle()
+
+	dialer := &kafka.Dialer{ClientID: "mka"}
+	client := a.get([]string{"localhost:9092"}, dialer)
+	assert.Same(t, client, a.get([]string{"localhost:9093"}, nil))
+	assert.Equal(t, "mka", a.transport.ClientID)
+	a.closeIdle()
+}
@@ -0,0 +1,235 @@
+package mka
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// minHedgeSamples 是根据分位数计算对冲阈值需要的最少样本数, 样本不足时使用 HedgeConfig.Delay.
+	minHedgeSamples = 100
+	// hedgeRefresh 是重新计算分位数之前需要记录的样本数.
+	hedgeRefresh = 16
+)
+
+// HedgeConfig 是延迟对冲写入的配置, 零值字段使用默认值.
+//
+// 开启对冲之后, 如果选择的集群超过阈值还没有确认写入, 同一批消息会同时写入下一个可用的集群,
+// 先写入成功的结果被返回. 对冲写入算作一次尝试, 受 RetryPolicy.MaxAttempts 的限制;
+// 两个集群都写入成功时消息会重复, 可以配合 WithProducerID 和 reader的去重使用.
+// 镜像模式已经同时写入所有集群, 不会对冲.
+type HedgeConfig struct {
+	// Delay 是固定的对冲阈值, 默认为50ms. 设置了 Percentile 时, 它是集群的延迟样本不足时使用的阈值.
+	Delay time.Duration
+	// Percentile 在(0, 1)之间时, 阈值是集群最近写入成功的延迟的这个分位数, 比如0.99.
+	Percentile float64
+	// MinDelay 是根据分位数计算的阈值的下限, 避免集群延迟很小时频繁对冲. 默认为1ms.
+	MinDelay time.Duration
+	// Window 是计算分位数使用的每个集群最近的写入次数, 默认为1000.
+	Window int
+}
+
+func (c HedgeConfig) withDefaults() HedgeConfig {
+	if c.Delay <= 0 {
+		c.Delay = 50 * time.Millisecond
+	}
+	if c.Percentile <= 0 || c.Percentile >= 1 {
+		c.Percentile = 0
+	}
+	if c.MinDelay <= 0 {
+		c.MinDelay = time.Millisecond
+	}
+	if c.Window <= 0 {
+		c.Window = 1000
+	}
+	return c
+}
+
+// WithHedging 开启延迟对冲写入.
+func WithHedging(config HedgeConfig) WriterOption {
+	return func(w *Writer) {
+		config = config.withDefaults()
+		w.hedge = &config
+	}
+}
+
+// hedgeStats 记录对冲写入的次数.
+type hedgeStats struct {
+	eligible   int64
+	hedges     int64
+	wins       int64
+	duplicates int64
+}
+
+// newLatencyWindow 返回记录集群写入延迟的窗口, 不需要按照分位数计算阈值时返回nil.
+func (c *HedgeConfig) newLatencyWindow() *latencyWindow {
+	if c == nil || c.Percentile == 0 {
+		return nil
+	}
+	return &latencyWindow{samples: make([]time.Duration, 0, c.Window), percentile: c.Percentile}
+}
+
+// delay 返回第i个集群的对冲阈值.
+func (c *HedgeConfig) delay(cluster *writerCluster) time.Duration {
+	if cluster.latencies == nil {
+		return c.Delay
+	}
+
+	d, ok := cluster.latencies.quantile()
+	if !ok {
+		return c.Delay
+	}
+	if d < c.MinDelay {
+		d = c.MinDelay
+	}
+	return d
+}
+
+// latencyWindow 保存集群最近的写入延迟, 并缓存它们的分位数.
+type latencyWindow struct {
+	mu         sync.Mutex
+	samples    []time.Duration
+	next       int
+	percentile float64
+
+	stale  int
+	cached time.Duration
+}
+
+func (lw *latencyWindow) record(d time.Duration) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if len(lw.samples) < cap(lw.samples) {
+		lw.samples = append(lw.samples, d)
+	} else {
+		lw.samples[lw.next] = d
+		lw.next = (lw.next + 1) % len(lw.samples)
+	}
+	lw.stale++
+}
+
+// quantile 返回延迟的分位数, 样本不足时返回false.
+func (lw *latencyWindow) quantile() (time.Duration, bool) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	n := len(lw.samples)
+	if n < minHedgeSamples && n < cap(lw.samples) {
+		return 0, false
+	}
+
+	if lw.stale >= hedgeRefresh || lw.cached == 0 {
+		sorted := append([]time.Duration(nil), lw.samples...)
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		lw.cached = sorted[int(lw.percentile*float64(n-1))]
+		lw.stale = 0
+	}
+	return lw.cached, true
+}
+
+// attemptResult 是一次写入尝试的结果.
+type attemptResult struct {
+	cluster int
+	attempt int
+	err     error
+}
+
+// hedgedWrite 向第i个集群写入消息, 超过阈值还没有返回时, 同时向next选择的集群写入.
+// 返回的结果按照完成的顺序排列: 先完成的尝试成功时只返回它, 另一个尝试在后台完成并统计重复的消息.
+// next 返回对冲的集群, 它的尝试次数和试探写入标记, 没有可用的集群时返回-1.
+func (w *Writer) hedgedWrite(ctx context.Context, s *writerSet, i int, trial bool, attempt int, msgs []kafka.Message,
+	timeout time.Duration, next func() (int, int, bool)) []attemptResult {
+	atomic.AddInt64(&w.hedgeStats.eligible, 1)
+
+	results := make(chan attemptResult, 2)
+	launch := func(i, attempt int, trial bool) {
+		// 对冲之后先返回的写入不会等待另一个写入, 由 inflight 保证关闭时等待它完成
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			results <- attemptResult{cluster: i, attempt: attempt, err: w.write(ctx, s, i, trial, msgs, timeout)}
+		}()
+	}
+	launch(i, attempt, trial)
+
+	timer := time.NewTimer(w.hedge.delay(s.clusters[i]))
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return []attemptResult{r}
+	case <-timer.C:
+	}
+
+	h, hattempt, htrial := next()
+	if h < 0 {
+		return []attemptResult{<-results}
+	}
+	atomic.AddInt64(&w.hedgeStats.hedges, 1)
+	launch(h, hattempt, htrial)
+
+	first := <-results
+	if first.err != nil {
+		return []attemptResult{first, <-results}
+	}
+
+	if first.cluster == h {
+		atomic.AddInt64(&w.hedgeStats.wins, 1)
+	}
+	go func() {
+		second := <-results
+		if n := int64(len(msgs) - failedCount(second.err, len(msgs))); n > 0 {
+			atomic.AddInt64(&w.hedgeStats.duplicates, n)
+		}
+	}()
+	return []attemptResult{first}
+}
+
+// failedCount 返回写入n条消息返回err时写入失败的消息数.
+func failedCount(err error, n int) int {
+	if err == nil {
+		return 0
+	}
+	if werr, ok := err.(WriteErrors); ok && len(werr) == n {
+		return werr.Count()
+	}
+	return n
+}
+
+// trackAttempts 把写入pending中消息的尝试结果记录到results中, 返回仍然没有写入成功的消息.
+// tries 按照完成的顺序排列, 消息记录为第一个写入成功的集群, 被多个集群写入成功的消息计入重复的消息.
+// 如果尝试的错误是 WriteErrors, 只有其中错误不为nil的消息被认为写入失败.
+func (w *Writer) trackAttempts(s *writerSet, results []MessageError, pending []int, tries []attemptResult) []int {
+	var failed []int
+	for k, j := range pending {
+		written := false
+		for _, t := range tries {
+			e := t.err
+			if werr, ok := e.(WriteErrors); ok && len(werr) == len(pending) {
+				e = werr[k]
+			}
+
+			switch {
+			case e == nil && written:
+				atomic.AddInt64(&w.hedgeStats.duplicates, 1)
+			case e == nil:
+				written = true
+				results[j] = MessageError{Cluster: t.cluster, Name: s.clusters[t.cluster].name}
+			case !written:
+				results[j] = MessageError{Cluster: t.cluster, Name: s.clusters[t.cluster].name, Err: e}
+			}
+		}
+
+		if !written {
+			failed = append(failed, j)
+		}
+	}
+
+	return failed
+}
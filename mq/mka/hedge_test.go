@@ -0,0 +1,129 @@
+package mka
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowWriter 的每次写入都等待delay之后才写入.
+type slowWriter struct {
+	*fakeWriter
+	delay int64 // time.Duration
+}
+
+func (w *slowWriter) setDelay(d time.Duration) {
+	atomic.StoreInt64(&w.delay, int64(d))
+}
+
+func (w *slowWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if d := time.Duration(atomic.LoadInt64(&w.delay)); d > 0 {
+		time.Sleep(d)
+	}
+	return w.fakeWriter.WriteMessages(ctx, msgs...)
+}
+
+func TestWriter_Hedging(t *testing.T) {
+	slow := &slowWriter{fakeWriter: &fakeWriter{}}
+	slow.setDelay(200 * time.Millisecond)
+	fast := &fakeWriter{}
+
+	w, err := NewWriterFromClusters(RWModeBackup, []ClusterWriter{slow, fast}, WithHedging(HedgeConfig{Delay: 10 * time.Millisecond}))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	msgs := []kafka.Message{{Value: []byte("0")}, {Value: []byte("1")}}
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, 2, fast.written())
+
+	// 关闭时等待慢的写入完成, 它写入的消息计入重复的消息
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 2, slow.written())
+
+	stats := w.AggregateStats()
+	assert.Equal(t, int64(1), stats.Hedges)
+	assert.Equal(t, 1.0, stats.HedgeRate)
+	assert.Equal(t, int64(1), stats.HedgeWins)
+	assert.Equal(t, int64(2), stats.HedgeDuplicates)
+	assert.Equal(t, int64(1), stats.Failovers)
+}
+
+func TestWriter_HedgingNotTriggered(t *testing.T) {
+	fakes := newFakeWriters(2)
+	w := newTestWriter(RWModeBackup, fakes, WithHedging(HedgeConfig{Delay: time.Second}))
+	defer w.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("0")}))
+	}
+	assert.Equal(t, 10, fakes[0].written())
+	assert.Equal(t, 0, fakes[1].written())
+
+	stats := w.AggregateStats()
+	assert.Equal(t, int64(0), stats.Hedges)
+	assert.Equal(t, 0.0, stats.HedgeRate)
+	assert.Equal(t, int64(0), stats.Failovers)
+
+	// 只能尝试一次时不会对冲
+	w2 := newTestWriter(RWModeBackup, fakes, WithHedging(HedgeConfig{Delay: time.Nanosecond}), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	defer w2.Close()
+	assert.NoError(t, w2.WriteMessages(context.Background(), kafka.Message{Value: []byte("0")}))
+	assert.Equal(t, int64(0), w2.AggregateStats().Hedges)
+}
+
+func TestWriter_HedgingPercentile(t *testing.T) {
+	slow := &slowWriter{fakeWriter: &fakeWriter{}}
+	fast := &fakeWriter{}
+
+	w, err := NewWriterFromClusters(RWModeBackup, []ClusterWriter{slow, fast}, WithHedging(HedgeConfig{
+		Delay:      time.Hour,
+		Percentile: 0.99,
+		MinDelay:   5 * time.Millisecond,
+		Window:     minHedgeSamples,
+	}))
+	assert.NoError(t, err)
+	defer w.Close()
+
+	// 样本不足时使用 Delay
+	for i := 0; i < minHedgeSamples; i++ {
+		assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("0")}))
+	}
+	assert.Equal(t, int64(0), w.AggregateStats().Hedges)
+
+	// 延迟超过p99之后对冲
+	slow.setDelay(100 * time.Millisecond)
+	start := time.Now()
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("1")}))
+	assert.Less(t, time.Since(start), 80*time.Millisecond)
+	assert.Equal(t, int64(1), w.AggregateStats().Hedges)
+	assert.Equal(t, 1, fast.written())
+}
+
+func TestLatencyWindow(t *testing.T) {
+	lw := (&HedgeConfig{Percentile: 0.99, Window: 200}).newLatencyWindow()
+	for i := 1; i < minHedgeSamples; i++ {
+		lw.record(time.Duration(i) * time.Millisecond)
+	}
+	_, ok := lw.quantile()
+	assert.False(t, ok)
+
+	lw.record(100 * time.Millisecond)
+	d, ok := lw.quantile()
+	assert.True(t, ok)
+	assert.Equal(t, 99*time.Millisecond, d)
+
+	// 窗口满了之后替换最早的样本
+	for i := 0; i < 200; i++ {
+		lw.record(time.Millisecond)
+	}
+	d, _ = lw.quantile()
+	assert.Equal(t, time.Millisecond, d)
+
+	assert.Nil(t, (&HedgeConfig{}).newLatencyWindow())
+	assert.Nil(t, (*HedgeConfig)(nil).newLatencyWindow())
+}
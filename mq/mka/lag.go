@@ -0,0 +1,417 @@
+package mka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ClusterLagger 可以由 ClusterReader 实现, 用来计算它代表的集群的总lag.
+// 计算集群的lag时, 如果reader实现了这个接口就使用它; 否则使用consumer group时根据group提交的offset计算,
+// 不使用consumer group时使用reader的 ReadLag.
+type ClusterLagger interface {
+	TotalLag(ctx context.Context) (int64, error)
+}
+
+// ClusterLag 是单个集群的lag.
+type ClusterLag struct {
+	Cluster int
+	Name    string
+	// Lag 是集群所有分区的lag之和, 计算失败时为-1, Err 是失败的原因.
+	Lag int64
+	Err error
+	// Stalled 表示lag大于0并且连续 LagMonitorConfig.StallPeriods 次没有从这个集群读取到新的消息.
+	Stalled bool
+
+	// reads 是计算lag时从这个集群读取到的消息数, 用来判断消费是否前进.
+	reads int64
+}
+
+// LagSnapshot 是某一时刻所有集群的lag.
+type LagSnapshot struct {
+	Time time.Time
+	// Clusters 是每个集群的lag, 按照集群的索引排列.
+	Clusters []ClusterLag
+	// Total 是计算成功的集群的lag之和.
+	Total int64
+}
+
+// LagEventType 是lag事件的类型.
+type LagEventType int
+
+const (
+	// LagAboveThreshold 表示lag超过了阈值.
+	LagAboveThreshold LagEventType = iota
+	// LagBelowThreshold 表示超过阈值的lag回到了阈值以下.
+	LagBelowThreshold
+	// LagStalled 表示lag大于0并且连续 StallPeriods 次没有读取到新的消息.
+	// lag稳定但是一直在消费的集群不算停滞.
+	LagStalled
+	// LagProgressing 表示停滞的集群重新开始消费或者lag降到了0.
+	LagProgressing
+)
+
+func (t LagEventType) String() string {
+	switch t {
+	case LagAboveThreshold:
+		return "above-threshold"
+	case LagBelowThreshold:
+		return "below-threshold"
+	case LagStalled:
+		return "stalled"
+	case LagProgressing:
+		return "progressing"
+	default:
+		return "unknown"
+	}
+}
+
+// LagEvent 描述了一次lag状态的变化.
+type LagEvent struct {
+	Type LagEventType
+	// Cluster 是集群的索引, Name 是它的名字. 总lag的事件 Cluster 为-1, Name 为空.
+	Cluster int
+	Name    string
+	Lag     int64
+	// Threshold 是阈值事件使用的阈值.
+	Threshold int64
+	Time      time.Time
+}
+
+// LagMonitorConfig 是lag监控的配置, 零值字段使用默认值.
+type LagMonitorConfig struct {
+	// Interval 是计算lag的间隔, 默认为30秒.
+	Interval time.Duration
+	// Timeout 是每次计算的超时时间, 默认为10秒.
+	Timeout time.Duration
+
+	// Threshold 是每个集群lag的阈值, 为0时不检查.
+	Threshold int64
+	// TotalThreshold 是所有集群lag之和的阈值, 为0时不检查.
+	TotalThreshold int64
+	// StallPeriods 是lag大于0时连续多少次没有读取到新的消息之后认为消费停滞, 默认为3.
+	StallPeriods int
+
+	// OnEvent 在lag越过阈值、停滞或者恢复下降时被调用, 不应该阻塞.
+	OnEvent func(LagEvent)
+}
+
+func (c LagMonitorConfig) withDefaults() LagMonitorConfig {
+	if c.Interval <= 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.StallPeriods <= 0 {
+		c.StallPeriods = 3
+	}
+	return c
+}
+
+// WithLagMonitor 开启lag监控: Reader 创建之后立即计算一次所有集群的lag, 之后每隔 Interval 计算一次,
+// 结果可以通过 LagSnapshot 获取, lag的状态变化通过 OnEvent 通知. Reader 关闭时停止监控.
+func WithLagMonitor(config LagMonitorConfig) ReaderOption {
+	return func(r *Reader) {
+		config = config.withDefaults()
+		r.lagConfig = &config
+	}
+}
+
+// CollectLag 计算所有集群当前的lag, 不需要开启 WithLagMonitor. 各个集群并发计算.
+// Reader 关闭之后返回零值.
+func (r *Reader) CollectLag(ctx context.Context) LagSnapshot {
+	set := r.acquire()
+	if set == nil {
+		return LagSnapshot{}
+	}
+	defer set.release()
+
+	snap := LagSnapshot{Time: time.Now(), Clusters: make([]ClusterLag, len(set.clusters))}
+	var wg sync.WaitGroup
+	for i, c := range set.clusters {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 先记录读取的消息数, 计算lag期间读取的消息算作下一次的进展
+			reads := atomic.LoadInt64(&c.messages)
+			lag, err := c.totalLag(ctx)
+			if err != nil {
+				lag = -1
+				err = ClusterError{Cluster: i, Name: c.name, Err: err}
+			}
+			snap.Clusters[i] = ClusterLag{Cluster: i, Name: c.name, Lag: lag, Err: err, reads: reads}
+		}()
+	}
+	wg.Wait()
+
+	for _, cl := range snap.Clusters {
+		if cl.Err == nil {
+			snap.Total += cl.Lag
+		}
+	}
+	return snap
+}
+
+// LagSnapshot 返回lag监控最近一次计算的结果, 没有开启 WithLagMonitor 或者还没有计算完成时返回零值.
+func (r *Reader) LagSnapshot() LagSnapshot {
+	if r.lagMonitor == nil {
+		return LagSnapshot{}
+	}
+	return r.lagMonitor.snapshot()
+}
+
+func (c *readerCluster) totalLag(ctx context.Context) (int64, error) {
+	c.lagOnce.Do(func() {
+		c.lagFunc = defaultLag(c)
+	})
+	return c.lagFunc(ctx)
+}
+
+func defaultLag(c *readerCluster) func(ctx context.Context) (int64, error) {
+	if l, ok := c.reader.(ClusterLagger); ok {
+		return l.TotalLag
+	}
+	if c.config.GroupID != "" && len(c.config.Brokers) > 0 {
+		return groupLag(c.admin.get(c.config.Brokers, c.config.Dialer), c.config)
+	}
+	return c.reader.ReadLag
+}
+
+// groupLag 返回一个根据consumer group提交的offset计算lag的函数.
+// 分区还没有提交过offset时, 按照 StartOffset 从分区的开头或者结尾计算.
+func groupLag(client *kafka.Client, config kafka.ReaderConfig) func(ctx context.Context) (int64, error) {
+	topics := config.GroupTopics
+	if config.Topic != "" {
+		topics = append([]string{config.Topic}, topics...)
+	}
+
+	return func(ctx context.Context) (int64, error) {
+		meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+		if err != nil {
+			return 0, err
+		}
+
+		partitions := make(map[string][]int)
+		requests := make(map[string][]kafka.OffsetRequest)
+		for _, t := range meta.Topics {
+			if t.Error != nil {
+				return 0, fmt.Errorf("topic %s: %w", t.Name, t.Error)
+			}
+			for _, p := range t.Partitions {
+				partitions[t.Name] = append(partitions[t.Name], p.ID)
+				requests[t.Name] = append(requests[t.Name], kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+			}
+		}
+
+		committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: config.GroupID, Topics: partitions})
+		if err != nil {
+			return 0, err
+		}
+		if committed.Error != nil {
+			return 0, committed.Error
+		}
+
+		offsets, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: requests})
+		if err != nil {
+			return 0, err
+		}
+
+		var lag int64
+		for topic, ps := range offsets.Topics {
+			commits := make(map[int]int64)
+			for _, p := range committed.Topics[topic] {
+				if p.Error != nil {
+					return 0, fmt.Errorf("topic %s partition %d: %w", topic, p.Partition, p.Error)
+				}
+				commits[p.Partition] = p.CommittedOffset
+			}
+
+			for _, p := range ps {
+				if p.Error != nil {
+					return 0, fmt.Errorf("topic %s partition %d: %w", topic, p.Partition, p.Error)
+				}
+
+				start, ok := commits[p.Partition]
+				if !ok || start < 0 {
+					start = p.FirstOffset
+					if config.StartOffset == kafka.LastOffset {
+						start = p.LastOffset
+					}
+				}
+				if d := p.LastOffset - start; d > 0 {
+					lag += d
+				}
+			}
+		}
+		return lag, nil
+	}
+}
+
+// lagMonitor 定期计算 Reader 的lag, 并根据lag的变化产生事件.
+type lagMonitor struct {
+	r      *Reader
+	config LagMonitorConfig
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	last  LagSnapshot
+	state map[string]*lagState
+	total lagState
+}
+
+// lagState 是一个集群或者总lag的监控状态.
+type lagState struct {
+	reads   int64
+	hasPrev bool
+	flat    int
+	stalled bool
+	above   bool
+}
+
+func newLagMonitor(r *Reader, config LagMonitorConfig) *lagMonitor {
+	m := &lagMonitor{
+		r:      r,
+		config: config,
+		done:   make(chan struct{}),
+		state:  make(map[string]*lagState),
+	}
+
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+func (m *lagMonitor) run() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+		// 关闭时打断正在进行的计算
+		go func() {
+			select {
+			case <-m.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		snap := m.r.CollectLag(ctx)
+		cancel()
+
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+		m.emit(m.update(snap))
+
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *lagMonitor) stop() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+func (m *lagMonitor) snapshot() LagSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// update 保存新的结果, 返回lag状态的变化. 集群按照名字记录状态, 被移除的集群的状态会被删除.
+func (m *lagMonitor) update(snap LagSnapshot) []LagEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []LagEvent
+	seen := make(map[string]bool, len(snap.Clusters))
+	for i := range snap.Clusters {
+		cl := &snap.Clusters[i]
+		seen[cl.Name] = true
+		if cl.Err != nil {
+			continue
+		}
+
+		s := m.state[cl.Name]
+		if s == nil {
+			s = &lagState{}
+			m.state[cl.Name] = s
+		}
+		for _, t := range s.observe(cl.Lag, cl.reads, m.config.Threshold, m.config.StallPeriods) {
+			events = append(events, LagEvent{Type: t, Cluster: cl.Cluster, Name: cl.Name, Lag: cl.Lag, Threshold: m.config.Threshold, Time: snap.Time})
+		}
+		cl.Stalled = s.stalled
+	}
+	for name := range m.state {
+		if !seen[name] {
+			delete(m.state, name)
+		}
+	}
+
+	// 总lag只检查阈值, 停滞由每个集群检查
+	for _, t := range m.total.observe(snap.Total, 0, m.config.TotalThreshold, 0) {
+		events = append(events, LagEvent{Type: t, Cluster: -1, Lag: snap.Total, Threshold: m.config.TotalThreshold, Time: snap.Time})
+	}
+
+	m.last = snap
+	return events
+}
+
+// observe 记录新的lag和读取到的消息数, 返回越过阈值和停滞状态变化的事件.
+// threshold 或者 stallPeriods 为0时不检查对应的状态.
+func (s *lagState) observe(lag, reads, threshold int64, stallPeriods int) []LagEventType {
+	var events []LagEventType
+
+	if threshold > 0 {
+		switch above := lag > threshold; {
+		case above && !s.above:
+			events = append(events, LagAboveThreshold)
+		case !above && s.above:
+			events = append(events, LagBelowThreshold)
+		}
+		s.above = lag > threshold
+	}
+
+	if stallPeriods > 0 {
+		if s.hasPrev && lag > 0 && reads == s.reads {
+			s.flat++
+		} else {
+			s.flat = 0
+		}
+
+		switch stalled := s.flat >= stallPeriods; {
+		case stalled && !s.stalled:
+			events = append(events, LagStalled)
+		case !stalled && s.stalled:
+			events = append(events, LagProgressing)
+		}
+		s.stalled = s.flat >= stallPeriods
+	}
+
+	s.reads, s.hasPrev = reads, true
+	return events
+}
+
+func (m *lagMonitor) emit(events []LagEvent) {
+	if m.config.OnEvent == nil {
+		return
+	}
+	for _, e := range events {
+		m.config.OnEvent(e)
+	}
+}
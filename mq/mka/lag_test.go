@@ -0,0 +1,133 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// lagReader 是lag可以随时设置的 fakeReader, err 不为nil时计算lag失败.
+type lagReader struct {
+	*fakeReader
+	lag int64
+	err error
+}
+
+func (r *lagReader) TotalLag(ctx context.Context) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return atomic.LoadInt64(&r.lag), nil
+}
+
+func TestLagState(t *testing.T) {
+	var s lagState
+	assert.Empty(t, s.observe(5, 0, 10, 2))
+	// 没有读取到新的消息, 不管lag是否变化都算停滞
+	assert.Equal(t, []LagEventType{LagAboveThreshold}, s.observe(20, 0, 10, 2))
+	assert.Equal(t, []LagEventType{LagStalled}, s.observe(20, 0, 10, 2))
+	assert.Equal(t, []LagEventType{LagBelowThreshold}, s.observe(8, 0, 10, 2))
+	assert.Equal(t, []LagEventType{LagProgressing}, s.observe(9, 3, 10, 2))
+
+	// lag稳定但是一直在消费的集群不算停滞
+	s = lagState{}
+	for i := 0; i < 5; i++ {
+		assert.Empty(t, s.observe(20, int64(i), 0, 2))
+	}
+
+	// 没有lag时不算停滞
+	s = lagState{}
+	for i := 0; i < 5; i++ {
+		assert.Empty(t, s.observe(0, 0, 0, 2))
+	}
+}
+
+func TestReader_CollectLag(t *testing.T) {
+	readers := []ClusterReader{
+		&lagReader{fakeReader: &fakeReader{}, lag: 7},
+		&lagReader{fakeReader: &fakeReader{}, err: errors.New("connection refused")},
+		&fakeReader{},
+	}
+	r, err := NewReaderFromClusters(readers, WithReaderClusterNames("a", "b", "c"))
+	assert.NoError(t, err)
+
+	snap := r.CollectLag(context.Background())
+	assert.False(t, snap.Time.IsZero())
+	assert.Equal(t, int64(7), snap.Total)
+	assert.Len(t, snap.Clusters, 3)
+	assert.Equal(t, ClusterLag{Cluster: 0, Name: "a", Lag: 7}, snap.Clusters[0])
+	assert.Equal(t, int64(-1), snap.Clusters[1].Lag)
+	var ce ClusterError
+	assert.ErrorAs(t, snap.Clusters[1].Err, &ce)
+	assert.Equal(t, "b", ce.Name)
+	// 没有实现 ClusterLagger 的reader使用 ReadLag
+	assert.NoError(t, snap.Clusters[2].Err)
+
+	// 没有开启监控
+	assert.True(t, r.LagSnapshot().Time.IsZero())
+
+	assert.NoError(t, r.Close())
+	assert.Empty(t, r.CollectLag(context.Background()).Clusters)
+}
+
+func TestReader_LagMonitor(t *testing.T) {
+	lr := &lagReader{fakeReader: &fakeReader{}, lag: 20}
+	events := make(chan LagEvent, 16)
+	r, err := NewReaderFromClusters([]ClusterReader{lr, &fakeReader{}},
+		WithReaderClusterNames("a", "b"),
+		WithLagMonitor(LagMonitorConfig{
+			Interval:       10 * time.Millisecond,
+			Threshold:      10,
+			TotalThreshold: 15,
+			StallPeriods:   2,
+			OnEvent:        func(e LagEvent) { events <- e },
+		}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	next := func() LagEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no lag event")
+			return LagEvent{}
+		}
+	}
+
+	e := next()
+	assert.Equal(t, LagAboveThreshold, e.Type)
+	assert.Equal(t, "a", e.Name)
+	assert.Equal(t, int64(10), e.Threshold)
+	e = next()
+	assert.Equal(t, LagAboveThreshold, e.Type)
+	assert.Equal(t, -1, e.Cluster)
+	assert.Equal(t, int64(15), e.Threshold)
+
+	// 没有读取新的消息
+	e = next()
+	assert.Equal(t, LagStalled, e.Type)
+	assert.Equal(t, 0, e.Cluster)
+	snap := r.LagSnapshot()
+	assert.Equal(t, int64(20), snap.Total)
+	assert.True(t, snap.Clusters[0].Stalled)
+
+	// 读取到新的消息之后恢复
+	atomic.StoreInt64(&lr.lag, 5)
+	lr.push(kafka.Message{})
+	_, err = r.ReadMessage(context.Background())
+	assert.NoError(t, err)
+	var types []LagEventType
+	for i := 0; i < 3; i++ {
+		types = append(types, next().Type)
+	}
+	assert.ElementsMatch(t, []LagEventType{LagBelowThreshold, LagProgressing, LagBelowThreshold}, types)
+
+	assert.NoError(t, r.Close())
+	assert.Equal(t, int64(5), r.LagSnapshot().Total)
+}
@@ -0,0 +1,119 @@
+package mka
+
+import (
+	"context"
+	"sort"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// AckPolicy 根据集群的数量n返回镜像模式下至少需要写入成功的集群数.
+type AckPolicy func(n int) int
+
+// AckAll 要求所有集群都写入成功.
+func AckAll(n int) int {
+	return n
+}
+
+// AckMajority 要求超过半数的集群写入成功.
+func AckMajority(n int) int {
+	return n/2 + 1
+}
+
+// AckAtLeast 要求至少k个集群写入成功, k超过集群数时要求所有集群都写入成功.
+func AckAtLeast(k int) AckPolicy {
+	return func(n int) int {
+		if k > n {
+			return n
+		}
+		return k
+	}
+}
+
+// mirror 把消息并发写入所有集群, 熔断的集群会被跳过并记为失败.
+// 开启spool或者死信时写入失败要等待所有集群完成, 否则消息写入spool或者死信之后,
+// 后台的写入仍然可能成功, 导致重放时重复写入或者写入成功的消息被当作死信.
+func (w *Writer) mirror(ctx context.Context, s *writerSet, msgs []kafka.Message) error {
+	var acked map[string]bool
+	if w.spool != nil || w.deadLetter != nil {
+		acked = make(map[string]bool)
+	}
+	return w.mirrorTo(ctx, s, msgs, acked)
+}
+
+// mirrorResult 是镜像写入单个集群的结果.
+type mirrorResult struct {
+	cluster int
+	err     error
+}
+
+// mirrorTo 和 mirror 一样写入消息, 但是跳过acked中的集群并把它们记为写入成功,
+// 写入成功的集群被加入acked. acked为nil时写入所有集群.
+//
+// 每个集群的写入使用单独的goroutine, 不占用集群列表共享的worker pool, 所以一个挂起的集群不会阻塞其它写入.
+// 写入成功的集群数达到 AckPolicy 的要求时立即返回, 其余集群的写入在后台继续, 使用调用方的ctx,
+// 结果只计入熔断器等统计. 已经不可能达到要求时, acked为nil就立即返回, 否则等待所有集群完成,
+// 让acked记录所有写入成功的集群, 之后重试时不会重复写入.
+func (w *Writer) mirrorTo(ctx context.Context, s *writerSet, msgs []kafka.Message, acked map[string]bool) error {
+	n := len(s.clusters)
+	required := w.ackPolicy(n)
+	if required < 1 {
+		required = 1
+	}
+	if required > n {
+		required = n
+	}
+
+	indexes := make([]int, len(msgs))
+	for j := range indexes {
+		indexes[j] = j
+	}
+
+	merr := &MirrorError{Required: required}
+	fail := func(i int, err error) {
+		merr.Errors = append(merr.Errors, ClusterError{Cluster: i, Name: s.clusters[i].name, Messages: indexes, Err: err})
+	}
+
+	results := make(chan mirrorResult, n)
+	pending := 0
+	for i := 0; i < n; i++ {
+		if acked[s.clusters[i].name] {
+			merr.Acked++
+			merr.acked = append(merr.acked, s.clusters[i].name)
+			continue
+		}
+		trial, ok := s.clusters[i].breaker.allow()
+		if !ok {
+			fail(i, ErrBreakerOpen)
+			continue
+		}
+
+		// 后台继续的写入同样需要在移除集群和关闭 Writer 之前完成
+		i := i
+		pending++
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			results <- mirrorResult{cluster: i, err: w.write(ctx, s, i, trial, msgs, w.retry.attemptTimeout(ctx, 1))}
+		}()
+	}
+
+	for ; pending > 0 && merr.Acked < required && (acked != nil || merr.Acked+pending >= required); pending-- {
+		res := <-results
+		if res.err != nil {
+			fail(res.cluster, res.err)
+			continue
+		}
+		merr.Acked++
+		merr.acked = append(merr.acked, s.clusters[res.cluster].name)
+		if acked != nil {
+			acked[s.clusters[res.cluster].name] = true
+		}
+	}
+
+	if merr.Acked >= required {
+		return nil
+	}
+	sort.Slice(merr.Errors, func(a, b int) bool { return merr.Errors[a].Cluster < merr.Errors[b].Cluster })
+	return merr
+}
@@ -0,0 +1,114 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAckPolicy(t *testing.T) {
+	assert.Equal(t, 3, AckAll(3))
+	assert.Equal(t, 2, AckMajority(3))
+	assert.Equal(t, 3, AckMajority(4))
+	assert.Equal(t, 1, AckAtLeast(1)(3))
+	assert.Equal(t, 3, AckAtLeast(5)(3))
+}
+
+func TestWriter_Mirror(t *testing.T) {
+	errDown := errors.New("cluster is down")
+
+	fakes := newFakeWriters(3)
+	fakes[1].setErr(errDown)
+
+	// 失败的集群晚于集群0返回, 失败结果确定之前集群0已经写入成功
+	slow := []*slowWriter{{fakeWriter: fakes[1]}, {fakeWriter: fakes[2]}}
+	for _, s := range slow {
+		s.setDelay(20 * time.Millisecond)
+	}
+	w, err := newWriter(RWModeMirror, make([]kafka.WriterConfig, 3),
+		[]ClusterWriter{fakes[0], slow[0], slow[1]}, WithAckPolicy(AckMajority))
+	assert.NoError(t, err)
+	defer w.Close()
+
+	err = w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fakes[0].written())
+	assert.Equal(t, 0, fakes[1].written())
+	assert.Equal(t, 1, fakes[2].written())
+
+	fakes[2].setErr(errDown)
+	err = w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+
+	var merr *MirrorError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, 2, merr.Required)
+	assert.Equal(t, 1, merr.Acked)
+	assert.Len(t, merr.Errors, 2)
+	assert.Equal(t, 1, merr.Errors[0].Cluster)
+	assert.Equal(t, 2, merr.Errors[1].Cluster)
+	assert.ErrorIs(t, merr.Errors[0], errDown)
+	assert.Equal(t, "kafka mirror write acked by 1 clusters, 2 required, errors: cluster 1 (cluster-1): cluster is down; cluster 2 (cluster-2): cluster is down", err.Error())
+}
+
+func TestWriter_MirrorAckAll(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeMirror, fakes)
+	defer w.Close()
+
+	err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+
+	var merr *MirrorError
+	assert.True(t, errors.As(err, &merr))
+	assert.Equal(t, 2, merr.Required)
+	// 已经不可能达到要求时立即返回, 其余集群的写入在关闭之前完成
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 1, fakes[1].written())
+}
+
+// hungWriter 的写入一直阻塞, 直到release被关闭或者ctx结束.
+type hungWriter struct {
+	*fakeWriter
+	release chan struct{}
+}
+
+func (w *hungWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	select {
+	case <-w.release:
+		return w.fakeWriter.WriteMessages(ctx, msgs...)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestWriter_MirrorHungCluster(t *testing.T) {
+	fakes := newFakeWriters(2)
+	hung := &hungWriter{fakeWriter: &fakeWriter{}, release: make(chan struct{})}
+	w, err := newWriter(RWModeMirror, make([]kafka.WriterConfig, 3),
+		[]ClusterWriter{fakes[0], fakes[1], hung}, WithAckPolicy(AckMajority))
+	assert.NoError(t, err)
+
+	// 达到要求之后立即返回, 挂起的集群不会占满worker, 阻塞之后的写入
+	for i := 0; i < 10; i++ {
+		done := make(chan error, 1)
+		go func() { done <- w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")}) }()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("mirror write blocked by the hung cluster")
+		}
+	}
+	assert.Equal(t, 10, fakes[0].written())
+	assert.Equal(t, 10, fakes[1].written())
+
+	// 后台的写入完成之后 Writer 才关闭
+	close(hung.release)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 10, hung.written())
+}
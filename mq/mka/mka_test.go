@@ -2,16 +2,29 @@ package mka
 
 import (
 	"context"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 )
 
+// testBrokers 返回环境变量 MKA_KAFKA_BROKERS 中逗号分隔的broker地址,
+// 没有设置时跳过需要真实Kafka集群的测试.
+func testBrokers(t *testing.T) []string {
+	brokers := os.Getenv("MKA_KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("MKA_KAFKA_BROKERS is not set")
+	}
+	return strings.Split(brokers, ",")
+}
+
 func TestSingleCluster(t *testing.T) {
+	brokers := testBrokers(t)
 	w := kafka.NewWriter(kafka.WriterConfig{
-		Brokers: []string{"localhost:9092"},
+		Brokers: brokers,
 		Topic:   "test",
 	})
 
@@ -27,7 +40,7 @@ func TestSingleCluster(t *testing.T) {
 	assert.NoError(t, err)
 
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{"localhost:9092"},
+		Brokers: brokers,
 		GroupID: "test-group1",
 		Topic:   "test",
 	})
@@ -40,10 +53,11 @@ func TestSingleCluster(t *testing.T) {
 }
 
 func TestReadWrite(t *testing.T) {
+	brokers := testBrokers(t)
 	// write
 	writer := NewWriter(RWModeMultiRW, []kafka.WriterConfig{
-		{Brokers: []string{"localhost:9092"}, Topic: "test"},
-		{Brokers: []string{"localhost:9092"}, Topic: "test"},
+		{Brokers: brokers, Topic: "test"},
+		{Brokers: brokers, Topic: "test"},
 	})
 
 	for i := 0; i < 10; i++ {
@@ -61,12 +75,12 @@ func TestReadWrite(t *testing.T) {
 	// read
 	reader := NewReader([]kafka.ReaderConfig{
 		{
-			Brokers: []string{"localhost:9092"},
+			Brokers: brokers,
 			GroupID: "test-group",
 			Topic:   "test",
 		},
 		{
-			Brokers: []string{"localhost:9092"},
+			Brokers: brokers,
 			GroupID: "test-group",
 			Topic:   "test",
 		},
@@ -0,0 +1,191 @@
+// Package mkaprom 把 mka.Writer 和 mka.Reader 的统计数据导出为prometheus指标.
+package mkaprom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/smallnest/gofer/mq/mka"
+)
+
+const namespace = "mka"
+
+var clusterLabels = []string{"cluster"}
+
+func newDesc(subsystem, name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+}
+
+// counters 把kafka-go返回的增量统计数据累加成prometheus需要的累计值.
+type counters map[string]float64
+
+func (c counters) add(cluster string, delta int64) float64 {
+	c[cluster] += float64(delta)
+	return c[cluster]
+}
+
+var (
+	writerWrites         = newDesc("writer", "writes_total", "Number of kafka-go write requests.", clusterLabels)
+	writerMessages       = newDesc("writer", "messages_total", "Number of messages written.", clusterLabels)
+	writerBytes          = newDesc("writer", "message_bytes_total", "Number of message bytes written.", clusterLabels)
+	writerKafkaErrors    = newDesc("writer", "kafka_errors_total", "Number of errors reported by kafka-go.", clusterLabels)
+	writerRetries        = newDesc("writer", "kafka_retries_total", "Number of retries made by kafka-go.", clusterLabels)
+	writerSuccesses      = newDesc("writer", "cluster_successes_total", "Number of successful writes to the cluster.", clusterLabels)
+	writerErrors         = newDesc("writer", "cluster_errors_total", "Number of failed writes to the cluster.", clusterLabels)
+	writerFallbackWrites = newDesc("writer", "fallback_writes_total", "Number of writes to the cluster as a fallback.", clusterLabels)
+	writerBreakerState   = newDesc("writer", "breaker_state", "Circuit breaker state: 0 closed, 1 open, 2 half-open.", clusterLabels)
+	writerLatency        = newDesc("writer", "latency_seconds", "Moving average of the write latency.", clusterLabels)
+	writerFailovers      = newDesc("writer", "failovers_total", "Number of writes which failed over to another cluster.", nil)
+	writerSpoolMessages  = newDesc("writer", "spool_messages", "Number of messages in the spool waiting for replay.", nil)
+	writerSpoolBytes     = newDesc("writer", "spool_bytes", "Size of the spool segments in bytes.", nil)
+	writerSpooled        = newDesc("writer", "spooled_messages_total", "Number of messages appended to the spool.", nil)
+	writerReplayed       = newDesc("writer", "replayed_messages_total", "Number of messages replayed from the spool.", nil)
+	writerHedges         = newDesc("writer", "hedges_total", "Number of write attempts which were hedged to another cluster.", nil)
+	writerHedgeWins      = newDesc("writer", "hedge_wins_total", "Number of hedged writes acknowledged first by the hedge cluster.", nil)
+	writerHedgeDups      = newDesc("writer", "hedge_duplicate_messages_total", "Number of messages written to more than one cluster by hedging.", nil)
+)
+
+// WriterCollector 是导出 mka.Writer 统计数据的 prometheus.Collector.
+type WriterCollector struct {
+	w *mka.Writer
+
+	mu       sync.Mutex
+	writes   counters
+	messages counters
+	bytes    counters
+	errors   counters
+	retries  counters
+}
+
+// NewWriterCollector 返回导出w的统计数据的 WriterCollector.
+// 它会调用w的 AggregateStats, 所以不要再通过其它方式获取w的kafka-go统计数据, 否则增量数据会被分走.
+func NewWriterCollector(w *mka.Writer) *WriterCollector {
+	return &WriterCollector{
+		w:        w,
+		writes:   counters{},
+		messages: counters{},
+		bytes:    counters{},
+		errors:   counters{},
+		retries:  counters{},
+	}
+}
+
+// Describe 实现 prometheus.Collector.
+func (c *WriterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		writerWrites, writerMessages, writerBytes, writerKafkaErrors, writerRetries,
+		writerSuccesses, writerErrors, writerFallbackWrites, writerBreakerState, writerLatency,
+		writerFailovers, writerSpoolMessages, writerSpoolBytes, writerSpooled, writerReplayed,
+		writerHedges, writerHedgeWins, writerHedgeDups,
+	} {
+		ch <- d
+	}
+}
+
+// Collect 实现 prometheus.Collector.
+func (c *WriterCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.w.AggregateStats()
+	for _, cs := range stats.Clusters {
+		name := cs.Name
+		ch <- prometheus.MustNewConstMetric(writerWrites, prometheus.CounterValue, c.writes.add(name, cs.Kafka.Writes), name)
+		ch <- prometheus.MustNewConstMetric(writerMessages, prometheus.CounterValue, c.messages.add(name, cs.Kafka.Messages), name)
+		ch <- prometheus.MustNewConstMetric(writerBytes, prometheus.CounterValue, c.bytes.add(name, cs.Kafka.Bytes), name)
+		ch <- prometheus.MustNewConstMetric(writerKafkaErrors, prometheus.CounterValue, c.errors.add(name, cs.Kafka.Errors), name)
+		ch <- prometheus.MustNewConstMetric(writerRetries, prometheus.CounterValue, c.retries.add(name, cs.Kafka.Retries), name)
+
+		ch <- prometheus.MustNewConstMetric(writerSuccesses, prometheus.CounterValue, float64(cs.Health.Successes), name)
+		ch <- prometheus.MustNewConstMetric(writerErrors, prometheus.CounterValue, float64(cs.Health.Failures), name)
+		ch <- prometheus.MustNewConstMetric(writerFallbackWrites, prometheus.CounterValue, float64(cs.FallbackWrites), name)
+		ch <- prometheus.MustNewConstMetric(writerBreakerState, prometheus.GaugeValue, float64(cs.Health.State), name)
+		ch <- prometheus.MustNewConstMetric(writerLatency, prometheus.GaugeValue, cs.Health.Latency.Seconds(), name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(writerFailovers, prometheus.CounterValue, float64(stats.Failovers))
+	ch <- prometheus.MustNewConstMetric(writerSpoolMessages, prometheus.GaugeValue, float64(stats.Spool.Messages))
+	ch <- prometheus.MustNewConstMetric(writerSpoolBytes, prometheus.GaugeValue, float64(stats.Spool.Bytes))
+	ch <- prometheus.MustNewConstMetric(writerSpooled, prometheus.CounterValue, float64(stats.Spool.Spooled))
+	ch <- prometheus.MustNewConstMetric(writerReplayed, prometheus.CounterValue, float64(stats.Spool.Replayed))
+	ch <- prometheus.MustNewConstMetric(writerHedges, prometheus.CounterValue, float64(stats.Hedges))
+	ch <- prometheus.MustNewConstMetric(writerHedgeWins, prometheus.CounterValue, float64(stats.HedgeWins))
+	ch <- prometheus.MustNewConstMetric(writerHedgeDups, prometheus.CounterValue, float64(stats.HedgeDuplicates))
+}
+
+var (
+	readerFetches     = newDesc("reader", "fetches_total", "Number of kafka-go fetch requests.", clusterLabels)
+	readerMessages    = newDesc("reader", "messages_total", "Number of messages read by kafka-go.", clusterLabels)
+	readerBytes       = newDesc("reader", "message_bytes_total", "Number of message bytes read.", clusterLabels)
+	readerKafkaErrors = newDesc("reader", "kafka_errors_total", "Number of errors reported by kafka-go.", clusterLabels)
+	readerRebalances  = newDesc("reader", "rebalances_total", "Number of consumer group rebalances.", clusterLabels)
+	readerLag         = newDesc("reader", "lag", "Lag of the reader reported by kafka-go.", clusterLabels)
+	readerMonitorLag  = newDesc("reader", "monitored_lag", "Total lag of the cluster computed by the lag monitor.", clusterLabels)
+	readerReturned    = newDesc("reader", "cluster_messages_total", "Number of messages returned from the cluster.", clusterLabels)
+	readerErrors      = newDesc("reader", "cluster_errors_total", "Number of read errors from the cluster.", clusterLabels)
+	readerDedupDrops  = newDesc("reader", "dedup_drops_total", "Number of duplicated messages dropped.", nil)
+)
+
+// ReaderCollector 是导出 mka.Reader 统计数据的 prometheus.Collector.
+type ReaderCollector struct {
+	r *mka.Reader
+
+	mu         sync.Mutex
+	fetches    counters
+	messages   counters
+	bytes      counters
+	errors     counters
+	rebalances counters
+}
+
+// NewReaderCollector 返回导出r的统计数据的 ReaderCollector.
+// 它会调用r的 AggregateStats, 所以不要再通过其它方式获取r的kafka-go统计数据, 否则增量数据会被分走.
+func NewReaderCollector(r *mka.Reader) *ReaderCollector {
+	return &ReaderCollector{
+		r:          r,
+		fetches:    counters{},
+		messages:   counters{},
+		bytes:      counters{},
+		errors:     counters{},
+		rebalances: counters{},
+	}
+}
+
+// Describe 实现 prometheus.Collector.
+func (c *ReaderCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		readerFetches, readerMessages, readerBytes, readerKafkaErrors, readerRebalances,
+		readerLag, readerMonitorLag, readerReturned, readerErrors, readerDedupDrops,
+	} {
+		ch <- d
+	}
+}
+
+// Collect 实现 prometheus.Collector.
+func (c *ReaderCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.r.AggregateStats()
+	for _, cs := range stats.Clusters {
+		name := cs.Name
+		ch <- prometheus.MustNewConstMetric(readerFetches, prometheus.CounterValue, c.fetches.add(name, cs.Kafka.Fetches), name)
+		ch <- prometheus.MustNewConstMetric(readerMessages, prometheus.CounterValue, c.messages.add(name, cs.Kafka.Messages), name)
+		ch <- prometheus.MustNewConstMetric(readerBytes, prometheus.CounterValue, c.bytes.add(name, cs.Kafka.Bytes), name)
+		ch <- prometheus.MustNewConstMetric(readerKafkaErrors, prometheus.CounterValue, c.errors.add(name, cs.Kafka.Errors), name)
+		ch <- prometheus.MustNewConstMetric(readerRebalances, prometheus.CounterValue, c.rebalances.add(name, cs.Kafka.Rebalances), name)
+		ch <- prometheus.MustNewConstMetric(readerLag, prometheus.GaugeValue, float64(cs.Kafka.Lag), name)
+
+		ch <- prometheus.MustNewConstMetric(readerReturned, prometheus.CounterValue, float64(cs.Messages), name)
+		ch <- prometheus.MustNewConstMetric(readerErrors, prometheus.CounterValue, float64(cs.Errors), name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(readerDedupDrops, prometheus.CounterValue, float64(stats.DedupHits))
+
+	// 只有开启了 mka.WithLagMonitor 才导出监控计算的lag, 计算失败的集群不导出
+	for _, cl := range c.r.LagSnapshot().Clusters {
+		if cl.Err == nil {
+			ch <- prometheus.MustNewConstMetric(readerMonitorLag, prometheus.GaugeValue, float64(cl.Lag), cl.Name)
+		}
+	}
+}
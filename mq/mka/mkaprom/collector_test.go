@@ -0,0 +1,84 @@
+package mkaprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"github.com/smallnest/gofer/mq/mka"
+	"github.com/smallnest/gofer/mq/mka/mkatest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterCollector(t *testing.T) {
+	w := mka.NewWriter(mka.RWModeBackup, []kafka.WriterConfig{
+		{Brokers: []string{"localhost:9092"}, Topic: "test"},
+		{Brokers: []string{"localhost:9093"}, Topic: "test"},
+	}, mka.WithWriterClusterNames("local", "remote"))
+	defer w.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(NewWriterCollector(w)))
+
+	expected := `
+# HELP mka_writer_breaker_state Circuit breaker state: 0 closed, 1 open, 2 half-open.
+# TYPE mka_writer_breaker_state gauge
+mka_writer_breaker_state{cluster="local"} 0
+mka_writer_breaker_state{cluster="remote"} 0
+# HELP mka_writer_failovers_total Number of writes which failed over to another cluster.
+# TYPE mka_writer_failovers_total counter
+mka_writer_failovers_total 0
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "mka_writer_breaker_state", "mka_writer_failovers_total")
+	assert.NoError(t, err)
+
+	n, err := testutil.GatherAndCount(reg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*10+8, n)
+}
+
+func TestReaderCollector(t *testing.T) {
+	r := mka.NewReader([]kafka.ReaderConfig{
+		{Brokers: []string{"localhost:9092"}, Topic: "test", Partition: 0},
+	}, mka.WithDedup(mka.DedupConfig{}))
+	defer r.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(NewReaderCollector(r)))
+
+	expected := `
+# HELP mka_reader_cluster_messages_total Number of messages returned from the cluster.
+# TYPE mka_reader_cluster_messages_total counter
+mka_reader_cluster_messages_total{cluster="cluster-0"} 0
+# HELP mka_reader_dedup_drops_total Number of duplicated messages dropped.
+# TYPE mka_reader_dedup_drops_total counter
+mka_reader_dedup_drops_total 0
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "mka_reader_cluster_messages_total", "mka_reader_dedup_drops_total")
+	assert.NoError(t, err)
+}
+
+func TestReaderCollectorMonitoredLag(t *testing.T) {
+	clusters := mkatest.NewClusters("a", "b")
+	clusters[0].Produce("test", kafka.Message{Value: []byte("1")}, kafka.Message{Value: []byte("2")})
+	r, err := mkatest.NewReader("test", clusters, mka.WithLagMonitor(mka.LagMonitorConfig{Interval: time.Hour}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.Eventually(t, func() bool { return !r.LagSnapshot().Time.IsZero() }, time.Second, 5*time.Millisecond)
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(NewReaderCollector(r)))
+
+	expected := `
+# HELP mka_reader_monitored_lag Total lag of the cluster computed by the lag monitor.
+# TYPE mka_reader_monitored_lag gauge
+mka_reader_monitored_lag{cluster="a"} 2
+mka_reader_monitored_lag{cluster="b"} 0
+`
+	err = testutil.GatherAndCompare(reg, strings.NewReader(expected), "mka_reader_monitored_lag")
+	assert.NoError(t, err)
+}
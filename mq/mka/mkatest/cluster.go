@@ -0,0 +1,186 @@
+// Package mkatest 提供了内存中的假kafka集群, 用来在没有kafka broker的情况下测试 mka.Writer 和 mka.Reader.
+//
+// 每个 Cluster 保存了写入的消息, 通过 Writer 和 Reader 方法返回的对象分别实现 mka.ClusterWriter 和 mka.ClusterReader.
+// Cluster 支持注入故障: 让接下来的N次写入失败、按照消息返回部分失败的 kafka.WriteErrors、增加延迟以及让集群宕机和恢复.
+package mkatest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ErrClusterDown 是集群宕机时写入和读取返回的错误.
+var ErrClusterDown = errors.New("mkatest: cluster is down")
+
+// Cluster 是内存中的假kafka集群, 每个topic只有一个分区.
+type Cluster struct {
+	name string
+
+	mu      sync.Mutex
+	topics  map[string][]kafka.Message
+	notify  chan struct{} // 有新消息写入时关闭并替换, 通知等待的reader
+	down    bool
+	latency time.Duration
+
+	failN   int
+	failErr error
+	failMsg func(msg kafka.Message) error
+
+	writes int
+	probes int
+}
+
+// NewCluster 返回一个名字为name的假集群.
+func NewCluster(name string) *Cluster {
+	return &Cluster{
+		name:   name,
+		topics: make(map[string][]kafka.Message),
+		notify: make(chan struct{}),
+	}
+}
+
+// Name 返回集群的名字.
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// Down 让集群宕机, 之后的写入、读取和探测都返回 ErrClusterDown.
+func (c *Cluster) Down() {
+	c.mu.Lock()
+	c.down = true
+	c.mu.Unlock()
+}
+
+// Up 恢复宕机的集群.
+func (c *Cluster) Up() {
+	c.mu.Lock()
+	c.down = false
+	c.mu.Unlock()
+}
+
+// IsDown 返回集群是否宕机.
+func (c *Cluster) IsDown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.down
+}
+
+// FailNext 让接下来的n次写入返回err, err为nil时返回 ErrClusterDown.
+func (c *Cluster) FailNext(n int, err error) {
+	if err == nil {
+		err = ErrClusterDown
+	}
+
+	c.mu.Lock()
+	c.failN = n
+	c.failErr = err
+	c.mu.Unlock()
+}
+
+// FailMessages 设置按照消息判断写入是否失败的函数, fn返回错误的消息不会被写入,
+// 这时写入返回 kafka.WriteErrors. fn为nil时取消设置.
+func (c *Cluster) FailMessages(fn func(msg kafka.Message) error) {
+	c.mu.Lock()
+	c.failMsg = fn
+	c.mu.Unlock()
+}
+
+// SetLatency 设置每次写入和探测的延迟.
+func (c *Cluster) SetLatency(d time.Duration) {
+	c.mu.Lock()
+	c.latency = d
+	c.mu.Unlock()
+}
+
+// Messages 返回写入topic的所有消息.
+func (c *Cluster) Messages(topic string) []kafka.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]kafka.Message(nil), c.topics[topic]...)
+}
+
+// Writes 返回调用写入的次数, 包括失败的写入.
+func (c *Cluster) Writes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+// Probes 返回调用 Probe 的次数.
+func (c *Cluster) Probes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.probes
+}
+
+// Produce 不经过故障注入直接向topic追加消息, 用来准备reader读取的数据.
+func (c *Cluster) Produce(topic string, msgs ...kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.append(topic, msgs)
+}
+
+// append 追加消息并通知等待的reader, 调用时必须持有锁.
+func (c *Cluster) append(topic string, msgs []kafka.Message) {
+	log := c.topics[topic]
+	now := time.Now()
+	for _, msg := range msgs {
+		msg.Topic = topic
+		msg.Partition = 0
+		msg.Offset = int64(len(log))
+		if msg.Time.IsZero() {
+			msg.Time = now
+		}
+		log = append(log, msg)
+	}
+	c.topics[topic] = log
+
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// Probe 探测集群是否健康, 集群宕机时返回 ErrClusterDown.
+func (c *Cluster) Probe(ctx context.Context) error {
+	c.mu.Lock()
+	c.probes++
+	latency, down := c.latency, c.down
+	c.mu.Unlock()
+
+	if err := sleep(ctx, latency); err != nil {
+		return err
+	}
+	if down {
+		return ErrClusterDown
+	}
+	return nil
+}
+
+// Writer 返回向这个集群写入消息的writer, 没有设置topic的消息写入topic.
+func (c *Cluster) Writer(topic string) *Writer {
+	return &Writer{cluster: c, topic: topic}
+}
+
+// Reader 返回从这个集群的topic中从头读取消息的reader.
+func (c *Cluster) Reader(topic string) *Reader {
+	return &Reader{cluster: c, topic: topic, closed: make(chan struct{})}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
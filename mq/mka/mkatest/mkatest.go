@@ -0,0 +1,57 @@
+package mkatest
+
+import "github.com/smallnest/gofer/mq/mka"
+
+var (
+	_ mka.ClusterWriter = (*Writer)(nil)
+	_ mka.ClusterProber = (*Writer)(nil)
+	_ mka.ClusterReader = (*Reader)(nil)
+)
+
+// NewClusters 返回名字分别为names的假集群.
+func NewClusters(names ...string) []*Cluster {
+	clusters := make([]*Cluster, len(names))
+	for i, name := range names {
+		clusters[i] = NewCluster(name)
+	}
+	return clusters
+}
+
+// Names 返回集群的名字, 可以传给 mka.WithWriterClusterNames 和 mka.WithReaderClusterNames.
+func Names(clusters []*Cluster) []string {
+	names := make([]string, len(clusters))
+	for i, c := range clusters {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// Writers 返回向每个集群的topic写入消息的writer, 可以传给 mka.NewWriterFromClusters.
+func Writers(topic string, clusters []*Cluster) []mka.ClusterWriter {
+	writers := make([]mka.ClusterWriter, len(clusters))
+	for i, c := range clusters {
+		writers[i] = c.Writer(topic)
+	}
+	return writers
+}
+
+// Readers 返回从每个集群的topic读取消息的reader, 可以传给 mka.NewReaderFromClusters.
+func Readers(topic string, clusters []*Cluster) []mka.ClusterReader {
+	readers := make([]mka.ClusterReader, len(clusters))
+	for i, c := range clusters {
+		readers[i] = c.Reader(topic)
+	}
+	return readers
+}
+
+// NewWriter 返回写入clusters的 mka.Writer, 集群的名字作为 mka.Writer 中集群的名字.
+func NewWriter(rwmode mka.RWMode, topic string, clusters []*Cluster, opts ...mka.WriterOption) (*mka.Writer, error) {
+	opts = append([]mka.WriterOption{mka.WithWriterClusterNames(Names(clusters)...)}, opts...)
+	return mka.NewWriterFromClusters(rwmode, Writers(topic, clusters), opts...)
+}
+
+// NewReader 返回读取clusters的 mka.Reader, 集群的名字作为 mka.Reader 中集群的名字.
+func NewReader(topic string, clusters []*Cluster, opts ...mka.ReaderOption) (*mka.Reader, error) {
+	opts = append([]mka.ReaderOption{mka.WithReaderClusterNames(Names(clusters)...)}, opts...)
+	return mka.NewReaderFromClusters(Readers(topic, clusters), opts...)
+}
@@ -0,0 +1,335 @@
+package mkatest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/smallnest/gofer/mq/mka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupFailover(t *testing.T) {
+	clusters := NewClusters("primary", "backup")
+	w, err := NewWriter(mka.RWModeBackup, "orders", clusters, mka.WithBreaker(mka.BreakerConfig{FailureThreshold: 2}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, w.WriteMessages(ctx, kafka.Message{Value: []byte("1")}))
+	assert.Len(t, clusters[0].Messages("orders"), 1)
+
+	clusters[0].Down()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, w.WriteMessages(ctx, kafka.Message{Value: []byte("2")}))
+	}
+	assert.Len(t, clusters[1].Messages("orders"), 3)
+	assert.Equal(t, mka.BreakerOpen, w.Health(0).State)
+	// 熔断之后不再尝试写入主集群
+	assert.Equal(t, 3, clusters[0].Writes())
+
+	clusters[1].Down()
+	assert.Error(t, w.WriteMessages(ctx, kafka.Message{Value: []byte("3")}))
+}
+
+func TestFailNext(t *testing.T) {
+	clusters := NewClusters("a", "b")
+	w, _ := NewWriter(mka.RWModeBackup, "t", clusters)
+	defer w.Close()
+
+	boom := errors.New("boom")
+	clusters[0].FailNext(1, boom)
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("1")}))
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("2")}))
+
+	assert.Len(t, clusters[0].Messages("t"), 1)
+	assert.Len(t, clusters[1].Messages("t"), 1)
+	assert.Equal(t, boom, w.Health(0).LastError)
+}
+
+func TestPartialWriteErrors(t *testing.T) {
+	clusters := NewClusters("a", "b")
+	w, _ := NewWriter(mka.RWModeBackup, "t", clusters)
+	defer w.Close()
+
+	clusters[0].FailMessages(func(msg kafka.Message) error {
+		if string(msg.Value) == "bad" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+
+	msgs := []kafka.Message{{Value: []byte("ok")}, {Value: []byte("bad")}, {Value: []byte("ok")}}
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+
+	// 只有失败的消息被重新发送到从集群
+	assert.Len(t, clusters[0].Messages("t"), 2)
+	if backup := clusters[1].Messages("t"); assert.Len(t, backup, 1) {
+		assert.Equal(t, "bad", string(backup[0].Value))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	clusters := NewClusters("slow", "fast")
+	w, _ := NewWriter(mka.RWModeBackup, "t", clusters, mka.WithRetryPolicy(mka.RetryPolicy{AttemptTimeout: 20 * time.Millisecond}))
+	defer w.Close()
+
+	clusters[0].SetLatency(time.Second)
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("1")}))
+	assert.Empty(t, clusters[0].Messages("t"))
+	assert.Len(t, clusters[1].Messages("t"), 1)
+}
+
+func TestFailbackProbe(t *testing.T) {
+	clusters := NewClusters("primary", "backup")
+	events := make(chan mka.BackupEvent, 10)
+	w, _ := NewWriter(mka.RWModeBackup, "t", clusters, mka.WithFailback(mka.FailbackConfig{
+		FailoverThreshold: 1,
+		ProbeInterval:     5 * time.Millisecond,
+		HealthyPeriod:     10 * time.Millisecond,
+		OnEvent:           func(e mka.BackupEvent) { events <- e },
+	}))
+	defer w.Close()
+
+	clusters[0].Down()
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("1")}))
+	assert.Equal(t, mka.BackupStateFailedOver, (<-events).To)
+
+	clusters[0].Up()
+	assert.Equal(t, mka.BackupStateRecovering, (<-events).To)
+	assert.Equal(t, mka.BackupStatePrimary, (<-events).To)
+	assert.Greater(t, clusters[0].Probes(), 0)
+}
+
+func TestReaderDedup(t *testing.T) {
+	clusters := NewClusters("a", "b")
+	w, _ := NewWriter(mka.RWModeMirror, "t", clusters, mka.WithProducerID("p1"))
+	defer w.Close()
+
+	r, err := NewReader("t", clusters, mka.WithDedup(mka.DedupConfig{}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, w.WriteMessages(ctx, kafka.Message{Value: []byte("1")}, kafka.Message{Value: []byte("2")}))
+
+	var got []string
+	for len(got) < 2 {
+		msgs, err := r.ReadMessage(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, msg := range msgs {
+			got = append(got, string(msg.Value))
+		}
+	}
+	assert.ElementsMatch(t, []string{"1", "2"}, got)
+
+	// 镜像到两个集群的消息各有一份被去掉
+	for r.DedupStats().Hits < 2 {
+		if _, err := r.ReadMessage(ctx); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, int64(2), r.DedupStats().Hits)
+}
+
+func TestReader(t *testing.T) {
+	c := NewCluster("a")
+	c.Produce("t", kafka.Message{Value: []byte("1")}, kafka.Message{Value: []byte("2")})
+
+	r := c.Reader("t")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg, err := r.ReadMessage(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), msg.Offset)
+	assert.Equal(t, int64(1), r.Lag())
+
+	lag, err := r.ReadLag(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), lag)
+
+	assert.NoError(t, r.SetOffset(kafka.LastOffset))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Produce("t", kafka.Message{Value: []byte("3")})
+	}()
+	msg, err = r.ReadMessage(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", string(msg.Value))
+
+	c.Down()
+	_, err = r.ReadMessage(ctx)
+	assert.Equal(t, ErrClusterDown, err)
+	c.Up()
+
+	assert.NoError(t, r.Close())
+	_, err = r.ReadMessage(ctx)
+	assert.Error(t, err)
+}
+
+func TestWriterStats(t *testing.T) {
+	c := NewCluster("a")
+	w := c.Writer("t")
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("abc")}))
+
+	stats := w.Stats()
+	assert.Equal(t, int64(1), stats.Writes)
+	assert.Equal(t, int64(1), stats.Messages)
+	assert.Equal(t, int64(3), stats.Bytes)
+	assert.Equal(t, int64(0), w.Stats().Writes)
+}
+
+func TestReaderCommit(t *testing.T) {
+	c := NewCluster("a")
+	c.Produce("t", kafka.Message{Value: []byte("1")}, kafka.Message{Value: []byte("2")})
+
+	r := c.Reader("t")
+	defer r.Close()
+	ctx := context.Background()
+
+	msg, err := r.FetchMessage(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), r.Committed())
+
+	assert.NoError(t, r.CommitMessages(ctx, msg))
+	assert.Equal(t, int64(1), r.Committed())
+
+	// ReadMessage 自动提交, 提交的offset不会后退
+	_, err = r.ReadMessage(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, r.CommitMessages(ctx, msg))
+	assert.Equal(t, int64(2), r.Committed())
+
+	c.Down()
+	assert.Equal(t, ErrClusterDown, r.CommitMessages(ctx, msg))
+}
+
+func TestReaderTotalLag(t *testing.T) {
+	c := NewCluster("a")
+	c.Produce("t", kafka.Message{Value: []byte("1")}, kafka.Message{Value: []byte("2")})
+
+	r := c.Reader("t")
+	defer r.Close()
+	ctx := context.Background()
+
+	// 读取之后还没有提交的消息仍然计入lag
+	msg, err := r.FetchMessage(ctx)
+	assert.NoError(t, err)
+	lag, err := r.TotalLag(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), lag)
+
+	assert.NoError(t, r.CommitMessages(ctx, msg))
+	lag, err = r.TotalLag(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), lag)
+
+	c.Down()
+	_, err = r.TotalLag(ctx)
+	assert.Equal(t, ErrClusterDown, err)
+}
+
+func TestReaderBatchIdleCluster(t *testing.T) {
+	clusters := NewClusters("idle", "busy")
+	for i := 0; i < 100; i++ {
+		clusters[1].Produce("t", kafka.Message{Value: []byte(strconv.Itoa(i))})
+	}
+
+	r, err := NewReader("t", clusters)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+
+	// 空闲的集群不会占用这一批的名额, 不用等待超时
+	start := time.Now()
+	b, err := r.ReadBatch(context.Background(), 10, 2*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, b.Len())
+	assert.Less(t, time.Since(start), time.Second)
+
+	b, err = r.ReadBatch(context.Background(), 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, b.Len())
+	assert.Equal(t, "10", string(b.Clusters[0].Messages[0].Value))
+}
+
+func TestReaderBatchDedup(t *testing.T) {
+	clusters := NewClusters("a", "b")
+	w, _ := NewWriter(mka.RWModeMirror, "t", clusters, mka.WithProducerID("p1"))
+	defer w.Close()
+
+	readers := []*Reader{clusters[0].Reader("t"), clusters[1].Reader("t")}
+	r, err := mka.NewReaderFromClusters([]mka.ClusterReader{readers[0], readers[1]},
+		mka.WithReaderClusterNames(Names(clusters)...), mka.WithDedup(mka.DedupConfig{}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, w.WriteMessages(ctx, kafka.Message{Value: []byte("1")}))
+
+	b, err := r.ReadBatch(ctx, 1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Len())
+	assert.NoError(t, b.Commit(ctx))
+
+	// 只读取到重复消息时返回空的一批, 重复消息和这一批一起提交
+	b, err = r.ReadBatch(ctx, 1, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Len())
+	assert.NoError(t, b.Commit(ctx))
+	for _, reader := range readers {
+		assert.Equal(t, int64(1), reader.Committed())
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	clusters := NewClusters("a", "b")
+	w, err := NewWriter(mka.RWModeMultiRW, "test", clusters)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		err := w.WriteMessages(ctx, kafka.Message{
+			Key:   []byte("Key-" + strconv.Itoa(i)),
+			Value: []byte("Hello World: " + strconv.Itoa(i)),
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 10, len(clusters[0].Messages("test"))+len(clusters[1].Messages("test")))
+
+	r, err := NewReader("test", clusters)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+
+	count := 0
+	for count < 10 {
+		msgs, err := r.ReadMessage(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Greater(t, len(msgs), 0)
+		count += len(msgs)
+	}
+	assert.Equal(t, 10, count)
+}
@@ -0,0 +1,226 @@
+package mkatest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Reader 是假集群的reader, 实现了 mka.ClusterReader.
+type Reader struct {
+	cluster *Cluster
+	topic   string
+
+	mu        sync.Mutex
+	offset    int64
+	committed int64
+	stats     kafka.ReaderStats
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ReadMessage 读取下一条消息并提交它的offset, 没有新消息时阻塞直到有新消息写入、ctx结束或者reader被关闭.
+// 集群宕机时返回 ErrClusterDown, reader被关闭之后返回 io.EOF.
+func (r *Reader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	msg, err := r.FetchMessage(ctx)
+	if err != nil {
+		return msg, err
+	}
+
+	r.commit(msg.Offset)
+	return msg, nil
+}
+
+// FetchMessage 和 ReadMessage 一样读取下一条消息, 但是不提交offset.
+func (r *Reader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	c := r.cluster
+	for {
+		select {
+		case <-r.closed:
+			return kafka.Message{}, io.EOF
+		default:
+		}
+
+		c.mu.Lock()
+		if c.down {
+			c.mu.Unlock()
+			r.recordError()
+			return kafka.Message{}, ErrClusterDown
+		}
+
+		log := c.topics[r.topic]
+		notify := c.notify
+
+		r.mu.Lock()
+		if r.offset < int64(len(log)) {
+			msg := log[r.offset]
+			r.offset++
+			r.stats.Fetches++
+			r.stats.Messages++
+			r.stats.Bytes += int64(len(msg.Key) + len(msg.Value))
+			r.stats.Lag = int64(len(log)) - r.offset
+			r.mu.Unlock()
+			c.mu.Unlock()
+			return msg, nil
+		}
+		r.mu.Unlock()
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-r.closed:
+			return kafka.Message{}, io.EOF
+		case <-notify:
+		}
+	}
+}
+
+// CommitMessages 提交消息的offset, 提交的offset只会前进. 集群宕机时返回 ErrClusterDown.
+func (r *Reader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if r.cluster.IsDown() {
+		return ErrClusterDown
+	}
+
+	for _, msg := range msgs {
+		r.commit(msg.Offset)
+	}
+	return nil
+}
+
+// Committed 返回已经提交的offset, 也就是下一条还没有提交的消息的offset.
+func (r *Reader) Committed() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.committed
+}
+
+func (r *Reader) commit(offset int64) {
+	r.mu.Lock()
+	if offset+1 > r.committed {
+		r.committed = offset + 1
+	}
+	r.mu.Unlock()
+}
+
+func (r *Reader) recordError() {
+	r.mu.Lock()
+	r.stats.Errors++
+	r.mu.Unlock()
+}
+
+// Close 关闭reader, 正在阻塞的 ReadMessage 返回 io.EOF.
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return nil
+}
+
+// Stats 和 kafka.Reader 一样返回自上次调用以来的统计数据.
+func (r *Reader) Stats() kafka.ReaderStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Topic = r.topic
+	stats.Partition = "0"
+	stats.Offset = r.offset
+	r.stats = kafka.ReaderStats{Lag: r.stats.Lag}
+	return stats
+}
+
+// Lag 返回最后一次读取之后还没有读取的消息数.
+func (r *Reader) Lag() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats.Lag
+}
+
+// Offset 返回下一条要读取的消息的offset.
+func (r *Reader) Offset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offset
+}
+
+// ReadLag 返回当前还没有读取的消息数.
+func (r *Reader) ReadLag(ctx context.Context) (int64, error) {
+	c := r.cluster
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		return 0, ErrClusterDown
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lag := int64(len(c.topics[r.topic])) - r.offset
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
+
+// TotalLag 和consumer group一样, 返回还没有提交的消息数, 实现了 mka.ClusterLagger.
+func (r *Reader) TotalLag(ctx context.Context) (int64, error) {
+	c := r.cluster
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		return 0, ErrClusterDown
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lag := int64(len(c.topics[r.topic])) - r.committed
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
+
+// SetOffset 设置下一条要读取的消息的offset, 支持 kafka.FirstOffset 和 kafka.LastOffset.
+func (r *Reader) SetOffset(offset int64) error {
+	c := r.cluster
+	c.mu.Lock()
+	end := int64(len(c.topics[r.topic]))
+	c.mu.Unlock()
+
+	switch {
+	case offset == kafka.FirstOffset:
+		offset = 0
+	case offset == kafka.LastOffset:
+		offset = end
+	case offset < 0:
+		return errors.New("mkatest: invalid offset")
+	}
+
+	r.mu.Lock()
+	r.offset = offset
+	r.mu.Unlock()
+	return nil
+}
+
+// SetOffsetAt 把offset设置为第一条时间不早于t的消息.
+func (r *Reader) SetOffsetAt(ctx context.Context, t time.Time) error {
+	c := r.cluster
+	c.mu.Lock()
+	log := c.topics[r.topic]
+	offset := int64(len(log))
+	for i, msg := range log {
+		if !msg.Time.Before(t) {
+			offset = int64(i)
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	r.mu.Lock()
+	r.offset = offset
+	r.mu.Unlock()
+	return nil
+}
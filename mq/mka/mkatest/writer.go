@@ -0,0 +1,132 @@
+package mkatest
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Writer 是假集群的writer, 实现了 mka.ClusterWriter 和 mka.ClusterProber.
+type Writer struct {
+	cluster *Cluster
+	topic   string
+
+	mu     sync.Mutex
+	closed bool
+	stats  kafka.WriterStats
+}
+
+// WriteMessages 把消息写入假集群, 按照集群的设置注入延迟和故障.
+func (w *Writer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	closed := w.closed
+	w.mu.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+
+	c := w.cluster
+	c.mu.Lock()
+	c.writes++
+	latency := c.latency
+	c.mu.Unlock()
+
+	if err := sleep(ctx, latency); err != nil {
+		w.record(nil, err)
+		return err
+	}
+
+	c.mu.Lock()
+	err := w.write(msgs)
+	c.mu.Unlock()
+
+	w.record(msgs, err)
+	return err
+}
+
+// write 按照故障注入的设置写入消息, 调用时必须持有集群的锁.
+func (w *Writer) write(msgs []kafka.Message) error {
+	c := w.cluster
+	if c.down {
+		return ErrClusterDown
+	}
+	if c.failN > 0 {
+		c.failN--
+		return c.failErr
+	}
+
+	byTopic := make(map[string][]kafka.Message)
+	var topics []string
+	werr := make(kafka.WriteErrors, len(msgs))
+	failed := false
+	for i, msg := range msgs {
+		if c.failMsg != nil {
+			if werr[i] = c.failMsg(msg); werr[i] != nil {
+				failed = true
+				continue
+			}
+		}
+
+		topic := msg.Topic
+		if topic == "" {
+			topic = w.topic
+		}
+		if _, ok := byTopic[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		byTopic[topic] = append(byTopic[topic], msg)
+	}
+
+	for _, topic := range topics {
+		c.append(topic, byTopic[topic])
+	}
+
+	if failed {
+		return werr
+	}
+	return nil
+}
+
+func (w *Writer) record(msgs []kafka.Message, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stats.Writes++
+	if err != nil {
+		w.stats.Errors++
+	}
+	werr, _ := err.(kafka.WriteErrors)
+	for i, msg := range msgs {
+		if err != nil && (werr == nil || werr[i] != nil) {
+			continue
+		}
+		w.stats.Messages++
+		w.stats.Bytes += int64(len(msg.Key) + len(msg.Value))
+	}
+}
+
+// Close 关闭writer, 之后的写入返回 io.ErrClosedPipe.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return nil
+}
+
+// Stats 和 kafka.Writer 一样返回自上次调用以来的统计数据.
+func (w *Writer) Stats() kafka.WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := w.stats
+	stats.Topic = w.topic
+	w.stats = kafka.WriterStats{}
+	return stats
+}
+
+// Probe 探测假集群是否健康.
+func (w *Writer) Probe(ctx context.Context) error {
+	return w.cluster.Probe(ctx)
+}
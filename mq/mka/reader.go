@@ -3,64 +3,178 @@ package mka
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/gammazero/workerpool"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/multierr"
 )
 
+// Message 是从某个kafka集群读取到的消息.
+type Message struct {
+	kafka.Message
+
+	// Cluster 是消息来源集群读取时的索引, ClusterName 是它的名字.
+	// 增删集群之后索引可能改变, 名字不会改变.
+	Cluster     int
+	ClusterName string
+
+	// dropped 是流式读取时在这条消息之前从同一个集群读取到并且被去重去掉的重复消息,
+	// 提交这条消息时一起提交.
+	dropped []kafka.Message
+}
+
+// ReaderOption 是 Reader 的可选配置.
+type ReaderOption func(*Reader)
+
+// WithReaderClusterNames 设置每个kafka集群的名字, 用于统计数据和错误信息.
+// 没有设置名字的集群使用 "cluster-<索引>" 作为名字.
+func WithReaderClusterNames(names ...string) ReaderOption {
+	return func(r *Reader) {
+		copy(r.names, names)
+	}
+}
+
 // Reader 代表一个支持多Kafka集群的reader.
 // 它会从多个kafka集群同时读取消息.
 type Reader struct {
-	configs []kafka.ReaderConfig
+	idx uint64
+
+	// mu 保护集群列表的替换, set 是当前的集群列表. closed 之后不再接受新的读取, 也不能再增删集群.
+	mu     sync.RWMutex
+	set    *readerSet
+	closed bool
+
+	// names 是创建时各个集群的名字.
+	names []string
+
+	dedup *dedupIndex
+
+	tracing *tracing
 
-	idx     uint64
-	n       int
-	readers []*kafka.Reader
+	// scheduler 安排每次读取的集群顺序, idleTimeout 是等待下一组集群之前的空闲时间.
+	scheduler   ReadScheduler
+	idleTimeout time.Duration
 
-	wp *workerpool.WorkerPool
+	// streamConfig 不为nil时开启流式读取, stream 是它的状态.
+	streamConfig *StreamConfig
+	stream       *stream
+
+	// lagConfig 不为nil时开启lag监控, lagMonitor 是它的状态.
+	lagConfig  *LagMonitorConfig
+	lagMonitor *lagMonitor
+
+	shutdown shutdown
+}
+
+// ClusterReader 是单个kafka集群的reader, *kafka.Reader 实现了这个接口.
+// 测试时可以使用 mkatest 包中的假集群代替真实的kafka集群.
+//
+// Reader 总是通过 FetchMessage 读取消息, 需要自动提交时在读取之后调用 CommitMessages.
+// 和 *kafka.Reader 一样, FetchMessage 因为ctx结束返回时不能丢失还没有返回的消息.
+type ClusterReader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+	Stats() kafka.ReaderStats
+	Lag() int64
+	Offset() int64
+	ReadLag(ctx context.Context) (int64, error)
+	SetOffset(offset int64) error
+	SetOffsetAt(ctx context.Context, t time.Time) error
 }
 
 // NewReader 返回一个支持多Kafka集群的reader.
-func NewReader(configs []kafka.ReaderConfig) *Reader {
+//
+// configs 为空, 或者 WithReaderClusterNames 设置了重复的名字时会panic.
+// 需要处理这些错误时使用 NewReaderFromConfig 或者 NewReaderFromClusters.
+func NewReader(configs []kafka.ReaderConfig, opts ...ReaderOption) *Reader {
+	r, err := newKafkaReader(configs, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// newKafkaReader 为每个配置创建kafka-go的reader并创建 Reader, 失败时关闭已经创建的reader.
+func newKafkaReader(configs []kafka.ReaderConfig, opts ...ReaderOption) (*Reader, error) {
 	if len(configs) == 0 {
-		panic("must set at least one kafka cluster")
+		return nil, ErrNoCluster
+	}
+
+	readers := newKafkaReaders(configs)
+	r, err := newReader(configs, readers, opts...)
+	if err != nil {
+		for _, reader := range readers {
+			reader.Close()
+		}
+		return nil, err
 	}
+	return r, nil
+}
 
-	var readers []*kafka.Reader
-	for _, config := range configs {
-		readers = append(readers, kafka.NewReader(config))
+// NewReaderFromClusters 使用给定的 ClusterReader 创建 Reader, 每个 ClusterReader 代表一个kafka集群.
+func NewReaderFromClusters(readers []ClusterReader, opts ...ReaderOption) (*Reader, error) {
+	if len(readers) == 0 {
+		return nil, ErrNoCluster
 	}
+	return newReader(make([]kafka.ReaderConfig, len(readers)), readers, opts...)
+}
 
-	n := len(configs)
+func newKafkaReaders(configs []kafka.ReaderConfig) []ClusterReader {
+	readers := make([]ClusterReader, len(configs))
+	for i, config := range configs {
+		readers[i] = kafka.NewReader(config)
+	}
+	return readers
+}
 
-	return &Reader{
-		configs: configs,
+func newReader(configs []kafka.ReaderConfig, readers []ClusterReader, opts ...ReaderOption) (*Reader, error) {
+	n := len(readers)
 
-		idx:     0,
-		n:       n,
-		readers: readers,
+	r := &Reader{
+		idx:   0,
+		names: defaultClusterNames(n),
+	}
 
-		wp: workerpool.New(n),
+	for _, opt := range opts {
+		opt(r)
 	}
-}
 
-// Close 关闭所有的reader, 阻止程序读取更多的kafka消息.
-func (r *Reader) Close() error {
-	var err error
-	for _, r := range r.readers {
-		e := r.Close()
-		if e != nil {
-			err = multierr.Append(err, e)
+	seen := make(map[string]bool, n)
+	clusters := make([]*readerCluster, n)
+	for i := range configs {
+		if seen[r.names[i]] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateCluster, r.names[i])
 		}
+		seen[r.names[i]] = true
 	}
+	for i, config := range configs {
+		clusters[i] = &readerCluster{
+			name:   r.names[i],
+			config: config,
+			reader: readers[i],
+		}
+	}
+	r.set = newReaderSet(clusters)
 
-	r.wp.Stop()
+	if r.streamConfig != nil {
+		r.stream = newStream(r, *r.streamConfig)
+		r.stream.sync()
+	}
+	if r.lagConfig != nil {
+		r.lagMonitor = newLagMonitor(r, *r.lagConfig)
+	}
+
+	return r, nil
+}
 
-	return err
+// Close 关闭所有的reader, 阻止程序读取更多的kafka消息. Close 等同于没有截止时间的 Shutdown.
+func (r *Reader) Close() error {
+	return r.Shutdown(context.Background())
 }
 
 // ReadMessage reads from all kafka clusters and return the next messages from the r. The method call
@@ -74,36 +188,152 @@ func (r *Reader) Close() error {
 // before the message is fully processed.
 //
 // If more fine grained control of when offsets are  committed is required, it
-// is recommended to use FetchMessage with CommitMessages instead.
+// is recommended to use FetchMessages with CommitMessages instead.
+//
+// If dedup is enabled, duplicated messages are dropped, and the method keeps
+// reading until at least one message is not a duplicate.
+//
+// 所有集群都读取失败时, 返回的error包含每个集群的 ClusterError, 可以通过 errors.As 获取.
 func (r *Reader) ReadMessage(ctx context.Context) ([]kafka.Message, error) {
+	msgs, err := r.ReadClusterMessages(ctx)
+	if msgs == nil {
+		return nil, err
+	}
+
+	kmsgs := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		kmsgs[i] = msg.Message
+	}
+	return kmsgs, err
+}
+
+// ReadClusterMessages 和 ReadMessage 一样读取消息, 但是返回的每条消息都标记了它来自哪个集群.
+func (r *Reader) ReadClusterMessages(ctx context.Context) ([]Message, error) {
+	return r.readMessages(ctx, false)
+}
+
+// FetchMessages 和 ReadClusterMessages 一样读取消息, 但是使用consumer group时不会自动提交offset.
+// 处理完消息之后需要调用 CommitMessages 提交, 它按照消息标记的集群把offset提交到对应的kafka集群.
+func (r *Reader) FetchMessages(ctx context.Context) ([]Message, error) {
+	return r.readMessages(ctx, true)
+}
+
+func (r *Reader) readMessages(ctx context.Context, fetch bool) ([]Message, error) {
+	if r.stream != nil {
+		msgs, err := r.stream.next(ctx)
+		if err == nil && !fetch {
+			err = r.stream.commit(ctx, msgs)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return msgs, nil
+	}
+
+	for {
+		msgs, err := r.readMessage(ctx, fetch)
+		if err != nil || r.dedup == nil || len(msgs) == 0 {
+			return msgs, err
+		}
+
+		if msgs = r.dedup.filter(msgs); len(msgs) > 0 {
+			return msgs, nil
+		}
+	}
+}
+
+// readMessage 从当前的集群列表读取消息, 读取期间集群列表被替换时使用新的集群列表重新读取.
+// fetch 为true时不自动提交offset.
+func (r *Reader) readMessage(ctx context.Context, fetch bool) ([]Message, error) {
+	for {
+		set := r.acquire()
+		if set == nil {
+			return nil, io.EOF
+		}
+		msgs, err := r.readFrom(ctx, set, fetch)
+		set.release()
+
+		if len(msgs) > 0 || ctx.Err() != nil || !set.isRetired() {
+			return msgs, err
+		}
+	}
+}
+
+func (r *Reader) readFrom(ctx context.Context, set *readerSet, fetch bool) ([]Message, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// 集群列表被替换时打断正在进行的读取
+	go func() {
+		select {
+		case <-set.retired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	var mu sync.Mutex
-	var msgs []kafka.Message
+	var msgs []Message
 	var err error
 
 	var wg sync.WaitGroup
-	wg.Add(r.n)
-
-	idx := atomic.AddUint64(&r.idx, 1) % uint64(r.n)
-	for i := 0; i < r.n; i++ {
-		reader := r.readers[(idx+uint64(i))%uint64(r.n)]
-
-		r.wp.Submit(func() {
+	// finished 在每个集群的读取结束时收到通知
+	finished := make(chan struct{}, len(set.clusters))
+	launch := func(j int) {
+		c := set.clusters[j]
+		wg.Add(1)
+		set.wp.Submit(func() {
 			defer wg.Done()
+			defer func() { finished <- struct{}{} }()
 
-			msg, e := reader.ReadMessage(ctx)
+			msg, _, e := c.fetch(ctx, !fetch)
 			if e == nil {
+				c.record(nil)
+				if r.tracing != nil {
+					r.traceReceive(ctx, j, c.name, msg)
+				}
 				mu.Lock()
-				msgs = append(msgs, msg)
+				msgs = append(msgs, Message{Message: msg, Cluster: j, ClusterName: c.name})
 				mu.Unlock()
 				cancel()
 			} else if !errors.Is(e, context.Canceled) {
-				err = multierr.Append(err, e)
+				c.record(e)
+				mu.Lock()
+				err = multierr.Append(err, ClusterError{Cluster: j, Name: c.name, Err: e})
+				mu.Unlock()
 			}
 		})
 	}
+
+	// 按照分组依次加入读取, 前面的集群空闲超时或者都读取失败之后才读取下一组
+	tiers := r.schedule(set)
+	launched, done := 0, 0
+	for k, tier := range tiers {
+		for _, j := range tier {
+			launch(j)
+		}
+		launched += len(tier)
+		if k == len(tiers)-1 {
+			break
+		}
+
+		timer := time.NewTimer(r.idleTimeout)
+	wait:
+		for done < launched {
+			select {
+			case <-finished:
+				done++
+			case <-timer.C:
+				break wait
+			case <-ctx.Done():
+				break wait
+			}
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+	}
 	wg.Wait()
 
 	if len(msgs) > 0 {
@@ -115,22 +345,32 @@ func (r *Reader) ReadMessage(ctx context.Context) ([]kafka.Message, error) {
 
 // Lag returns the lag of the last message returned by ReadMessage, or -1
 // if r is backed by a consumer group.
+//
+// i 超出集群列表的范围时返回0. 集群被添加或者移除之后索引会改变.
+//
+// Deprecated: 使用 AggregateStats, 它按照名字返回每个集群的统计数据, 其中 Kafka.Lag 是这个集群的lag.
 func (r *Reader) Lag(i int) int64 {
-	if i >= r.n {
+	set := r.current()
+	if i < 0 || i >= len(set.clusters) {
 		return 0
 	}
 
-	return r.readers[i].Lag()
+	return set.clusters[i].reader.Lag()
 }
 
 // Offset returns the current absolute offset of the reader, or -1
 // if r is backed by a consumer group.
+//
+// i 超出集群列表的范围时返回0. 集群被添加或者移除之后索引会改变.
+//
+// Deprecated: 使用 AggregateStats, 它按照名字返回每个集群的统计数据, 其中 Kafka.Offset 是这个集群的offset.
 func (r *Reader) Offset(i int) int64 {
-	if i >= r.n {
+	set := r.current()
+	if i < 0 || i >= len(set.clusters) {
 		return 0
 	}
 
-	return r.readers[i].Offset()
+	return set.clusters[i].reader.Offset()
 }
 
 // ReadLag returns the current lag of the reader by fetching the last offset of
@@ -144,12 +384,15 @@ func (r *Reader) Offset(i int) int64 {
 //
 // The function returns a lag of zero when the reader's current offset is
 // negative.
+//
+// i 超出集群列表的范围时返回包装 ErrUnknownCluster 的错误.
 func (r *Reader) ReadLag(ctx context.Context, i int) (lag int64, err error) {
-	if i >= r.n {
-		return 0, errors.New("wrong index")
+	set := r.current()
+	if i < 0 || i >= len(set.clusters) {
+		return 0, unknownIndex(i)
 	}
 
-	return r.readers[i].ReadLag(ctx)
+	return set.clusters[i].reader.ReadLag(ctx)
 }
 
 // SetOffset changes the offset from which the next batch of messages will be
@@ -160,12 +403,15 @@ func (r *Reader) ReadLag(ctx context.Context, i int) (lag int64, err error) {
 // to indicate the first or last offset in previous versions, the meanings of the numbers
 // were swapped in 0.2.0 to match the meanings in other libraries and the Kafka protocol
 // specification.
+//
+// i 超出集群列表的范围时返回包装 ErrUnknownCluster 的错误.
 func (r *Reader) SetOffset(i int, offset int64) error {
-	if i >= r.n {
-		return errors.New("wrong index")
+	set := r.current()
+	if i < 0 || i >= len(set.clusters) {
+		return unknownIndex(i)
 	}
 
-	return r.readers[i].SetOffset(offset)
+	return set.clusters[i].reader.SetOffset(offset)
 }
 
 // SetOffsetAt changes the offset from which the next batch of messages will be
@@ -173,12 +419,15 @@ func (r *Reader) SetOffset(i int, offset int64) error {
 //
 // The method fails if the unable to connect partition leader, or unable to read the offset
 // given the ts, or if the reader has been closed.
+//
+// i 超出集群列表的范围时返回包装 ErrUnknownCluster 的错误.
 func (r *Reader) SetOffsetAt(ctx context.Context, i int, t time.Time) error {
-	if i >= r.n {
-		return errors.New("wrong index")
+	set := r.current()
+	if i < 0 || i >= len(set.clusters) {
+		return unknownIndex(i)
 	}
 
-	return r.readers[i].SetOffsetAt(ctx, t)
+	return set.clusters[i].reader.SetOffsetAt(ctx, t)
 }
 
 // Stats returns a snapshot of the reader stats since the last time the method
@@ -188,10 +437,19 @@ func (r *Reader) SetOffsetAt(ctx context.Context, i int, t time.Time) error {
 // A typical use of this method is to spawn a goroutine that will periodically
 // call Stats on a kafka reader and report the metrics to a stats collection
 // system.
+//
+// i 超出集群列表的范围时返回零值. 集群被添加或者移除之后索引会改变.
+//
+// Deprecated: 使用 AggregateStats, 它按照名字返回每个集群的统计数据.
 func (r *Reader) Stats(i int) kafka.ReaderStats {
-	if i >= r.n {
+	set := r.current()
+	if i < 0 || i >= len(set.clusters) {
 		return kafka.ReaderStats{}
 	}
 
-	return r.readers[i].Stats()
+	return set.clusters[i].reader.Stats()
+}
+
+func unknownIndex(i int) error {
+	return fmt.Errorf("%w: index %d", ErrUnknownCluster, i)
 }
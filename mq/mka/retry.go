@@ -0,0 +1,104 @@
+package mka
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy 是写入失败时切换集群重试的策略, 零值表示每个集群依次尝试一次, 重试前不等待.
+type RetryPolicy struct {
+	// MaxAttempts 是一次写入最多尝试的次数, 默认为可以使用的集群数.
+	// 超过集群数时会按照顺序再次尝试之前失败的集群.
+	MaxAttempts int
+	// Clusters 限定重试时可以使用的集群, 为空时可以使用所有集群.
+	// 集群的尝试顺序仍然由 RWMode 决定.
+	Clusters []int
+
+	// Backoff 是第一次重试前等待的时间, 之后每次重试等待的时间翻倍. 默认为0, 立即重试.
+	Backoff time.Duration
+	// MaxBackoff 是重试前等待时间的上限, 为0时没有上限.
+	MaxBackoff time.Duration
+	// Jitter 是等待时间上随机增加的比例, 取值范围是[0, 1].
+	Jitter float64
+
+	// AttemptTimeout 是每次尝试的超时时间, 为0时不限制.
+	// 如果调用方的context设置了deadline, 每次尝试的超时时间不会超过剩余时间平均分给剩余尝试次数的时长.
+	AttemptTimeout time.Duration
+}
+
+// backoff 返回第retry次重试前需要等待的时间, retry从1开始.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.Backoff <= 0 || retry <= 0 {
+		return 0
+	}
+
+	d := p.Backoff
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// wait 在第retry次重试前等待, context被取消时返回它的错误.
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	d := p.backoff(retry)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// attemptTimeout 返回剩余remaining次尝试时, 本次尝试的超时时间.
+func (p RetryPolicy) attemptTimeout(ctx context.Context, remaining int) time.Duration {
+	timeout := p.AttemptTimeout
+
+	if deadline, ok := ctx.Deadline(); ok && remaining > 0 {
+		share := time.Until(deadline) / time.Duration(remaining)
+		if timeout <= 0 || share < timeout {
+			timeout = share
+		}
+	}
+
+	return timeout
+}
+
+// filter 返回candidates中策略允许使用的集群, 保持原来的顺序.
+func (p RetryPolicy) filter(candidates []int) []int {
+	if len(p.Clusters) == 0 {
+		return candidates
+	}
+
+	allowed := make(map[int]bool, len(p.Clusters))
+	for _, i := range p.Clusters {
+		allowed[i] = true
+	}
+
+	var filtered []int
+	for _, i := range candidates {
+		if allowed[i] {
+			filtered = append(filtered, i)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,45 @@
+package mka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	assert.Equal(t, time.Duration(0), p.backoff(0))
+	assert.Equal(t, 10*time.Millisecond, p.backoff(1))
+	assert.Equal(t, 20*time.Millisecond, p.backoff(2))
+	assert.Equal(t, 30*time.Millisecond, p.backoff(3))
+	assert.Equal(t, 30*time.Millisecond, p.backoff(10))
+
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := p.backoff(1)
+		assert.GreaterOrEqual(t, d, 10*time.Millisecond)
+		assert.LessOrEqual(t, d, 15*time.Millisecond)
+	}
+}
+
+func TestRetryPolicy_AttemptTimeout(t *testing.T) {
+	p := RetryPolicy{AttemptTimeout: time.Second}
+	assert.Equal(t, time.Second, p.attemptTimeout(context.Background(), 3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	timeout := p.attemptTimeout(ctx, 2)
+	assert.Equal(t, time.Second, timeout)
+
+	timeout = p.attemptTimeout(ctx, 6)
+	assert.LessOrEqual(t, timeout, 500*time.Millisecond)
+	assert.Greater(t, timeout, 400*time.Millisecond)
+}
+
+func TestRetryPolicy_Filter(t *testing.T) {
+	assert.Equal(t, []int{2, 0, 1}, RetryPolicy{}.filter([]int{2, 0, 1}))
+	assert.Equal(t, []int{2, 1}, RetryPolicy{Clusters: []int{1, 2}}.filter([]int{2, 0, 1}))
+}
@@ -0,0 +1,216 @@
+package mka
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReaderClusterState 是 ReadScheduler 安排读取顺序时看到的集群状态.
+type ReaderClusterState struct {
+	// Cluster 是集群当前的索引, Name 是它的名字.
+	Cluster int
+	Name    string
+	// Paused 表示集群被 Reader.Pause 暂停.
+	Paused bool
+	// Failing 表示集群最近一次读取失败.
+	Failing bool
+	// LastMessage 是最近一次从这个集群读取到消息的时间, 还没有读取到消息时为零值.
+	LastMessage time.Time
+}
+
+// ReadScheduler 安排每次读取时各个集群的读取顺序.
+//
+// clusters 是所有集群当前的状态, 按照集群的索引排列. Schedule 返回集群索引的分组:
+// Reader 先从第一组的集群读取, 这组集群在空闲超时之内都没有返回消息, 或者都读取失败时,
+// 再同时读取下一组的集群, 以此类推, 先读取到的消息被返回. 没有出现在分组中的集群不会被读取;
+// 没有返回任何集群时, 同时读取所有集群.
+//
+// 调度只作用于 ReadMessage、ReadClusterMessages 和 FetchMessages; ReadBatch 和流式读取总是同时读取所有集群.
+// ReadScheduler 会被多个goroutine并发调用.
+type ReadScheduler interface {
+	Schedule(clusters []ReaderClusterState) [][]int
+}
+
+// WithReadScheduler 设置安排集群读取顺序的策略, idleTimeout 是一组集群没有返回消息时等待下一组集群的时间, 默认为50ms.
+// 没有设置时每次读取都同时读取所有集群, 第一个尝试的集群轮流改变.
+func WithReadScheduler(scheduler ReadScheduler, idleTimeout time.Duration) ReaderOption {
+	return func(r *Reader) {
+		if idleTimeout <= 0 {
+			idleTimeout = 50 * time.Millisecond
+		}
+		r.scheduler = scheduler
+		r.idleTimeout = idleTimeout
+	}
+}
+
+// schedule 返回这次读取的集群分组, 去掉无效和重复的索引.
+func (r *Reader) schedule(set *readerSet) [][]int {
+	n := len(set.clusters)
+	if r.scheduler != nil {
+		states := make([]ReaderClusterState, n)
+		for i, c := range set.clusters {
+			states[i] = c.state(i)
+		}
+
+		seen := make([]bool, n)
+		var tiers [][]int
+		for _, tier := range r.scheduler.Schedule(states) {
+			var valid []int
+			for _, i := range tier {
+				if i >= 0 && i < n && !seen[i] {
+					seen[i] = true
+					valid = append(valid, i)
+				}
+			}
+			if len(valid) > 0 {
+				tiers = append(tiers, valid)
+			}
+		}
+		if len(tiers) > 0 {
+			return tiers
+		}
+	}
+
+	all := make([]int, n)
+	idx := atomic.AddUint64(&r.idx, 1) % uint64(n)
+	for i := range all {
+		all[i] = int((idx + uint64(i)) % uint64(n))
+	}
+	return [][]int{all}
+}
+
+func (c *readerCluster) state(i int) ReaderClusterState {
+	s := ReaderClusterState{
+		Cluster: i,
+		Name:    c.name,
+		Paused:  c.gate.paused(),
+		Failing: atomic.LoadInt32(&c.failing) != 0,
+	}
+	if last := atomic.LoadInt64(&c.lastMessage); last > 0 {
+		s.LastMessage = time.Unix(0, last)
+	}
+	return s
+}
+
+// PriorityScheduler 按照优先级分组读取集群: 优先读取优先级最高的一组集群, 它们都空闲或者读取失败时才读取下一组.
+// 读取失败或者被暂停的集群排在最后一组. 同一组中第一个尝试的集群轮流改变.
+type PriorityScheduler struct {
+	priorities []int
+	idx        uint64
+}
+
+// NewPriorityScheduler 返回一个 PriorityScheduler, priorities按照集群的索引排列, 数值越小优先级越高.
+// 没有设置priorities时集群的优先级就是它的索引, 也就是优先读取主集群(索引为0), 其次是索引为1的集群, 以此类推.
+// 没有设置优先级的集群排在设置了优先级的集群后面.
+func NewPriorityScheduler(priorities ...int) *PriorityScheduler {
+	return &PriorityScheduler{priorities: priorities}
+}
+
+func (s *PriorityScheduler) priority(i int) int {
+	if len(s.priorities) == 0 {
+		return i
+	}
+	if i < len(s.priorities) {
+		return s.priorities[i]
+	}
+	return math.MaxInt
+}
+
+func (s *PriorityScheduler) Schedule(clusters []ReaderClusterState) [][]int {
+	var healthy, demoted []int
+	for _, c := range clusters {
+		if c.Failing || c.Paused {
+			demoted = append(demoted, c.Cluster)
+		} else {
+			healthy = append(healthy, c.Cluster)
+		}
+	}
+	sort.SliceStable(healthy, func(a, b int) bool { return s.priority(healthy[a]) < s.priority(healthy[b]) })
+
+	idx := atomic.AddUint64(&s.idx, 1)
+	var tiers [][]int
+	for start := 0; start < len(healthy); {
+		end := start + 1
+		for end < len(healthy) && s.priority(healthy[end]) == s.priority(healthy[start]) {
+			end++
+		}
+
+		tier := make([]int, 0, end-start)
+		k := int(idx % uint64(end-start))
+		tier = append(tier, healthy[start+k:end]...)
+		tier = append(tier, healthy[start:start+k]...)
+		tiers = append(tiers, tier)
+		start = end
+	}
+	if len(demoted) > 0 {
+		tiers = append(tiers, demoted)
+	}
+	return tiers
+}
+
+// WeightedScheduler 按照权重选择每次优先读取的集群, 其它集群在它空闲或者读取失败时才读取.
+// 比如权重为 3 和 1 时, 两个集群都有消息的情况下, 75% 的读取返回第一个集群的消息.
+// 和 WeightedSelector 一样使用平滑加权轮询算法, 读取失败或者被暂停的集群不参与选择.
+type WeightedScheduler struct {
+	mu      sync.Mutex
+	weights []int
+	current []int
+}
+
+// NewWeightedScheduler 返回一个按照权重读取集群的 WeightedScheduler, weights按照集群的索引排列.
+// 没有设置权重或者权重小于等于0的集群只在被选择的集群空闲时读取.
+func NewWeightedScheduler(weights ...int) *WeightedScheduler {
+	return &WeightedScheduler{weights: weights}
+}
+
+func (s *WeightedScheduler) weight(c ReaderClusterState) int {
+	if c.Failing || c.Paused || c.Cluster >= len(s.weights) || s.weights[c.Cluster] <= 0 {
+		return 0
+	}
+	return s.weights[c.Cluster]
+}
+
+func (s *WeightedScheduler) Schedule(clusters []ReaderClusterState) [][]int {
+	n := len(clusters)
+
+	s.mu.Lock()
+	if len(s.current) != n {
+		s.current = make([]int, n)
+	}
+	best, total := -1, 0
+	for i, c := range clusters {
+		w := s.weight(c)
+		if w == 0 {
+			continue
+		}
+		total += w
+		s.current[i] += w
+		if best < 0 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		s.current[best] -= total
+	}
+	s.mu.Unlock()
+
+	if best < 0 {
+		return nil
+	}
+
+	rest := make([]int, 0, n-1)
+	for i := range clusters {
+		if i != best {
+			rest = append(rest, i)
+		}
+	}
+	sort.SliceStable(rest, func(a, b int) bool { return s.weight(clusters[rest[a]]) > s.weight(clusters[rest[b]]) })
+
+	if len(rest) == 0 {
+		return [][]int{{best}}
+	}
+	return [][]int{{best}, rest}
+}
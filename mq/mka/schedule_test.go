@@ -0,0 +1,125 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func readerStates(n int) []ReaderClusterState {
+	states := make([]ReaderClusterState, n)
+	for i := range states {
+		states[i].Cluster = i
+	}
+	return states
+}
+
+func TestPriorityScheduler(t *testing.T) {
+	states := readerStates(3)
+	assert.Equal(t, [][]int{{0}, {1}, {2}}, NewPriorityScheduler().Schedule(states))
+
+	// 读取失败和暂停的集群排在最后
+	states[0].Failing = true
+	states[1].Paused = true
+	assert.Equal(t, [][]int{{2}, {0, 1}}, NewPriorityScheduler().Schedule(states))
+
+	// 优先级相同的集群在同一组, 第一个尝试的集群轮流改变
+	s := NewPriorityScheduler(1, 0, 1)
+	states = readerStates(3)
+	first := s.Schedule(states)
+	second := s.Schedule(states)
+	assert.Equal(t, []int{1}, first[0])
+	assert.ElementsMatch(t, []int{0, 2}, first[1])
+	assert.NotEqual(t, first[1][0], second[1][0])
+
+	// 没有设置优先级的集群排在后面
+	assert.Equal(t, [][]int{{1}, {0}, {2}}, NewPriorityScheduler(1, 0).Schedule(readerStates(3)))
+}
+
+func TestWeightedScheduler(t *testing.T) {
+	s := NewWeightedScheduler(3, 1)
+	states := readerStates(2)
+
+	counts := make([]int, 2)
+	for i := 0; i < 8; i++ {
+		tiers := s.Schedule(states)
+		assert.Len(t, tiers, 2)
+		counts[tiers[0][0]]++
+	}
+	assert.Equal(t, []int{6, 2}, counts)
+
+	// 读取失败的集群不参与选择
+	states[0].Failing = true
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, [][]int{{1}, {0}}, s.Schedule(states))
+	}
+
+	states[1].Paused = true
+	assert.Nil(t, s.Schedule(states))
+}
+
+func TestReader_PriorityScheduler(t *testing.T) {
+	fakes := []*fakeReader{
+		{msgs: make([]kafka.Message, 5)},
+		{msgs: make([]kafka.Message, 5)},
+	}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]},
+		WithReaderClusterNames("primary", "backup"), WithReadScheduler(NewPriorityScheduler(), 20*time.Millisecond))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		msgs, err := r.ReadClusterMessages(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 1)
+		assert.Equal(t, "primary", msgs[0].ClusterName)
+	}
+	assert.Equal(t, 5, fakes[1].remaining())
+
+	// 主集群空闲之后读取备集群
+	start := time.Now()
+	msgs, err := r.ReadClusterMessages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "backup", msgs[0].ClusterName)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
+
+func TestReader_PrioritySchedulerFailing(t *testing.T) {
+	readers := []ClusterReader{
+		&failingReader{fakeReader: &fakeReader{}, err: errors.New("connection refused")},
+		&fakeReader{msgs: make([]kafka.Message, 2)},
+	}
+	r, err := NewReaderFromClusters(readers, WithReadScheduler(NewPriorityScheduler(), time.Hour))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// 主集群读取失败时不用等待空闲超时
+	for i := 0; i < 2; i++ {
+		msgs, err := r.ReadClusterMessages(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, msgs[0].Cluster)
+	}
+}
+
+func TestReader_WeightedScheduler(t *testing.T) {
+	fakes := []*fakeReader{
+		{msgs: make([]kafka.Message, 100)},
+		{msgs: make([]kafka.Message, 100)},
+	}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]}, WithReadScheduler(NewWeightedScheduler(3, 1), time.Second))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	counts := make([]int, 2)
+	for i := 0; i < 40; i++ {
+		msgs, err := r.ReadClusterMessages(context.Background())
+		assert.NoError(t, err)
+		counts[msgs[0].Cluster]++
+	}
+	assert.Equal(t, []int{30, 10}, counts)
+}
@@ -0,0 +1,204 @@
+package mka
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ClusterSelector 为每批消息选择依次尝试写入的kafka集群.
+//
+// clusters 是所有集群当前的健康状况, 按照集群的索引排列.
+// Select 返回集群索引的列表, 排在前面的集群优先尝试, 没有出现在列表中的集群不会被尝试.
+// 熔断的集群即使出现在列表中也会被跳过.
+//
+// ClusterSelector 会被多个goroutine并发调用.
+type ClusterSelector interface {
+	Select(msgs []kafka.Message, clusters []ClusterHealth) []int
+}
+
+// ClusterObserver 是一个可选的接口.
+// 如果 ClusterSelector 实现了这个接口, 每次写入某个集群之后都会调用 Observe 通知写入的结果和耗时.
+type ClusterObserver interface {
+	Observe(cluster int, err error, latency time.Duration)
+}
+
+// WithSelector 设置选择集群的策略, 默认根据 RWMode 使用 RoundRobinSelector 或者 BackupSelector.
+// 镜像模式总是写入所有集群, 不使用 ClusterSelector.
+func WithSelector(selector ClusterSelector) WriterOption {
+	return func(w *Writer) {
+		w.selector = selector
+	}
+}
+
+// RoundRobinSelector 轮询选择第一个尝试的集群, 其它集群依次排在后面.
+type RoundRobinSelector struct {
+	idx uint64
+}
+
+// NewRoundRobinSelector 返回一个轮询选择集群的 RoundRobinSelector.
+func NewRoundRobinSelector() *RoundRobinSelector {
+	return &RoundRobinSelector{}
+}
+
+func (s *RoundRobinSelector) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	n := uint64(len(clusters))
+	order := make([]int, 0, n)
+
+	idx := atomic.AddUint64(&s.idx, 1) % n
+	for i := uint64(0); i < n; i++ {
+		order = append(order, int((idx+i)%n))
+	}
+	return order
+}
+
+// BackupSelector 优先选择主集群(索引为0), 从集群按照轮询的顺序排在后面.
+type BackupSelector struct {
+	idx uint64
+}
+
+// NewBackupSelector 返回一个主备模式的 BackupSelector.
+func NewBackupSelector() *BackupSelector {
+	return &BackupSelector{}
+}
+
+func (s *BackupSelector) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	n := uint64(len(clusters))
+	order := make([]int, 0, n)
+
+	order = append(order, 0)
+	if n > 1 {
+		idx := atomic.AddUint64(&s.idx, 1) % (n - 1)
+		for i := uint64(0); i < n-1; i++ {
+			order = append(order, 1+int((idx+i)%(n-1)))
+		}
+	}
+	return order
+}
+
+// WeightedSelector 按照权重选择第一个尝试的集群, 其它集群按照权重从大到小排在后面.
+// 比如权重为 80 和 20 时, 80% 的消息优先写入第一个集群.
+// 使用平滑加权轮询算法, 选择的结果是确定的并且分布均匀.
+type WeightedSelector struct {
+	mu      sync.Mutex
+	weights []int
+	current []int
+}
+
+// NewWeightedSelector 返回一个按照权重选择集群的 WeightedSelector, weights按照集群的索引排列.
+// 没有设置权重或者权重小于等于0的集群只在其它集群失败时尝试.
+func NewWeightedSelector(weights ...int) *WeightedSelector {
+	return &WeightedSelector{weights: weights}
+}
+
+func (s *WeightedSelector) weight(i int) int {
+	if i < len(s.weights) && s.weights[i] > 0 {
+		return s.weights[i]
+	}
+	return 0
+}
+
+func (s *WeightedSelector) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	n := len(clusters)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return s.weight(order[a]) > s.weight(order[b]) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.current) != n {
+		s.current = make([]int, n)
+	}
+
+	best, total := -1, 0
+	for i := 0; i < n; i++ {
+		w := s.weight(i)
+		if w == 0 {
+			continue
+		}
+		total += w
+		s.current[i] += w
+		if best < 0 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return order
+	}
+	s.current[best] -= total
+
+	// 把选中的集群移到第一位
+	for k, i := range order {
+		if i == best {
+			copy(order[1:k+1], order[:k])
+			order[0] = best
+			break
+		}
+	}
+	return order
+}
+
+// StickySelector 一直选择同一个集群, 直到写入这个集群失败, 之后切换到下一个集群并停留在那里.
+type StickySelector struct {
+	mu      sync.Mutex
+	current int
+	n       int
+}
+
+// NewStickySelector 返回一个从第一个集群开始的 StickySelector.
+func NewStickySelector() *StickySelector {
+	return &StickySelector{}
+}
+
+func (s *StickySelector) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	n := len(clusters)
+
+	s.mu.Lock()
+	s.n = n
+	current := s.current % n
+	s.mu.Unlock()
+
+	order := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, (current+i)%n)
+	}
+	return order
+}
+
+// Observe 在当前集群写入失败时切换到下一个集群.
+func (s *StickySelector) Observe(cluster int, err error, latency time.Duration) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.n > 0 && s.current%s.n == cluster {
+		s.current = (cluster + 1) % s.n
+	}
+}
+
+// LatencySelector 按照观测到的写入延迟从小到大排列集群.
+// 还没有延迟数据的集群排在最前面, 以便尽快得到它的延迟.
+type LatencySelector struct{}
+
+// NewLatencySelector 返回一个优先选择延迟最小的集群的 LatencySelector.
+func NewLatencySelector() *LatencySelector {
+	return &LatencySelector{}
+}
+
+func (s *LatencySelector) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	order := make([]int, len(clusters))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return clusters[order[a]].Latency < clusters[order[b]].Latency })
+	return order
+}
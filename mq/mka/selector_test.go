@@ -0,0 +1,92 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := NewRoundRobinSelector()
+	clusters := make([]ClusterHealth, 3)
+
+	assert.Equal(t, []int{1, 2, 0}, s.Select(nil, clusters))
+	assert.Equal(t, []int{2, 0, 1}, s.Select(nil, clusters))
+	assert.Equal(t, []int{0, 1, 2}, s.Select(nil, clusters))
+}
+
+func TestBackupSelector(t *testing.T) {
+	s := NewBackupSelector()
+	clusters := make([]ClusterHealth, 3)
+
+	assert.Equal(t, []int{0, 2, 1}, s.Select(nil, clusters))
+	assert.Equal(t, []int{0, 1, 2}, s.Select(nil, clusters))
+	assert.Equal(t, []int{0}, s.Select(nil, clusters[:1]))
+}
+
+func TestWeightedSelector(t *testing.T) {
+	s := NewWeightedSelector(80, 20, 0)
+	clusters := make([]ClusterHealth, 3)
+
+	counts := make([]int, 3)
+	for i := 0; i < 100; i++ {
+		order := s.Select(nil, clusters)
+		assert.Len(t, order, 3)
+		assert.Equal(t, 2, order[2])
+		counts[order[0]]++
+	}
+	assert.Equal(t, []int{80, 20, 0}, counts)
+}
+
+func TestStickySelector(t *testing.T) {
+	s := NewStickySelector()
+	clusters := make([]ClusterHealth, 2)
+
+	assert.Equal(t, []int{0, 1}, s.Select(nil, clusters))
+	s.Observe(0, nil, time.Millisecond)
+	s.Observe(1, errors.New("write failed"), time.Millisecond)
+	assert.Equal(t, []int{0, 1}, s.Select(nil, clusters))
+
+	s.Observe(0, errors.New("write failed"), time.Millisecond)
+	assert.Equal(t, []int{1, 0}, s.Select(nil, clusters))
+	assert.Equal(t, []int{1, 0}, s.Select(nil, clusters))
+
+	s.Observe(1, errors.New("write failed"), time.Millisecond)
+	assert.Equal(t, []int{0, 1}, s.Select(nil, clusters))
+
+	s.Observe(0, errors.New("write failed"), time.Millisecond)
+	assert.Equal(t, []int{1, 0}, s.Select(nil, clusters))
+}
+
+func TestLatencySelector(t *testing.T) {
+	s := NewLatencySelector()
+	clusters := []ClusterHealth{
+		{Cluster: 0, Latency: 30 * time.Millisecond},
+		{Cluster: 1, Latency: 10 * time.Millisecond},
+		{Cluster: 2},
+	}
+	assert.Equal(t, []int{2, 1, 0}, s.Select(nil, clusters))
+}
+
+type fixedSelector []int
+
+func (s fixedSelector) Select(msgs []kafka.Message, clusters []ClusterHealth) []int {
+	return s
+}
+
+func TestWriter_Selector(t *testing.T) {
+	fakes := newFakeWriters(3)
+	fakes[2].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeMultiRW, fakes, WithSelector(fixedSelector{2, 7, 2, -1, 1}))
+	defer w.Close()
+
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")}))
+	assert.Equal(t, 0, fakes[0].attempts())
+	assert.Equal(t, 1, fakes[1].written())
+	assert.Equal(t, 1, fakes[2].attempts())
+}
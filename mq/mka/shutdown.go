@@ -0,0 +1,206 @@
+package mka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/multierr"
+)
+
+// ShutdownError 表示 Shutdown 的ctx结束时还没有完成的工作, 这些工作会在后台继续完成.
+// 再次调用 Shutdown 或者 Close 会继续等待同一个关闭过程.
+type ShutdownError struct {
+	// Err 是ctx结束的原因.
+	Err error
+	// Inflight 是还没有返回的读写调用数.
+	Inflight int64
+	// Clusters 是还没有关闭完成的集群的名字, 按照名字排序.
+	Clusters []string
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("mka: shutdown incomplete: %v, %d calls in flight, clusters not closed: [%s]",
+		e.Err, e.Inflight, strings.Join(e.Clusters, ", "))
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// shutdown 执行并记录关闭的过程. 关闭过程只在后台执行一次, 每次调用 Shutdown 都等待同一个过程.
+type shutdown struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+
+	mu      sync.Mutex
+	calls   *int64
+	pending map[string]bool
+}
+
+// run 启动关闭过程fn, 然后等待它结束或者ctx结束.
+func (s *shutdown) run(ctx context.Context, fn func() error) error {
+	s.once.Do(func() {
+		s.done = make(chan struct{})
+		go func() {
+			s.err = fn()
+			close(s.done)
+		}()
+	})
+
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+	}
+
+	// 关闭过程可能恰好同时完成
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serr := &ShutdownError{Err: ctx.Err()}
+	if s.calls != nil {
+		serr.Inflight = atomic.LoadInt64(s.calls)
+	}
+	for name := range s.pending {
+		serr.Clusters = append(serr.Clusters, name)
+	}
+	sort.Strings(serr.Clusters)
+	return serr
+}
+
+// track 记录需要等待的读写调用数和需要关闭的集群.
+func (s *shutdown) track(calls *int64, names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = calls
+	s.pending = make(map[string]bool, len(names))
+	for _, name := range names {
+		s.pending[name] = true
+	}
+}
+
+// closeAll 并发地关闭所有集群, 返回关闭失败的集群的错误.
+func (s *shutdown) closeAll(names []string, closers []io.Closer) error {
+	errs := make([]error, len(closers))
+
+	var wg sync.WaitGroup
+	wg.Add(len(closers))
+	for i, c := range closers {
+		i, c := i, c
+		go func() {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				errs[i] = fmt.Errorf("mka: close cluster %s: %w", names[i], err)
+			}
+
+			s.mu.Lock()
+			delete(s.pending, names[i])
+			s.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return multierr.Combine(errs...)
+}
+
+// Shutdown 优雅地关闭 Writer: 立即停止接受新的写入, 之后的写入返回 io.ErrClosedPipe;
+// 等待正在进行的写入和spool重放完成, 然后并发地关闭所有集群, 刷新它们缓冲中还没有发送的消息.
+//
+// ctx结束时关闭还没有完成, Shutdown 返回 *ShutdownError, 记录还没有完成的写入和还没有关闭的集群,
+// 关闭过程会在后台继续.
+func (w *Writer) Shutdown(ctx context.Context) error {
+	return w.shutdown.run(ctx, w.close)
+}
+
+func (w *Writer) close() error {
+	w.mu.Lock()
+	w.closed = true
+	close(w.done)
+	set := w.set
+	w.mu.Unlock()
+	if w.failback != nil {
+		w.failback.stop()
+	}
+
+	names := make([]string, len(set.clusters))
+	closers := make([]io.Closer, len(set.clusters))
+	for i, c := range set.clusters {
+		names[i] = c.name
+		closers[i] = c.writer
+	}
+	w.shutdown.track(&set.calls, names)
+
+	set.inflight.Wait()
+	w.wg.Wait()
+
+	var err error
+	if w.spool != nil {
+		err = w.spool.close()
+	}
+	if w.deadLetter != nil {
+		err = multierr.Append(err, w.deadLetter.Close())
+	}
+
+	err = multierr.Append(err, w.shutdown.closeAll(names, closers))
+	for _, c := range set.clusters {
+		c.admin.closeIdle()
+	}
+	set.wp.Stop()
+	return err
+}
+
+// Shutdown 优雅地关闭 Reader: 立即停止接受新的读取, 之后的读取返回 io.EOF, 正在进行的读取被打断;
+// 然后并发地关闭所有集群. 使用consumer group时, 关闭 *kafka.Reader 会提交还没有提交的offset.
+//
+// ctx结束时关闭还没有完成, Shutdown 返回 *ShutdownError, 记录还没有完成的读取和还没有关闭的集群,
+// 关闭过程会在后台继续.
+func (r *Reader) Shutdown(ctx context.Context) error {
+	return r.shutdown.run(ctx, r.close)
+}
+
+func (r *Reader) close() error {
+	r.mu.Lock()
+	r.closed = true
+	set := r.set
+	r.mu.Unlock()
+
+	names := make([]string, len(set.clusters))
+	closers := make([]io.Closer, len(set.clusters))
+	for i, c := range set.clusters {
+		names[i] = c.name
+		closers[i] = c.reader
+	}
+	r.shutdown.track(&set.calls, names)
+
+	// 先停止流式读取和lag监控, 再关闭集群
+	if r.stream != nil {
+		r.stream.stop()
+	}
+	if r.lagMonitor != nil {
+		r.lagMonitor.stop()
+	}
+
+	// 打断正在进行的读取, 它们重新获取集群列表时返回 io.EOF
+	close(set.retired)
+	set.inflight.Wait()
+
+	err := r.shutdown.closeAll(names, closers)
+	for _, c := range set.clusters {
+		c.admin.closeIdle()
+	}
+	set.wp.Stop()
+	return err
+}
@@ -0,0 +1,128 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingWriter 的 Close 阻塞到release被关闭.
+type hangingWriter struct {
+	*fakeWriter
+	release chan struct{}
+}
+
+func (w *hangingWriter) Close() error {
+	<-w.release
+	return w.fakeWriter.Close()
+}
+
+// blockingWriter 的写入阻塞到release被关闭.
+type blockingWriter struct {
+	*fakeWriter
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	close(w.started)
+	<-w.release
+	return w.fakeWriter.WriteMessages(ctx, msgs...)
+}
+
+// slowReader 的 Close 需要delay才能完成.
+type slowReader struct {
+	*fakeReader
+	delay time.Duration
+}
+
+func (r *slowReader) Close() error {
+	time.Sleep(r.delay)
+	return nil
+}
+
+func TestWriter_ShutdownDeadline(t *testing.T) {
+	hung := &hangingWriter{fakeWriter: &fakeWriter{}, release: make(chan struct{})}
+	ok := &fakeWriter{}
+	w, err := NewWriterFromClusters(RWModeMultiRW, []ClusterWriter{ok, hung}, WithWriterClusterNames("ok", "hung"))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = w.Shutdown(ctx)
+
+	var serr *ShutdownError
+	assert.True(t, errors.As(err, &serr))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, []string{"hung"}, serr.Clusters)
+	assert.Equal(t, int64(0), serr.Inflight)
+	assert.True(t, ok.closed)
+
+	// 不再接受新的写入和集群变更
+	assert.Equal(t, io.ErrClosedPipe, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("0")}))
+	assert.Equal(t, io.ErrClosedPipe, w.AddClusterWriter("c", &fakeWriter{}))
+
+	// 再次调用等待同一个关闭过程
+	close(hung.release)
+	assert.NoError(t, w.Close())
+	assert.True(t, hung.closed)
+}
+
+func TestWriter_ShutdownDrainsWrites(t *testing.T) {
+	bw := &blockingWriter{fakeWriter: &fakeWriter{}, started: make(chan struct{}), release: make(chan struct{})}
+	w, err := NewWriterFromClusters(RWModeMultiRW, []ClusterWriter{bw})
+	assert.NoError(t, err)
+
+	werr := make(chan error, 1)
+	go func() {
+		werr <- w.WriteMessages(context.Background(), kafka.Message{Value: []byte("0")})
+	}()
+	<-bw.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var serr *ShutdownError
+	assert.True(t, errors.As(w.Shutdown(ctx), &serr))
+	assert.Equal(t, int64(1), serr.Inflight)
+	assert.Equal(t, []string{"cluster-0"}, serr.Clusters)
+	assert.False(t, bw.closed)
+
+	// 正在进行的写入完成之后才关闭集群
+	close(bw.release)
+	assert.NoError(t, <-werr)
+	assert.NoError(t, w.Shutdown(context.Background()))
+	assert.Equal(t, 1, bw.written())
+	assert.True(t, bw.closed)
+}
+
+func TestReader_Shutdown(t *testing.T) {
+	readers := []ClusterReader{
+		&slowReader{fakeReader: &fakeReader{}, delay: 100 * time.Millisecond},
+		&slowReader{fakeReader: &fakeReader{}, delay: 100 * time.Millisecond},
+		&slowReader{fakeReader: &fakeReader{}, delay: 100 * time.Millisecond},
+	}
+	r, err := NewReaderFromClusters(readers)
+	assert.NoError(t, err)
+
+	rerr := make(chan error, 1)
+	go func() {
+		_, err := r.ReadMessage(context.Background())
+		rerr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// 并发关闭所有集群, 正在进行的读取被打断
+	start := time.Now()
+	assert.NoError(t, r.Shutdown(context.Background()))
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+	assert.Equal(t, io.EOF, <-rerr)
+
+	_, err = r.ReadMessage(context.Background())
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, io.ErrClosedPipe, r.RemoveCluster("cluster-0"))
+}
@@ -0,0 +1,883 @@
+package mka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	// ErrSpooled 表示所有kafka集群都写入失败, 消息已经写入本地磁盘的spool, 稍后会被重放到kafka.
+	// 调用方可以把它当作写入成功处理.
+	ErrSpooled = errors.New("mka: messages are spooled to local disk")
+	// ErrSpoolFull 表示spool的大小已经达到上限, 消息没有写入spool.
+	ErrSpoolFull = errors.New("mka: spool is full")
+)
+
+// FsyncPolicy 决定消息写入spool之后何时调用fsync.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways 每次写入spool之后都调用fsync.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval 距离上一次fsync超过 SyncInterval 时才调用fsync.
+	FsyncInterval
+	// FsyncNever 从不主动调用fsync, 由操作系统决定何时刷盘.
+	FsyncNever
+)
+
+// SpoolConfig 是本地磁盘spool的配置, 零值字段使用默认值.
+type SpoolConfig struct {
+	// Dir 是spool文件所在的目录, 必须设置.
+	Dir string
+	// SegmentBytes 是单个segment文件的大小, 超过后创建新的segment, 默认为64MB.
+	SegmentBytes int64
+	// MaxBytes 是还没有重放的消息大小之和的上限, 超过后写入返回 ErrSpoolFull. 为0时不限制.
+	MaxBytes int64
+
+	// Fsync 是fsync的策略, 默认为 FsyncAlways.
+	Fsync FsyncPolicy
+	// SyncInterval 是 FsyncInterval 策略下fsync的间隔, 默认为1秒.
+	SyncInterval time.Duration
+
+	// ReplayInterval 是检查spool并重放到kafka的间隔, 默认为1秒.
+	ReplayInterval time.Duration
+	// ReplayBatchSize 是每次重放的最大消息数, 默认为100.
+	ReplayBatchSize int
+}
+
+func (c SpoolConfig) withDefaults() SpoolConfig {
+	if c.SegmentBytes <= 0 {
+		c.SegmentBytes = 64 << 20
+	}
+	if c.SyncInterval <= 0 {
+		c.SyncInterval = time.Second
+	}
+	if c.ReplayInterval <= 0 {
+		c.ReplayInterval = time.Second
+	}
+	if c.ReplayBatchSize <= 0 {
+		c.ReplayBatchSize = 100
+	}
+	return c
+}
+
+// SpoolStats 是spool的统计数据.
+type SpoolStats struct {
+	// Segments 是segment文件的个数.
+	Segments int
+	// Bytes 是segment文件的总大小.
+	Bytes int64
+	// Messages 是spool中还没有重放到kafka的消息数.
+	Messages int64
+
+	// Spooled 是累计写入spool的消息数.
+	Spooled int64
+	// Replayed 是累计重放到kafka的消息数.
+	Replayed int64
+	// Rejected 是因为spool已满而没有写入spool的消息数.
+	Rejected int64
+	// Corrupted 是因为数据损坏而丢弃的segment尾部的字节数.
+	Corrupted int64
+}
+
+const (
+	segmentSuffix  = ".seg"
+	checkpointFile = "checkpoint"
+
+	// recordHeaderSize 是每条记录头部的大小: 4字节的payload长度和4字节的crc32校验和.
+	recordHeaderSize = 8
+)
+
+var errCorruptRecord = errors.New("mka: corrupt spool record")
+
+// spoolPos 是spool中一条记录的位置.
+type spoolPos struct {
+	seq uint64
+	off int64
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// spool 是一个分段的磁盘日志, 按照写入的顺序保存kafka集群都写入失败的消息.
+//
+// 每个segment文件由若干记录组成, 每条记录是4字节的长度、4字节的crc32校验和以及编码后的消息.
+// checkpoint 文件记录了下一条需要重放的记录的位置, 已经重放完的segment会被删除.
+type spool struct {
+	mu     sync.Mutex
+	config SpoolConfig
+
+	segments []segment
+	active   *os.File
+	readPos  spoolPos
+	lastSync time.Time
+	dirty    bool
+
+	depth int64
+	// skipped 表示读取时跳过了损坏的记录, 下次 commit 时需要重新计算depth.
+	skipped   bool
+	spooled   int64
+	replayed  int64
+	rejected  int64
+	corrupted int64
+}
+
+// openSpool 打开config.Dir中的spool, 恢复崩溃时写了一半的记录.
+func openSpool(config SpoolConfig) (*spool, error) {
+	if config.Dir == "" {
+		return nil, errors.New("mka: spool dir must be set")
+	}
+
+	s := &spool{config: config.withDefaults()}
+	if err := os.MkdirAll(s.config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment{seq: seq})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	// 校验每个segment, 截断损坏或者只写了一半的记录
+	for i := range s.segments {
+		size, err := s.recover(s.segments[i].seq)
+		if err != nil {
+			return nil, err
+		}
+		s.segments[i].size = size
+	}
+
+	if err := s.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	if err := s.removeConsumed(); err != nil {
+		return nil, err
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = append(s.segments, segment{seq: s.readPos.seq})
+	}
+	last := s.segments[len(s.segments)-1]
+	s.active, err = os.OpenFile(s.segmentPath(last.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	// 计算还没有重放的消息数
+	if s.depth, err = s.countUnread(); err != nil {
+		s.active.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// recover 扫描segment, 把文件截断到最后一条完整的记录, 返回截断后的大小.
+func (s *spool) recover(seq uint64) (int64, error) {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	r := bufio.NewReader(f)
+	for {
+		_, n, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		size += int64(n)
+	}
+
+	if size < info.Size() {
+		s.corrupted += info.Size() - size
+		if err := f.Truncate(size); err != nil {
+			return 0, err
+		}
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// countUnread 返回checkpoint之后的记录数, 调用时必须持有锁或者还没有开始使用spool.
+func (s *spool) countUnread() (int64, error) {
+	var depth int64
+	for _, seg := range s.segments {
+		if seg.seq < s.readPos.seq {
+			continue
+		}
+		off := int64(0)
+		if seg.seq == s.readPos.seq {
+			off = s.readPos.off
+		}
+		n, err := s.count(seg, off)
+		if err != nil {
+			return 0, err
+		}
+		depth += n
+	}
+	return depth, nil
+}
+
+// count 返回segment中从off开始的记录数.
+func (s *spool) count(seg segment, off int64) (int64, error) {
+	f, err := os.Open(s.segmentPath(seg.seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n int64
+	r := bufio.NewReader(io.NewSectionReader(f, off, seg.size-off))
+	for {
+		if _, _, err := readRecord(r); err != nil {
+			break
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *spool) loadCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, checkpointFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) == 16 {
+		s.readPos.seq = binary.BigEndian.Uint64(data)
+		s.readPos.off = int64(binary.BigEndian.Uint64(data[8:]))
+	}
+
+	// checkpoint 指向的segment已经不存在时, 从第一个segment开始重放
+	for _, seg := range s.segments {
+		if seg.seq == s.readPos.seq {
+			if s.readPos.off > seg.size {
+				s.readPos.off = seg.size
+			}
+			return nil
+		}
+		if seg.seq > s.readPos.seq {
+			s.readPos = spoolPos{seq: seg.seq}
+			return nil
+		}
+	}
+
+	if n := len(s.segments); n > 0 {
+		s.readPos = spoolPos{seq: s.segments[n-1].seq, off: s.segments[n-1].size}
+	}
+	return nil
+}
+
+func (s *spool) saveCheckpoint() error {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:], s.readPos.seq)
+	binary.BigEndian.PutUint64(data[8:], uint64(s.readPos.off))
+
+	tmp := filepath.Join(s.config.Dir, checkpointFile+".tmp")
+	if err := os.WriteFile(tmp, data[:], 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.config.Dir, checkpointFile))
+}
+
+// removeConsumed 删除已经重放完的segment, 正在写入的segment不会被删除.
+func (s *spool) removeConsumed() error {
+	for len(s.segments) > 1 {
+		seg := s.segments[0]
+		if seg.seq > s.readPos.seq || (seg.seq == s.readPos.seq && s.readPos.off < seg.size) {
+			break
+		}
+		if err := os.Remove(s.segmentPath(seg.seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.segments = s.segments[1:]
+		if s.readPos.seq <= seg.seq {
+			s.readPos = spoolPos{seq: s.segments[0].seq}
+		}
+	}
+	return nil
+}
+
+// append 把消息追加到spool中, acked 不为nil时是每条消息已经写入成功的集群, 重放时跳过这些集群.
+func (s *spool) append(msgs []kafka.Message, acked [][]string) error {
+	var buf []byte
+	for j, msg := range msgs {
+		var names []string
+		if acked != nil {
+			names = acked[j]
+		}
+		buf = appendRecord(buf, encodeSpoolRecord(msg, names))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return io.ErrClosedPipe
+	}
+
+	if s.config.MaxBytes > 0 && s.unreadBytes()+int64(len(buf)) > s.config.MaxBytes {
+		s.rejected += int64(len(msgs))
+		return ErrSpoolFull
+	}
+
+	last := &s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+int64(len(buf)) > s.config.SegmentBytes {
+		if err := s.roll(); err != nil {
+			return err
+		}
+		last = &s.segments[len(s.segments)-1]
+	}
+
+	size := last.size
+	_, err := s.active.Write(buf)
+	if err == nil {
+		s.dirty = true
+		switch s.config.Fsync {
+		case FsyncAlways:
+			err = s.sync()
+		case FsyncInterval:
+			if time.Since(s.lastSync) >= s.config.SyncInterval {
+				err = s.sync()
+			}
+		}
+	}
+	if err != nil {
+		// 截断这次写入的记录, 返回错误时消息不在spool中, 不会被重放
+		if terr := s.active.Truncate(size); terr != nil {
+			err = fmt.Errorf("%w; truncate: %v", err, terr)
+		}
+		return err
+	}
+	last.size += int64(len(buf))
+
+	s.depth += int64(len(msgs))
+	s.spooled += int64(len(msgs))
+	return nil
+}
+
+// roll 关闭当前的segment, 创建一个新的segment用于写入.
+func (s *spool) roll() error {
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+
+	seq := s.segments[len(s.segments)-1].seq + 1
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		s.active = nil
+		return err
+	}
+
+	s.active = f
+	s.segments = append(s.segments, segment{seq: seq})
+	s.dirty = false
+	s.lastSync = time.Now()
+	return nil
+}
+
+func (s *spool) sync() error {
+	if s.active == nil || !s.dirty {
+		return nil
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	s.lastSync = time.Now()
+	return nil
+}
+
+func (s *spool) bytes() int64 {
+	var n int64
+	for _, seg := range s.segments {
+		n += seg.size
+	}
+	return n
+}
+
+// unreadBytes 返回checkpoint之后还没有重放的记录的大小.
+func (s *spool) unreadBytes() int64 {
+	var n int64
+	for _, seg := range s.segments {
+		switch {
+		case seg.seq == s.readPos.seq:
+			n += seg.size - s.readPos.off
+		case seg.seq > s.readPos.seq:
+			n += seg.size
+		}
+	}
+	return n
+}
+
+// read 从checkpoint开始按照顺序读取最多max条消息, 返回消息、它们已经写入成功的集群和读取之后的位置.
+// 一次读取的消息已经写入成功的集群都相同, 遇到不同的消息时停止. 只有调用 commit 之后checkpoint才会前进.
+func (s *spool) read(max int) ([]kafka.Message, []string, spoolPos, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pos := s.readPos
+	var msgs []kafka.Message
+	var acked []string
+	stopped := false
+	for _, seg := range s.segments {
+		if len(msgs) >= max || stopped {
+			break
+		}
+		if seg.seq < pos.seq {
+			continue
+		}
+		if seg.seq > pos.seq {
+			pos = spoolPos{seq: seg.seq}
+		}
+		if pos.off >= seg.size {
+			continue
+		}
+
+		f, err := os.Open(s.segmentPath(seg.seq))
+		if err != nil {
+			return msgs, acked, pos, err
+		}
+
+		r := bufio.NewReader(io.NewSectionReader(f, pos.off, seg.size-pos.off))
+		for len(msgs) < max {
+			payload, n, err := readRecord(r)
+			if err == io.EOF {
+				break
+			}
+
+			var msg kafka.Message
+			var names []string
+			if err == nil {
+				msg, names, err = decodeSpoolRecord(payload)
+			}
+			if err != nil {
+				// 打开之后segment又被损坏, 丢弃这个segment剩余的部分
+				s.corrupted += seg.size - pos.off
+				s.skipped = true
+				pos.off = seg.size
+				break
+			}
+
+			if len(msgs) == 0 {
+				acked = names
+			} else if !equalNames(acked, names) {
+				stopped = true
+				break
+			}
+			msgs = append(msgs, msg)
+			pos.off += int64(n)
+		}
+		f.Close()
+	}
+
+	return msgs, acked, pos, nil
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// commit 把checkpoint前进到pos, n是重放成功的消息数.
+// 读取时跳过了损坏的记录时, 跳过的消息数无法确定, 重新计算还没有重放的消息数.
+func (s *spool) commit(pos spoolPos, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readPos = pos
+	s.depth -= int64(n)
+	s.replayed += int64(n)
+	if s.skipped {
+		s.skipped = false
+		if depth, err := s.countUnread(); err == nil {
+			s.depth = depth
+		}
+	}
+
+	if err := s.saveCheckpoint(); err != nil {
+		return err
+	}
+	return s.removeConsumed()
+}
+
+func (s *spool) position() spoolPos {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readPos
+}
+
+func (s *spool) stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SpoolStats{
+		Segments:  len(s.segments),
+		Bytes:     s.bytes(),
+		Messages:  s.depth,
+		Spooled:   s.spooled,
+		Replayed:  s.replayed,
+		Rejected:  s.rejected,
+		Corrupted: s.corrupted,
+	}
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return nil
+	}
+
+	err := s.sync()
+	if e := s.active.Close(); err == nil {
+		err = e
+	}
+	s.active = nil
+	return err
+}
+
+// appendRecord 把payload编码成一条记录追加到buf中.
+func appendRecord(buf []byte, payload []byte) []byte {
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// readRecord 读取一条记录, 返回payload和记录的总长度.
+// 已经读到结尾时返回 io.EOF, 记录不完整或者校验失败时返回 errCorruptRecord.
+func readRecord(r io.Reader) ([]byte, int, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	return payload, recordHeaderSize + len(payload), nil
+}
+
+// encodeSpoolRecord 编码spool中的一条记录: 消息, 以及消息已经写入成功的集群.
+// 没有写入成功的集群时和 encodeMessage 相同.
+func encodeSpoolRecord(msg kafka.Message, acked []string) []byte {
+	buf := encodeMessage(msg)
+	if len(acked) == 0 {
+		return buf
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(acked)))
+	for _, name := range acked {
+		buf = appendBytes(buf, []byte(name))
+	}
+	return buf
+}
+
+func decodeSpoolRecord(data []byte) (kafka.Message, []string, error) {
+	d := decoder{data: data}
+	msg := d.message()
+
+	var acked []string
+	if d.err == nil && len(d.data) > 0 {
+		n := d.uvarint()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			acked = append(acked, string(d.bytes()))
+		}
+	}
+	return msg, acked, d.err
+}
+
+// encodeMessage 把消息的topic、key、value、headers和时间编码成字节.
+func encodeMessage(msg kafka.Message) []byte {
+	buf := appendBytes(nil, []byte(msg.Topic))
+	buf = appendBytes(buf, msg.Key)
+	buf = appendBytes(buf, msg.Value)
+
+	buf = binary.AppendUvarint(buf, uint64(len(msg.Headers)))
+	for _, h := range msg.Headers {
+		buf = appendBytes(buf, []byte(h.Key))
+		buf = appendBytes(buf, h.Value)
+	}
+
+	var ts int64
+	if !msg.Time.IsZero() {
+		ts = msg.Time.UnixNano()
+	}
+	return binary.AppendVarint(buf, ts)
+}
+
+func decodeMessage(data []byte) (kafka.Message, error) {
+	d := decoder{data: data}
+	msg := d.message()
+	return msg, d.err
+}
+
+// message 解码 encodeMessage 编码的消息.
+func (d *decoder) message() kafka.Message {
+	var msg kafka.Message
+	msg.Topic = string(d.bytes())
+	msg.Key = d.bytes()
+	msg.Value = d.bytes()
+
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: string(d.bytes()), Value: d.bytes()})
+	}
+
+	if ts := d.varint(); ts != 0 {
+		msg.Time = time.Unix(0, ts)
+	}
+	return msg
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(buf, -1)
+	}
+	buf = binary.AppendVarint(buf, int64(len(b)))
+	return append(buf, b...)
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.varint()
+	if d.err != nil || n < 0 {
+		return nil
+	}
+	if n > int64(len(d.data)) {
+		d.err = errCorruptRecord
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.data)
+	d.data = d.data[n:]
+	return b
+}
+
+// WithSpool 开启本地磁盘spool.
+// 所有kafka集群都写入失败时, 消息被追加到spool中, WriteMessages 返回 ErrSpooled;
+// 后台会在任意集群恢复之后按照顺序把spool中的消息重放到kafka.
+// 镜像模式下只有写入成功的集群数没有达到 AckPolicy 要求的消息写入spool, 重放时跳过已经写入成功的集群,
+// 一批消息重放失败时, 重试只写入还没有写入成功的集群.
+func WithSpool(config SpoolConfig) WriterOption {
+	return func(w *Writer) {
+		w.spoolConfig = &config
+	}
+}
+
+// SpoolStats 返回spool的统计数据, 没有开启spool时返回零值.
+func (w *Writer) SpoolStats() SpoolStats {
+	if w.spool == nil {
+		return SpoolStats{}
+	}
+	return w.spool.stats()
+}
+
+// spoolMessages 把写入失败的消息追加到spool中, 成功时返回 ErrSpooled.
+// 写入spool也失败时, 返回的error同时包含原来的错误和spool的错误(比如 ErrSpoolFull), 都可以通过 errors.Is 判断.
+// 有消息因为致命的错误写入失败时不使用spool, 因为重放这些消息永远不会成功, 会阻塞spool中后面的消息.
+func (w *Writer) spoolMessages(ctx context.Context, msgs []kafka.Message, err error) error {
+	if w.spool == nil || ctx.Err() != nil || hasFatal(msgs, err) {
+		return err
+	}
+
+	// 镜像模式下记录每条消息已经写入成功的集群, 重放时只写入其它集群
+	var failed []kafka.Message
+	var acked [][]string
+	var merr *MirrorError
+	isMirror := errors.As(err, &merr)
+	for _, j := range failedIndexes(len(msgs), err) {
+		failed = append(failed, msgs[j])
+		if isMirror {
+			acked = append(acked, merr.ackedBy(j))
+		}
+	}
+
+	if serr := w.spool.append(failed, acked); serr != nil {
+		return fmt.Errorf("%w; spool: %w", err, serr)
+	}
+	return ErrSpooled
+}
+
+// replay 周期性地把spool中的消息按照顺序重放到kafka, 直到Writer被关闭.
+func (w *Writer) replay() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.spool.config.ReplayInterval)
+	defer ticker.Stop()
+
+	var batch replayBatch
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		w.spool.mu.Lock()
+		w.spool.sync()
+		w.spool.mu.Unlock()
+
+		w.drainSpool(&batch)
+	}
+}
+
+// replayBatch 是正在重放的一批消息, 重放失败时下次重试同一批消息.
+// 镜像模式下 acked 记录已经写入成功的集群, 包括写入spool之前已经写入成功的集群,
+// 重放和重试时只写入其它集群, 避免写入成功的集群收到重复的消息.
+type replayBatch struct {
+	msgs  []kafka.Message
+	pos   spoolPos
+	acked map[string]bool
+}
+
+// drainSpool 重放spool中所有的消息, 遇到写入失败时停止, 等待下一次重放.
+func (w *Writer) drainSpool(batch *replayBatch) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if batch.msgs == nil {
+			msgs, names, pos, err := w.spool.read(w.spool.config.ReplayBatchSize)
+			if err != nil {
+				return
+			}
+			if len(msgs) == 0 {
+				// 跳过了损坏的记录时也需要前进checkpoint
+				if pos != w.spool.position() {
+					w.spool.commit(pos, 0)
+				}
+				return
+			}
+			acked := make(map[string]bool)
+			for _, name := range names {
+				acked[name] = true
+			}
+			*batch = replayBatch{msgs: msgs, pos: pos, acked: acked}
+		}
+
+		if err := w.replaySend(ctx, batch); err != nil {
+			return
+		}
+		if err := w.spool.commit(batch.pos, len(batch.msgs)); err != nil {
+			return
+		}
+		*batch = replayBatch{}
+	}
+}
+
+// replaySend 写入重放的一批消息, 镜像模式下跳过已经写入成功的集群.
+func (w *Writer) replaySend(ctx context.Context, batch *replayBatch) error {
+	if w.rwmode != RWModeMirror {
+		return w.send(ctx, batch.msgs)
+	}
+
+	s := w.acquire()
+	if s == nil {
+		return io.ErrClosedPipe
+	}
+	defer s.release()
+	return w.mirrorTo(ctx, s, batch.msgs, batch.acked)
+}
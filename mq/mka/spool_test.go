@@ -0,0 +1,315 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spoolTestMessages(n int) []kafka.Message {
+	var msgs []kafka.Message
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, kafka.Message{
+			Topic:   "test",
+			Key:     []byte("Key-" + strconv.Itoa(i)),
+			Value:   []byte("Hello World: " + strconv.Itoa(i)),
+			Headers: []kafka.Header{{Key: "seq", Value: []byte(strconv.Itoa(i))}},
+			Time:    time.Unix(1700000000, int64(i)),
+		})
+	}
+	return msgs
+}
+
+func TestSpool_AppendRead(t *testing.T) {
+	s, err := openSpool(SpoolConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer s.close()
+
+	msgs := spoolTestMessages(3)
+	require.NoError(t, s.append(msgs, nil))
+	assert.Equal(t, int64(3), s.stats().Messages)
+
+	got, _, pos, err := s.read(2)
+	require.NoError(t, err)
+	assert.Equal(t, msgs[:2], got)
+	require.NoError(t, s.commit(pos, len(got)))
+
+	got, _, pos, err = s.read(10)
+	require.NoError(t, err)
+	assert.Equal(t, msgs[2:], got)
+	require.NoError(t, s.commit(pos, len(got)))
+
+	got, _, _, err = s.read(10)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	stats := s.stats()
+	assert.Equal(t, int64(0), stats.Messages)
+	assert.Equal(t, int64(3), stats.Spooled)
+	assert.Equal(t, int64(3), stats.Replayed)
+}
+
+func TestSpool_Recover(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	require.NoError(t, err)
+	msgs := spoolTestMessages(3)
+	require.NoError(t, s.append(msgs, nil))
+
+	got, _, pos, err := s.read(1)
+	require.NoError(t, err)
+	require.NoError(t, s.commit(pos, len(got)))
+	require.NoError(t, s.close())
+
+	// 模拟崩溃时只写了一半的记录
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000000.seg"), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write(appendRecord(nil, encodeMessage(msgs[0]))[:10])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = openSpool(SpoolConfig{Dir: dir})
+	require.NoError(t, err)
+	defer s.close()
+
+	stats := s.stats()
+	assert.Equal(t, int64(2), stats.Messages)
+	assert.Equal(t, int64(10), stats.Corrupted)
+
+	got, _, _, err = s.read(10)
+	require.NoError(t, err)
+	assert.Equal(t, msgs[1:], got)
+
+	// 截断之后可以继续追加
+	require.NoError(t, s.append(msgs[:1], nil))
+	got, _, _, err = s.read(10)
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+}
+
+func TestSpool_Segments(t *testing.T) {
+	msgs := spoolTestMessages(10)
+	recordSize := int64(len(appendRecord(nil, encodeMessage(msgs[0]))))
+
+	s, err := openSpool(SpoolConfig{
+		Dir:          t.TempDir(),
+		SegmentBytes: 3 * recordSize,
+		MaxBytes:     9 * recordSize,
+		Fsync:        FsyncNever,
+	})
+	require.NoError(t, err)
+	defer s.close()
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, s.append(msgs[i:i+1], nil))
+	}
+	assert.Equal(t, 3, s.stats().Segments)
+	assert.ErrorIs(t, s.append(msgs[9:], nil), ErrSpoolFull)
+	assert.Equal(t, int64(1), s.stats().Rejected)
+
+	got, _, pos, err := s.read(7)
+	require.NoError(t, err)
+	assert.Equal(t, msgs[:7], got)
+	require.NoError(t, s.commit(pos, len(got)))
+
+	stats := s.stats()
+	assert.Equal(t, 1, stats.Segments)
+	assert.Equal(t, int64(2), stats.Messages)
+	assert.NoError(t, s.append(msgs[9:], nil))
+}
+
+func TestWriter_Spool(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("cluster is down"))
+	fakes[1].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeBackup, fakes,
+		WithBreaker(BreakerConfig{OpenTimeout: 10 * time.Millisecond}),
+		WithSpool(SpoolConfig{Dir: t.TempDir(), ReplayInterval: 10 * time.Millisecond}))
+	defer w.Close()
+
+	msgs := spoolTestMessages(3)
+	err := w.WriteMessages(context.Background(), msgs...)
+	assert.ErrorIs(t, err, ErrSpooled)
+	assert.Equal(t, int64(3), w.SpoolStats().Spooled)
+
+	fakes[1].setErr(nil)
+	assert.Eventually(t, func() bool {
+		return w.SpoolStats().Messages == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, msgs, fakes[1].msgs)
+	assert.Equal(t, int64(3), w.SpoolStats().Replayed)
+}
+
+func TestSpool_SkipCorruptedDepth(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	require.NoError(t, err)
+	defer s.close()
+
+	msgs := spoolTestMessages(3)
+	require.NoError(t, s.append(msgs, nil))
+	require.NoError(t, s.sync())
+
+	// 打开之后第二条记录被损坏, 读取时跳过segment剩余的部分
+	recordSize := int64(len(appendRecord(nil, encodeMessage(msgs[0]))))
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000000.seg"), os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("xx"), recordSize+recordHeaderSize+1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	got, _, pos, err := s.read(10)
+	require.NoError(t, err)
+	assert.Equal(t, msgs[:1], got)
+	require.NoError(t, s.commit(pos, len(got)))
+	assert.Equal(t, int64(0), s.stats().Messages)
+
+	require.NoError(t, s.append(msgs[:1], nil))
+	assert.Equal(t, int64(1), s.stats().Messages)
+}
+
+func TestWriter_SpoolFull(t *testing.T) {
+	errDown := errors.New("cluster is down")
+	fakes := newFakeWriters(1)
+	fakes[0].setErr(errDown)
+
+	w := newTestWriter(RWModeBackup, fakes, WithSpool(SpoolConfig{Dir: t.TempDir(), MaxBytes: 1}))
+	defer w.Close()
+
+	// 写入spool失败时, 原来的错误和spool的错误都可以判断
+	err := w.WriteMessages(context.Background(), spoolTestMessages(1)...)
+	assert.ErrorIs(t, err, ErrSpoolFull)
+	assert.ErrorIs(t, err, errDown)
+	assert.NotErrorIs(t, err, ErrSpooled)
+	assert.Equal(t, int64(1), w.SpoolStats().Rejected)
+}
+
+func TestWriter_SpoolMirrorReplay(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("cluster is down"))
+	fakes[1].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeMirror, fakes,
+		WithBreaker(BreakerConfig{OpenTimeout: 5 * time.Millisecond}),
+		WithSpool(SpoolConfig{Dir: t.TempDir(), ReplayInterval: 5 * time.Millisecond}))
+	defer w.Close()
+
+	msgs := spoolTestMessages(3)
+	assert.ErrorIs(t, w.WriteMessages(context.Background(), msgs...), ErrSpooled)
+
+	// 只有一个集群恢复时重放失败, 但是这个集群已经写入成功, 之后不再重复写入
+	fakes[0].setErr(nil)
+	assert.Eventually(t, func() bool { return fakes[0].written() == 3 }, time.Second, 5*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, int64(3), w.SpoolStats().Messages)
+
+	fakes[1].setErr(nil)
+	assert.Eventually(t, func() bool { return w.SpoolStats().Messages == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, msgs, fakes[0].msgs)
+	assert.Equal(t, msgs, fakes[1].msgs)
+}
+
+func TestSpool_MaxBytesUnread(t *testing.T) {
+	msgs := spoolTestMessages(5)
+	recordSize := int64(len(appendRecord(nil, encodeMessage(msgs[0]))))
+
+	s, err := openSpool(SpoolConfig{Dir: t.TempDir(), MaxBytes: 3 * recordSize, Fsync: FsyncNever})
+	require.NoError(t, err)
+	defer s.close()
+
+	require.NoError(t, s.append(msgs[:3], nil))
+	assert.ErrorIs(t, s.append(msgs[3:4], nil), ErrSpoolFull)
+
+	// 已经重放的记录虽然还在segment中, 但是不计入上限
+	got, _, pos, err := s.read(2)
+	require.NoError(t, err)
+	require.NoError(t, s.commit(pos, len(got)))
+	assert.NoError(t, s.append(msgs[3:5], nil))
+	assert.Equal(t, int64(3), s.stats().Messages)
+}
+
+func TestSpool_ReadAcked(t *testing.T) {
+	s, err := openSpool(SpoolConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer s.close()
+
+	msgs := spoolTestMessages(4)
+	require.NoError(t, s.append(msgs, [][]string{{"a"}, {"a"}, {"a", "b"}, nil}))
+
+	// 一次读取的消息已经写入成功的集群都相同
+	for _, want := range []struct {
+		msgs  []kafka.Message
+		acked []string
+	}{
+		{msgs[:2], []string{"a"}},
+		{msgs[2:3], []string{"a", "b"}},
+		{msgs[3:], nil},
+	} {
+		got, acked, pos, err := s.read(10)
+		require.NoError(t, err)
+		assert.Equal(t, want.msgs, got)
+		assert.Equal(t, want.acked, acked)
+		require.NoError(t, s.commit(pos, len(got)))
+	}
+}
+
+func TestWriter_SpoolOnlyFailed(t *testing.T) {
+	fakes := newFakeWriters(1)
+	fakes[0].fail = func(msg kafka.Message) error {
+		if string(msg.Key) == "Key-1" {
+			return kafka.LeaderNotAvailable
+		}
+		return nil
+	}
+
+	w := newTestWriter(RWModeBackup, fakes, WithSpool(SpoolConfig{Dir: t.TempDir()}))
+	defer w.Close()
+
+	// 只尝试一次时错误是 WriteErrors, 只有写入失败的消息写入spool
+	msgs := spoolTestMessages(3)
+	assert.ErrorIs(t, w.WriteMessages(context.Background(), msgs...), ErrSpooled)
+	assert.Equal(t, int64(1), w.SpoolStats().Spooled)
+}
+
+func TestWriter_SpoolMirrorPartialAck(t *testing.T) {
+	fakes := newFakeWriters(3)
+	fakes[1].fail = func(msg kafka.Message) error {
+		if string(msg.Key) == "Key-1" {
+			return kafka.LeaderNotAvailable
+		}
+		return nil
+	}
+	fakes[2].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeMirror, fakes, WithAckPolicy(AckMajority),
+		WithBreaker(BreakerConfig{OpenTimeout: 5 * time.Millisecond}),
+		WithSpool(SpoolConfig{Dir: t.TempDir(), ReplayInterval: 5 * time.Millisecond}))
+	defer w.Close()
+
+	// 第一条消息已经写入两个集群, 只有第二条消息写入spool, 并记录它已经写入了cluster-0
+	msgs := spoolTestMessages(2)
+	assert.ErrorIs(t, w.WriteMessages(context.Background(), msgs...), ErrSpooled)
+	assert.Equal(t, int64(1), w.SpoolStats().Spooled)
+
+	fakes[1].mu.Lock()
+	fakes[1].fail = nil
+	fakes[1].mu.Unlock()
+	fakes[2].setErr(nil)
+	assert.Eventually(t, func() bool { return w.SpoolStats().Messages == 0 }, time.Second, 5*time.Millisecond)
+
+	// 重放时跳过已经写入成功的cluster-0
+	require.NoError(t, w.Close())
+	assert.Equal(t, msgs, fakes[0].msgs)
+	assert.Equal(t, msgs, fakes[1].msgs)
+	assert.Equal(t, msgs[1:], fakes[2].msgs)
+}
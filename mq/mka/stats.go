@@ -0,0 +1,210 @@
+package mka
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func defaultClusterNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = "cluster-" + strconv.Itoa(i)
+	}
+	return names
+}
+
+// ClusterWriterStats 是 Writer 中单个kafka集群的统计数据.
+type ClusterWriterStats struct {
+	Index int
+	Name  string
+
+	// Kafka 是kafka-go writer自上次获取以来的统计数据.
+	Kafka kafka.WriterStats
+	// Health 是集群的健康状况, 其中的 Successes 和 Failures 是累计的写入成功和失败次数.
+	Health ClusterHealth
+	// FallbackWrites 是累计作为备选集群被写入的次数.
+	FallbackWrites int64
+}
+
+// WriterStats 是 Writer 所有kafka集群的聚合统计数据.
+type WriterStats struct {
+	// Kafka 是所有集群的kafka-go统计数据之和.
+	Kafka kafka.WriterStats
+	// Clusters 是每个集群的统计数据, 按照集群的索引排列.
+	Clusters []ClusterWriterStats
+
+	// Failovers 是累计需要切换集群的写入次数.
+	Failovers int64
+	// FallbackWrites 是累计写入备选集群的次数.
+	FallbackWrites int64
+	// Errors 是累计写入集群失败的次数.
+	Errors int64
+	// Spool 是spool的统计数据, 没有开启spool时为零值.
+	Spool SpoolStats
+
+	// Hedges 是累计触发对冲的写入尝试次数, HedgeRate 是它占可以对冲的尝试次数的比例.
+	Hedges    int64
+	HedgeRate float64
+	// HedgeWins 是对冲的集群先写入成功的次数.
+	HedgeWins int64
+	// HedgeDuplicates 是因为对冲被多个集群写入成功的消息数.
+	HedgeDuplicates int64
+}
+
+// AggregateStats 返回所有kafka集群的聚合统计数据和每个集群的统计数据.
+//
+// 和 Stats 一样, 其中kafka-go的统计数据是自上次调用 Stats 或者 AggregateStats 以来的数据;
+// mka 自身的计数器(Failovers、FallbackWrites、Errors等)是累计值.
+func (w *Writer) AggregateStats() WriterStats {
+	stats := WriterStats{
+		Failovers:       atomic.LoadInt64(&w.failovers),
+		Spool:           w.SpoolStats(),
+		Hedges:          atomic.LoadInt64(&w.hedgeStats.hedges),
+		HedgeWins:       atomic.LoadInt64(&w.hedgeStats.wins),
+		HedgeDuplicates: atomic.LoadInt64(&w.hedgeStats.duplicates),
+	}
+	if eligible := atomic.LoadInt64(&w.hedgeStats.eligible); eligible > 0 {
+		stats.HedgeRate = float64(stats.Hedges) / float64(eligible)
+	}
+
+	s := w.current()
+	for i, c := range s.clusters {
+		cs := ClusterWriterStats{
+			Index:          i,
+			Name:           c.name,
+			Kafka:          c.writer.Stats(),
+			Health:         s.health(i),
+			FallbackWrites: atomic.LoadInt64(&c.fallbacks),
+		}
+		stats.Clusters = append(stats.Clusters, cs)
+
+		stats.FallbackWrites += cs.FallbackWrites
+		stats.Errors += cs.Health.Failures
+		mergeWriterStats(&stats.Kafka, cs.Kafka)
+	}
+
+	return stats
+}
+
+// ClusterReaderStats 是 Reader 中单个kafka集群的统计数据.
+type ClusterReaderStats struct {
+	Index int
+	Name  string
+
+	// Kafka 是kafka-go reader自上次获取以来的统计数据.
+	Kafka kafka.ReaderStats
+	// Messages 和 Errors 是累计从这个集群读取到的消息数和错误数.
+	Messages int64
+	Errors   int64
+	// Paused 表示这个集群被 Reader.Pause 暂停.
+	Paused bool
+}
+
+// ReaderStats 是 Reader 所有kafka集群的聚合统计数据.
+type ReaderStats struct {
+	// Kafka 是所有集群的kafka-go统计数据之和.
+	Kafka kafka.ReaderStats
+	// Clusters 是每个集群的统计数据, 按照集群的索引排列.
+	Clusters []ClusterReaderStats
+
+	// Messages 和 Errors 是累计读取到的消息数和错误数.
+	Messages int64
+	Errors   int64
+	// DedupHits 是累计去掉的重复消息数.
+	DedupHits int64
+}
+
+// AggregateStats 返回所有kafka集群的聚合统计数据和每个集群的统计数据.
+//
+// 和 Stats 一样, 其中kafka-go的统计数据是自上次调用 Stats 或者 AggregateStats 以来的数据;
+// mka 自身的计数器是累计值.
+func (r *Reader) AggregateStats() ReaderStats {
+	stats := ReaderStats{DedupHits: r.DedupStats().Hits}
+
+	for i, c := range r.current().clusters {
+		cs := ClusterReaderStats{
+			Index:    i,
+			Name:     c.name,
+			Kafka:    c.reader.Stats(),
+			Messages: atomic.LoadInt64(&c.messages),
+			Errors:   atomic.LoadInt64(&c.errors),
+			Paused:   c.gate.paused(),
+		}
+		stats.Clusters = append(stats.Clusters, cs)
+
+		stats.Messages += cs.Messages
+		stats.Errors += cs.Errors
+		mergeReaderStats(&stats.Kafka, cs.Kafka)
+	}
+
+	return stats
+}
+
+func mergeWriterStats(dst *kafka.WriterStats, src kafka.WriterStats) {
+	dst.Writes += src.Writes
+	dst.Messages += src.Messages
+	dst.Bytes += src.Bytes
+	dst.Errors += src.Errors
+	dst.Retries += src.Retries
+	dst.Dials += src.Dials
+
+	mergeDuration(&dst.BatchTime, src.BatchTime)
+	mergeDuration(&dst.BatchQueueTime, src.BatchQueueTime)
+	mergeDuration(&dst.WriteTime, src.WriteTime)
+	mergeDuration(&dst.WaitTime, src.WaitTime)
+	mergeDuration(&dst.DialTime, src.DialTime)
+	mergeSummary(&dst.BatchSize, src.BatchSize)
+	mergeSummary(&dst.BatchBytes, src.BatchBytes)
+}
+
+func mergeReaderStats(dst *kafka.ReaderStats, src kafka.ReaderStats) {
+	dst.Dials += src.Dials
+	dst.Fetches += src.Fetches
+	dst.Messages += src.Messages
+	dst.Bytes += src.Bytes
+	dst.Rebalances += src.Rebalances
+	dst.Timeouts += src.Timeouts
+	dst.Errors += src.Errors
+	dst.Lag += src.Lag
+	dst.QueueLength += src.QueueLength
+	dst.QueueCapacity += src.QueueCapacity
+
+	mergeDuration(&dst.DialTime, src.DialTime)
+	mergeDuration(&dst.ReadTime, src.ReadTime)
+	mergeDuration(&dst.WaitTime, src.WaitTime)
+	mergeSummary(&dst.FetchSize, src.FetchSize)
+	mergeSummary(&dst.FetchBytes, src.FetchBytes)
+}
+
+func mergeDuration(dst *kafka.DurationStats, src kafka.DurationStats) {
+	if src.Count == 0 {
+		return
+	}
+	if dst.Count == 0 || src.Min < dst.Min {
+		dst.Min = src.Min
+	}
+	if src.Max > dst.Max {
+		dst.Max = src.Max
+	}
+	dst.Count += src.Count
+	dst.Sum += src.Sum
+	dst.Avg = dst.Sum / time.Duration(dst.Count)
+}
+
+func mergeSummary(dst *kafka.SummaryStats, src kafka.SummaryStats) {
+	if src.Count == 0 {
+		return
+	}
+	if dst.Count == 0 || src.Min < dst.Min {
+		dst.Min = src.Min
+	}
+	if src.Max > dst.Max {
+		dst.Max = src.Max
+	}
+	dst.Count += src.Count
+	dst.Sum += src.Sum
+	dst.Avg = dst.Sum / dst.Count
+}
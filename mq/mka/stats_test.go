@@ -0,0 +1,54 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter_AggregateStats(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("primary is down"))
+
+	w := newTestWriter(RWModeBackup, fakes, WithWriterClusterNames("local", "remote"))
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("v")}))
+	}
+
+	stats := w.AggregateStats()
+	assert.Len(t, stats.Clusters, 2)
+	assert.Equal(t, "local", stats.Clusters[0].Name)
+	assert.Equal(t, "remote", stats.Clusters[1].Name)
+	assert.Equal(t, int64(3), stats.Failovers)
+	assert.Equal(t, int64(3), stats.FallbackWrites)
+	assert.Equal(t, int64(3), stats.Clusters[1].FallbackWrites)
+	assert.Equal(t, int64(3), stats.Errors)
+	assert.Equal(t, int64(3), stats.Clusters[0].Health.Failures)
+	assert.Equal(t, int64(3), stats.Clusters[1].Health.Successes)
+}
+
+func TestWriter_DefaultClusterNames(t *testing.T) {
+	w := newTestWriter(RWModeMultiRW, newFakeWriters(2))
+	defer w.Close()
+
+	assert.Equal(t, "cluster-1", w.Health(1).Name)
+}
+
+func TestMergeDuration(t *testing.T) {
+	var dst kafka.DurationStats
+	mergeDuration(&dst, kafka.DurationStats{Min: 2 * time.Millisecond, Max: 4 * time.Millisecond, Count: 2, Sum: 6 * time.Millisecond})
+	mergeDuration(&dst, kafka.DurationStats{})
+	mergeDuration(&dst, kafka.DurationStats{Min: time.Millisecond, Max: 3 * time.Millisecond, Count: 1, Sum: 3 * time.Millisecond})
+
+	assert.Equal(t, time.Millisecond, dst.Min)
+	assert.Equal(t, 4*time.Millisecond, dst.Max)
+	assert.Equal(t, int64(3), dst.Count)
+	assert.Equal(t, 9*time.Millisecond, dst.Sum)
+	assert.Equal(t, 3*time.Millisecond, dst.Avg)
+}
@@ -0,0 +1,477 @@
+package mka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/multierr"
+)
+
+// StreamConfig 是流式读取的配置, 零值字段使用默认值.
+type StreamConfig struct {
+	// Buffer 是 Messages 返回的channel的容量, 默认为256.
+	// channel满了之后每个集群的读取都会暂停, 直到消息被取走.
+	Buffer int
+	// Backoff 是集群读取失败之后重试前等待的时间, 之后每次失败等待的时间翻倍, 默认为100ms.
+	Backoff time.Duration
+	// MaxBackoff 是重试前等待时间的上限, 默认为5s.
+	MaxBackoff time.Duration
+}
+
+func (c StreamConfig) withDefaults() StreamConfig {
+	if c.Buffer <= 0 {
+		c.Buffer = 256
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 5 * time.Second
+	}
+	return c
+}
+
+// WithStreaming 开启流式读取: 每个集群有一个常驻的goroutine通过 FetchMessage 持续读取消息, 放入一个有界的channel.
+// channel中的消息都没有提交offset, 进程退出时还没有处理的消息不会丢失.
+//
+// 开启之后 ReadMessage、ReadClusterMessages、FetchMessages 和 ReadBatch 都从这个channel中获取消息,
+// 提交offset的方式和没有开启时相同: ReadMessage 和 ReadClusterMessages 在返回消息之前提交,
+// FetchMessages 和 ReadBatch 需要调用方提交. 也可以直接使用 Messages 返回的channel.
+// 增删集群时只会启动或者停止对应集群的读取, 不会打断其它集群正在进行的读取.
+func WithStreaming(config StreamConfig) ReaderOption {
+	return func(r *Reader) {
+		config = config.withDefaults()
+		r.streamConfig = &config
+	}
+}
+
+// stream 是 Reader 的流式读取, 每个集群的 pump 把读取到的消息放入msgs.
+type stream struct {
+	r      *Reader
+	config StreamConfig
+	policy RetryPolicy
+
+	msgs chan Message
+	errs chan error
+	// done 在 Reader 关闭时关闭.
+	done chan struct{}
+
+	// mu 保护pumps的启动和停止, stopped 之后不再启动新的pump.
+	mu      sync.Mutex
+	stopped bool
+	pumps   map[*readerCluster]*pump
+	wg      sync.WaitGroup
+}
+
+// pump 是读取单个集群的goroutine.
+type pump struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newStream(r *Reader, config StreamConfig) *stream {
+	return &stream{
+		r:      r,
+		config: config,
+		policy: RetryPolicy{Backoff: config.Backoff, MaxBackoff: config.MaxBackoff, Jitter: 0.2},
+		msgs:   make(chan Message, config.Buffer),
+		errs:   make(chan error, config.Buffer),
+		done:   make(chan struct{}),
+		pumps:  make(map[*readerCluster]*pump),
+	}
+}
+
+// Messages 返回流式读取的channel, 消息都标记了它来自哪个集群. Reader 关闭之后channel被关闭.
+// 消息没有提交offset, 处理完之后需要调用 CommitMessages 提交. 没有开启 WithStreaming 时返回nil.
+//
+// 不要同时使用 Messages 和 ReadMessage 等方法, 否则消息会被它们分别取走.
+func (r *Reader) Messages() <-chan Message {
+	if r.stream == nil {
+		return nil
+	}
+	return r.stream.msgs
+}
+
+// Errors 返回流式读取中集群读取失败的 ClusterError. 没有开启 WithStreaming 时返回nil.
+//
+// channel满了之后新的错误会被丢弃, 错误数仍然计入统计数据.
+// 使用 ReadMessage 等方法时不要读取这个channel, 它们使用其中的错误判断是否所有集群都读取失败.
+func (r *Reader) Errors() <-chan error {
+	if r.stream == nil {
+		return nil
+	}
+	return r.stream.errs
+}
+
+// sync 让pumps和当前的集群列表保持一致: 为新的集群启动pump, 停止被移除集群的pump并等待它退出.
+func (s *stream) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+
+	current := make(map[*readerCluster]bool)
+	for _, c := range s.r.current().clusters {
+		current[c] = true
+		if s.pumps[c] == nil {
+			s.start(c)
+		}
+	}
+
+	for c, p := range s.pumps {
+		if !current[c] {
+			p.cancel()
+			<-p.done
+			delete(s.pumps, c)
+		}
+	}
+}
+
+func (s *stream) start(c *readerCluster) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pump{cancel: cancel, done: make(chan struct{})}
+	s.pumps[c] = p
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(p.done)
+		s.run(ctx, c)
+	}()
+}
+
+// stop 停止所有的pump, 等待它们退出之后关闭msgs.
+func (s *stream) stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.done)
+	for _, p := range s.pumps {
+		p.cancel()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	close(s.msgs)
+}
+
+// run 持续读取集群c的消息, 直到ctx结束. 读取失败时按照 StreamConfig.Backoff 等待之后重试.
+func (s *stream) run(ctx context.Context, c *readerCluster) {
+	failures := 0
+	// dropped 是去重去掉的重复消息, 附在这个集群之后的第一条消息上一起提交
+	var dropped []kafka.Message
+	for {
+		msg, deduped, err := c.fetch(ctx, false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.record(err)
+		if err != nil {
+			s.sendErr(ClusterError{Cluster: s.r.current().index(c.name), Name: c.name, Err: err})
+
+			failures++
+			if s.policy.wait(ctx, failures) != nil {
+				return
+			}
+			continue
+		}
+
+		failures = 0
+
+		i := s.r.current().index(c.name)
+		if s.r.tracing != nil {
+			s.r.traceReceive(ctx, i, c.name, msg)
+		}
+		m := Message{Message: msg, Cluster: i, ClusterName: c.name}
+		// 提交失败放回的消息已经通过了去重, 它的key已经记录过, 不能再去重
+		if s.r.dedup != nil && !deduped && len(s.r.dedup.filter([]Message{m})) == 0 {
+			dropped = append(dropped, msg)
+			continue
+		}
+
+		m.dropped, dropped = dropped, nil
+		select {
+		case s.msgs <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *stream) sendErr(err error) {
+	select {
+	case s.errs <- err:
+	default:
+	}
+}
+
+// next 返回channel中的下一条消息. 只有所有集群最近一次读取都失败时才返回错误,
+// 错误包含channel中所有集群的 ClusterError. Reader 关闭之后返回 io.EOF.
+func (s *stream) next(ctx context.Context) ([]Message, error) {
+	select {
+	case <-s.done:
+		return nil, io.EOF
+	default:
+	}
+
+	for {
+		select {
+		case msg, ok := <-s.msgs:
+			if !ok {
+				return nil, io.EOF
+			}
+			return []Message{msg}, nil
+		case err := <-s.errs:
+			if s.allFailing() {
+				return nil, multierr.Append(err, s.drainErrs())
+			}
+		case <-s.done:
+			return nil, io.EOF
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// commit 提交 ReadMessage 从channel中取出的消息, 以及它们之前被去重去掉的消息.
+// 提交失败的消息被放回它的集群, 之后重新读取时不再去重.
+func (s *stream) commit(ctx context.Context, msgs []Message) error {
+	var err error
+	for _, msg := range msgs {
+		c, e := s.r.cluster(msg.ClusterName)
+		if e == nil {
+			if e = c.commit(ctx, append(msg.dropped, msg.Message)...); e != nil {
+				c.redeliver(msg.Message)
+			}
+		}
+		if e != nil {
+			err = multierr.Append(err, ClusterError{Cluster: msg.Cluster, Name: msg.ClusterName, Err: e})
+		}
+	}
+	return err
+}
+
+func (s *stream) allFailing() bool {
+	for _, c := range s.r.current().clusters {
+		if atomic.LoadInt32(&c.failing) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *stream) drainErrs() error {
+	var err error
+	for {
+		select {
+		case e := <-s.errs:
+			err = multierr.Append(err, e)
+		default:
+			return err
+		}
+	}
+}
+
+// pauseGate 控制集群的暂停和恢复.
+type pauseGate struct {
+	mu sync.Mutex
+	// resumed 在集群暂停时不为nil, 恢复时关闭.
+	resumed chan struct{}
+	// fetches 是正在进行的读取, 暂停时取消它们.
+	fetches map[uint64]context.CancelFunc
+	next    uint64
+}
+
+// enter 等待集群恢复之后开始一次读取, 返回读取使用的ctx和读取结束时调用的函数. ctx结束时返回它的错误.
+func (g *pauseGate) enter(ctx context.Context) (context.Context, func(), error) {
+	for {
+		g.mu.Lock()
+		resumed := g.resumed
+		if resumed == nil {
+			fctx, cancel := context.WithCancel(ctx)
+			id := g.next
+			g.next++
+			if g.fetches == nil {
+				g.fetches = make(map[uint64]context.CancelFunc)
+			}
+			g.fetches[id] = cancel
+			g.mu.Unlock()
+
+			return fctx, func() {
+				g.mu.Lock()
+				delete(g.fetches, id)
+				g.mu.Unlock()
+				cancel()
+			}, nil
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return
+	}
+
+	g.resumed = make(chan struct{})
+	for _, cancel := range g.fetches {
+		cancel()
+	}
+}
+
+// interrupt 打断正在进行的读取但是不暂停集群, 被打断的读取重新进行.
+func (g *pauseGate) interrupt() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, cancel := range g.fetches {
+		cancel()
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// fetch 通过 FetchMessage 读取集群的一条消息, commit 为true时在读取之后提交offset.
+// 集群暂停时等待它恢复, 被暂停打断的读取在恢复之后重新进行. 之前放回的消息首先返回.
+//
+// 暂停只会打断 FetchMessage, 不会打断提交, 所以不会出现消息已经提交却没有返回的情况.
+// 提交失败时消息被放回, 下次读取时重新返回. deduped 表示消息是通过 redeliver 放回的, 已经通过了去重.
+func (c *readerCluster) fetch(ctx context.Context, commit bool) (msg kafka.Message, deduped bool, err error) {
+	msg, deduped, err = c.fetchMessage(ctx)
+	if err != nil || !commit {
+		return msg, deduped, err
+	}
+
+	if err := c.commit(ctx, msg); err != nil {
+		c.put(pendingMessage{msg: msg, deduped: deduped})
+		return kafka.Message{}, false, err
+	}
+	return msg, deduped, nil
+}
+
+func (c *readerCluster) fetchMessage(ctx context.Context) (kafka.Message, bool, error) {
+	for {
+		fctx, done, err := c.gate.enter(ctx)
+		if err != nil {
+			return kafka.Message{}, false, err
+		}
+
+		if p, ok := c.popPending(); ok {
+			done()
+			return p.msg, p.deduped, nil
+		}
+
+		msg, err := c.reader.FetchMessage(fctx)
+		interrupted := err != nil && ctx.Err() == nil && fctx.Err() != nil
+		done()
+		if interrupted {
+			continue
+		}
+		return msg, false, err
+	}
+}
+
+// pendingMessage 是放回集群的消息, deduped 表示它已经通过了去重.
+type pendingMessage struct {
+	msg     kafka.Message
+	deduped bool
+}
+
+// unread 把通过 FetchMessage 读取但是没有使用的消息放回去, 下次读取这个集群时首先返回.
+func (c *readerCluster) unread(msg kafka.Message) {
+	c.put(pendingMessage{msg: msg})
+}
+
+// redeliver 和 unread 一样放回消息, 用于已经通过去重的消息, 重新读取时不会被当作重复消息去掉.
+func (c *readerCluster) redeliver(msg kafka.Message) {
+	c.put(pendingMessage{msg: msg, deduped: true})
+}
+
+// put 放回消息并打断这个集群正在进行的 FetchMessage, 让等待新消息的读取 (例如流式读取的pump) 立即返回放回的消息.
+func (c *readerCluster) put(p pendingMessage) {
+	c.pendingMu.Lock()
+	c.pending = append(c.pending, p)
+	c.pendingMu.Unlock()
+	c.gate.interrupt()
+}
+
+func (c *readerCluster) popPending() (pendingMessage, bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if len(c.pending) == 0 {
+		return pendingMessage{}, false
+	}
+
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+	return p, true
+}
+
+// commit 提交通过 FetchMessage 读取的消息, 不使用consumer group的 kafka.Reader 没有需要提交的offset.
+func (c *readerCluster) commit(ctx context.Context, msgs ...kafka.Message) error {
+	if kr, ok := c.reader.(*kafka.Reader); ok && kr.Config().GroupID == "" {
+		return nil
+	}
+	return c.reader.CommitMessages(ctx, msgs...)
+}
+
+// Pause 暂停读取名字为name的集群, 正在进行的 FetchMessage 被打断, 之后的读取等待它恢复.
+// 暂停不会打断提交, 所以打断的读取没有返回的消息既不会丢失也不会被提交, 集群恢复之后会重新读取到.
+// 暂停的集群仍然可以提交offset.
+func (r *Reader) Pause(name string) error {
+	c, err := r.cluster(name)
+	if err != nil {
+		return err
+	}
+	c.gate.pause()
+	return nil
+}
+
+// Resume 恢复读取被 Pause 暂停的集群.
+func (r *Reader) Resume(name string) error {
+	c, err := r.cluster(name)
+	if err != nil {
+		return err
+	}
+	c.gate.resume()
+	return nil
+}
+
+func (r *Reader) cluster(name string) (*readerCluster, error) {
+	set := r.current()
+	i := set.index(name)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCluster, name)
+	}
+	return set.clusters[i], nil
+}
@@ -0,0 +1,235 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func (r *fakeReader) push(msgs ...kafka.Message) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, msgs...)
+	r.mu.Unlock()
+}
+
+func (r *fakeReader) remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.msgs)
+}
+
+func TestReader_Streaming(t *testing.T) {
+	fakes := []*fakeReader{
+		{msgs: []kafka.Message{{Value: []byte("a0")}, {Value: []byte("a1")}}},
+		{msgs: []kafka.Message{{Value: []byte("b0")}}},
+	}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]},
+		WithReaderClusterNames("a", "b"), WithStreaming(StreamConfig{Buffer: 1}))
+	assert.NoError(t, err)
+
+	got := make(map[string]string)
+	for len(got) < 3 {
+		msg := <-r.Messages()
+		got[string(msg.Value)] = msg.ClusterName
+	}
+	assert.Equal(t, map[string]string{"a0": "a", "a1": "a", "b0": "b"}, got)
+
+	// 新增的集群启动自己的读取
+	assert.NoError(t, r.AddClusterReader("c", &fakeReader{msgs: []kafka.Message{{Value: []byte("c0")}}}))
+	msgs, err := r.ReadClusterMessages(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "c", msgs[0].ClusterName)
+	assert.Equal(t, 2, msgs[0].Cluster)
+	assert.NoError(t, r.RemoveCluster("a"))
+
+	assert.NoError(t, r.Close())
+	_, ok := <-r.Messages()
+	assert.False(t, ok)
+	_, err = r.ReadMessage(context.Background())
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReader_StreamingBackpressure(t *testing.T) {
+	fake := &fakeReader{msgs: make([]kafka.Message, 10)}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithStreaming(StreamConfig{Buffer: 2}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// channel中的两条消息加上等待放入channel的一条消息
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 7, fake.remaining())
+
+	<-r.Messages()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 6, fake.remaining())
+}
+
+func TestReader_StreamingPause(t *testing.T) {
+	fake := &fakeReader{}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"), WithStreaming(StreamConfig{}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.NoError(t, r.Pause("a"))
+	assert.True(t, r.AggregateStats().Clusters[0].Paused)
+	fake.push(kafka.Message{Value: []byte("0")})
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, fake.remaining())
+
+	assert.NoError(t, r.Resume("a"))
+	msg := <-r.Messages()
+	assert.Equal(t, "0", string(msg.Value))
+	assert.False(t, r.AggregateStats().Clusters[0].Paused)
+
+	assert.True(t, errors.Is(r.Pause("x"), ErrUnknownCluster))
+}
+
+func TestReader_Pause(t *testing.T) {
+	fakes := []*fakeReader{{msgs: []kafka.Message{{Value: []byte("a0")}}}, {}}
+	r, err := NewReaderFromClusters([]ClusterReader{fakes[0], fakes[1]}, WithReaderClusterNames("a", "b"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.NoError(t, r.Pause("a"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msgs, _ := r.ReadMessage(ctx)
+	assert.Empty(t, msgs)
+
+	assert.NoError(t, r.Resume("a"))
+	msgs, err = r.ReadMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "a0", string(msgs[0].Value))
+}
+
+func TestReader_StreamingErrors(t *testing.T) {
+	readers := []ClusterReader{
+		&failingReader{fakeReader: &fakeReader{}, err: errors.New("connection refused")},
+		&fakeReader{msgs: []kafka.Message{{Value: []byte("b0")}}},
+	}
+	r, err := NewReaderFromClusters(readers, WithReaderClusterNames("a", "b"),
+		WithStreaming(StreamConfig{Backoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// 只有一个集群失败时不返回错误
+	msgs, err := r.ReadMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "b0", string(msgs[0].Value))
+
+	var cerr ClusterError
+	assert.True(t, errors.As(<-r.Errors(), &cerr))
+	assert.Equal(t, "a", cerr.Name)
+
+	// 所有集群都失败时返回错误
+	r2, err := NewReaderFromClusters([]ClusterReader{readers[0]},
+		WithStreaming(StreamConfig{Backoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	assert.NoError(t, err)
+	defer r2.Close()
+
+	_, err = r2.ReadMessage(context.Background())
+	assert.True(t, errors.As(err, &cerr))
+	assert.Greater(t, r2.AggregateStats().Errors, int64(0))
+}
+
+func TestReader_StreamingCommit(t *testing.T) {
+	fake := &fakeReader{msgs: []kafka.Message{{Offset: 0}, {Offset: 1}, {Offset: 2}}}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"), WithStreaming(StreamConfig{}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+
+	// FetchMessages 不提交, ReadMessage 在返回之前提交
+	msgs, err := r.FetchMessages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), msgs[0].Offset)
+	assert.Empty(t, fake.commits())
+
+	kmsgs, err := r.ReadMessage(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []kafka.Message{kmsgs[0]}, fake.commits())
+
+	// channel中的消息没有提交
+	msg := <-r.Messages()
+	assert.Equal(t, int64(2), msg.Offset)
+	assert.Len(t, fake.commits(), 1)
+	assert.NoError(t, r.CommitMessages(ctx, msg))
+	assert.Len(t, fake.commits(), 2)
+}
+
+// commitOnReadReader 的 ReadMessage 和 consumer group的 kafka.Reader 一样读取之后提交,
+// 提交之后等待ctx结束, 模拟提交已经完成但是读取被打断.
+type commitOnReadReader struct {
+	*fakeReader
+}
+
+func (r *commitOnReadReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	msg, err := r.fakeReader.ReadMessage(ctx)
+	if err != nil {
+		return msg, err
+	}
+	r.CommitMessages(ctx, msg)
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func TestReader_PauseDoesNotLoseCommitted(t *testing.T) {
+	fake := &commitOnReadReader{fakeReader: &fakeReader{}}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	done := make(chan []kafka.Message)
+	go func() {
+		msgs, _ := r.ReadMessage(context.Background())
+		done <- msgs
+	}()
+
+	// 读取进行中暂停集群, 之后才有消息
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, r.Pause("a"))
+	fake.push(kafka.Message{Offset: 7})
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, fake.commits())
+
+	// 恢复之后消息被返回并且只提交一次
+	assert.NoError(t, r.Resume("a"))
+	msgs := <-done
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, int64(7), msgs[0].Offset)
+	assert.Equal(t, msgs, fake.commits())
+}
+
+func TestReader_StreamingCommitFailureWithDedup(t *testing.T) {
+	headers := []kafka.Header{{Key: HeaderProducerID, Value: []byte("p")}, {Key: HeaderSequence, Value: []byte("1")}}
+	fake := &fakeReader{msgs: []kafka.Message{{Offset: 3, Headers: headers}}, commitErr: kafka.RebalanceInProgress}
+	r, err := NewReaderFromClusters([]ClusterReader{fake}, WithReaderClusterNames("a"),
+		WithStreaming(StreamConfig{}), WithDedup(DedupConfig{}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = r.ReadMessage(ctx)
+	assert.ErrorIs(t, err, kafka.RebalanceInProgress)
+
+	// 提交失败放回的消息不会被当作重复消息去掉
+	fake.mu.Lock()
+	fake.commitErr = nil
+	fake.mu.Unlock()
+	msgs, err := r.ReadMessage(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, int64(3), msgs[0].Offset)
+	}
+	assert.Len(t, fake.commits(), 1)
+	assert.Equal(t, int64(0), r.DedupStats().Hits)
+}
@@ -0,0 +1,218 @@
+package mka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/smallnest/gofer/mq/mka"
+
+// TracingConfig 是OpenTelemetry链路追踪的配置, 零值字段使用默认值.
+type TracingConfig struct {
+	// TracerProvider 用于创建span, 默认为 otel.GetTracerProvider().
+	TracerProvider trace.TracerProvider
+	// Propagator 用于在消息的header中注入和提取链路上下文, 默认为W3C trace context.
+	Propagator propagation.TextMapPropagator
+}
+
+// tracing 是开启链路追踪之后 Writer 和 Reader 使用的tracer和propagator.
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newTracing(config TracingConfig) *tracing {
+	tp := config.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	propagator := config.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+
+	return &tracing{
+		tracer:     tp.Tracer(tracerName),
+		propagator: propagator,
+	}
+}
+
+// WithWriterTracing 开启写入的链路追踪.
+//
+// 每次 WriteMessages 都会创建一个producer span, 并把它的上下文注入到每条消息的header中.
+// 每次向集群的写入尝试都会作为一个event记录在这个span上, span结束时记录写入成功的集群和尝试的次数.
+func WithWriterTracing(config TracingConfig) WriterOption {
+	return func(w *Writer) {
+		w.tracing = newTracing(config)
+	}
+}
+
+// WithReaderTracing 开启读取的链路追踪.
+//
+// ReadMessage 为读到的每条消息创建一个consumer span, 这个span是ctx中span的子span,
+// 并且链接(link)到消息header中携带的producer span.
+func WithReaderTracing(config TracingConfig) ReaderOption {
+	return func(r *Reader) {
+		r.tracing = newTracing(config)
+	}
+}
+
+// MessageContext 返回从msg的header中提取出producer链路上下文之后的ctx,
+// 用来在处理消息时延续producer的链路. 没有开启 WithReaderTracing 时使用W3C trace context提取.
+func (r *Reader) MessageContext(ctx context.Context, msg kafka.Message) context.Context {
+	propagator := propagation.TextMapPropagator(propagation.TraceContext{})
+	if r.tracing != nil {
+		propagator = r.tracing.propagator
+	}
+	return propagator.Extract(ctx, &headerCarrier{headers: &msg.Headers})
+}
+
+// headerCarrier 把kafka消息的header适配为 propagation.TextMapCarrier.
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c *headerCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c *headerCarrier) Set(key, value string) {
+	for i, h := range *c.headers {
+		if h.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c *headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, h := range *c.headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// writeTrace 记录一次 WriteMessages 中各次写入尝试的结果, 通过context传递给 write.
+type writeTrace struct {
+	span trace.Span
+
+	mu       sync.Mutex
+	attempts int
+	acked    []string
+}
+
+type writeTraceKey struct{}
+
+// startWriteSpan 创建producer span, 并把它的上下文注入到消息的header中.
+// 消息的header会被复制, 不会修改调用方的消息.
+func (w *Writer) startWriteSpan(ctx context.Context, msgs []kafka.Message) (context.Context, []kafka.Message, *writeTrace) {
+	topic := w.current().clusters[0].config.Topic
+	if len(msgs) > 0 && msgs[0].Topic != "" {
+		topic = msgs[0].Topic
+	}
+
+	ctx, span := w.tracing.tracer.Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.operation", "publish"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.Int("messaging.batch.message_count", len(msgs)),
+			attribute.String("mka.rwmode", w.rwmode.String()),
+		))
+
+	injected := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		injected[i] = msg
+		headers := make([]kafka.Header, len(msg.Headers), len(msg.Headers)+2)
+		copy(headers, msg.Headers)
+		w.tracing.propagator.Inject(ctx, &headerCarrier{headers: &headers})
+		injected[i].Headers = headers
+	}
+
+	wt := &writeTrace{span: span}
+	return context.WithValue(ctx, writeTraceKey{}, wt), injected, wt
+}
+
+// traceAttempt 把一次向第i个集群的写入尝试记录到ctx中的producer span上.
+func (w *Writer) traceAttempt(ctx context.Context, i int, name string, n int, err error) {
+	wt, ok := ctx.Value(writeTraceKey{}).(*writeTrace)
+	if !ok {
+		return
+	}
+
+	wt.mu.Lock()
+	wt.attempts++
+	attempt := wt.attempts
+	if err == nil {
+		wt.acked = append(wt.acked, name)
+	}
+	wt.mu.Unlock()
+
+	attrs := []attribute.KeyValue{
+		attribute.Int("mka.attempt", attempt),
+		attribute.Int("mka.cluster.index", i),
+		attribute.String("mka.cluster.name", name),
+		attribute.Int("messaging.batch.message_count", n),
+	}
+	if err != nil {
+		attrs = append(attrs, attribute.String("exception.message", err.Error()))
+	}
+	wt.span.AddEvent("mka.write", trace.WithAttributes(attrs...))
+}
+
+// end 记录写入的最终结果并结束producer span.
+func (wt *writeTrace) end(err error) {
+	wt.mu.Lock()
+	attempts, acked := wt.attempts, wt.acked
+	wt.mu.Unlock()
+
+	wt.span.SetAttributes(
+		attribute.Int("mka.attempts", attempts),
+		attribute.Bool("mka.failover", attempts > 1),
+		attribute.StringSlice("mka.clusters", acked),
+	)
+	if err != nil {
+		wt.span.RecordError(err)
+		wt.span.SetStatus(codes.Error, err.Error())
+	}
+	wt.span.End()
+}
+
+// traceReceive 为从第i个集群读到的消息创建consumer span, 并链接到消息中的producer span.
+func (r *Reader) traceReceive(ctx context.Context, i int, name string, msg kafka.Message) {
+	var opts []trace.SpanStartOption
+	pctx := r.tracing.propagator.Extract(context.Background(), &headerCarrier{headers: &msg.Headers})
+	if sc := trace.SpanContextFromContext(pctx); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+
+	opts = append(opts,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.operation", "receive"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int("messaging.kafka.destination.partition", msg.Partition),
+			attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+			attribute.Int("mka.cluster.index", i),
+			attribute.String("mka.cluster.name", name),
+		))
+
+	_, span := r.tracing.tracer.Start(ctx, msg.Topic+" receive", opts...)
+	span.End()
+}
@@ -0,0 +1,106 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracing() (TracingConfig, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return TracingConfig{TracerProvider: tp}, exporter
+}
+
+func spanAttr(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestWriter_Tracing(t *testing.T) {
+	config, exporter := newTestTracing()
+
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("primary is down"))
+
+	w := newTestWriter(RWModeBackup, fakes, WithWriterClusterNames("local", "remote"), WithWriterTracing(config))
+	defer w.Close()
+
+	msg := kafka.Message{Topic: "orders", Value: []byte("v"), Headers: []kafka.Header{{Key: "k", Value: []byte("v")}}}
+	assert.NoError(t, w.WriteMessages(context.Background(), msg))
+	assert.Len(t, msg.Headers, 1, "the caller's message must not be modified")
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	span := spans[0]
+	assert.Equal(t, "orders publish", span.Name)
+	assert.Equal(t, trace.SpanKindProducer, span.SpanKind)
+	assert.Equal(t, int64(2), spanAttr(span, "mka.attempts").AsInt64())
+	assert.True(t, spanAttr(span, "mka.failover").AsBool())
+	assert.Equal(t, []string{"remote"}, spanAttr(span, "mka.clusters").AsStringSlice())
+	assert.Len(t, span.Events, 2)
+
+	// 消息的header中携带了producer span的上下文
+	written := fakes[1].msgs[0]
+	r := &Reader{}
+	sc := trace.SpanContextFromContext(r.MessageContext(context.Background(), written))
+	assert.Equal(t, span.SpanContext.TraceID(), sc.TraceID())
+	assert.Equal(t, span.SpanContext.SpanID(), sc.SpanID())
+}
+
+func TestWriter_TracingError(t *testing.T) {
+	config, exporter := newTestTracing()
+
+	fakes := newFakeWriters(1)
+	fakes[0].setErr(errors.New("down"))
+
+	w := newTestWriter(RWModeMultiRW, fakes, WithWriterTracing(config))
+	defer w.Close()
+
+	assert.Error(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("v")}))
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+		assert.False(t, spanAttr(spans[0], "mka.failover").AsBool())
+	}
+}
+
+func TestReader_TraceReceive(t *testing.T) {
+	config, exporter := newTestTracing()
+
+	w := newTestWriter(RWModeMultiRW, newFakeWriters(1), WithWriterTracing(config))
+	defer w.Close()
+	_, injected, wt := w.startWriteSpan(context.Background(), []kafka.Message{{Topic: "orders"}})
+	wt.end(nil)
+	producer := exporter.GetSpans()[0]
+	exporter.Reset()
+
+	r := &Reader{tracing: newTracing(config)}
+	r.traceReceive(context.Background(), 0, "local", injected[0])
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	assert.Equal(t, "orders receive", spans[0].Name)
+	assert.Equal(t, trace.SpanKindConsumer, spans[0].SpanKind)
+	if assert.Len(t, spans[0].Links, 1) {
+		assert.Equal(t, producer.SpanContext.SpanID(), spans[0].Links[0].SpanContext.SpanID())
+	}
+	assert.Equal(t, "local", spanAttr(spans[0], "mka.cluster.name").AsString())
+}
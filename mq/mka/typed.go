@@ -0,0 +1,179 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/multierr"
+)
+
+// ErrUnexpectedContentType 表示消息的编码格式不是 TypedReader 可以解码的格式.
+var ErrUnexpectedContentType = errors.New("mka: unexpected content type")
+
+// DecodeError 表示 TypedReader 无法解码的消息.
+type DecodeError struct {
+	// Message 是原始的消息, 包括它的来源集群.
+	Message Message
+	// ContentType 是消息header中记录的编码格式, 没有记录时为空.
+	ContentType string
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("mka: decode message from cluster %s (topic %s, partition %d, offset %d): %v",
+		e.Message.ClusterName, e.Message.Topic, e.Message.Partition, e.Message.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedMessage 是值的类型为T的消息.
+type TypedMessage[T any] struct {
+	Topic   string
+	Key     []byte
+	Value   T
+	Headers []kafka.Header
+
+	// Raw 是读取到的原始消息, 包括它的来源集群, 写入时不使用.
+	Raw Message
+}
+
+// TypedWriter 使用 Codec 编码类型为T的值, 然后通过 Writer 写入.
+type TypedWriter[T any] struct {
+	w     *Writer
+	codec Codec
+}
+
+// NewTypedWriter 返回使用codec编码值的 TypedWriter.
+func NewTypedWriter[T any](w *Writer, codec Codec) *TypedWriter[T] {
+	return &TypedWriter[T]{w: w, codec: codec}
+}
+
+// Write 编码values并写入, 每个值对应一条没有key的消息.
+func (tw *TypedWriter[T]) Write(ctx context.Context, values ...T) error {
+	msgs := make([]TypedMessage[T], len(values))
+	for i, v := range values {
+		msgs[i].Value = v
+	}
+	return tw.WriteMessages(ctx, msgs...)
+}
+
+// WriteMessages 编码消息的值并写入, 编码格式记录在 HeaderContentType header中.
+// 有消息编码失败时不会写入任何消息.
+func (tw *TypedWriter[T]) WriteMessages(ctx context.Context, msgs ...TypedMessage[T]) error {
+	kmsgs := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		value, err := tw.codec.Marshal(msg.Value)
+		if err != nil {
+			return fmt.Errorf("mka: encode message %d: %w", i, err)
+		}
+
+		headers := make([]kafka.Header, 0, len(msg.Headers)+1)
+		for _, h := range msg.Headers {
+			if h.Key != HeaderContentType {
+				headers = append(headers, h)
+			}
+		}
+		headers = append(headers, kafka.Header{Key: HeaderContentType, Value: []byte(tw.codec.ContentType())})
+
+		kmsgs[i] = kafka.Message{
+			Topic:   msg.Topic,
+			Key:     msg.Key,
+			Value:   value,
+			Headers: headers,
+		}
+	}
+
+	return tw.w.WriteMessages(ctx, kmsgs...)
+}
+
+// Close 关闭底层的 Writer.
+func (tw *TypedWriter[T]) Close() error {
+	return tw.w.Close()
+}
+
+// TypedReader 通过 Reader 读取消息, 然后按照消息的编码格式把值解码为类型T.
+type TypedReader[T any] struct {
+	r        *Reader
+	fallback Codec
+	codecs   map[string]Codec
+}
+
+// NewTypedReader 返回解码类型为T的值的 TypedReader.
+// 消息的编码格式由 HeaderContentType header决定, 只有codecs中的编码格式可以被解码,
+// 其它格式的消息返回包装了 ErrUnexpectedContentType 的 *DecodeError.
+// 没有这个header的消息使用第一个codec解码.
+func NewTypedReader[T any](r *Reader, codec Codec, codecs ...Codec) *TypedReader[T] {
+	tr := &TypedReader[T]{
+		r:        r,
+		fallback: codec,
+		codecs:   map[string]Codec{codec.ContentType(): codec},
+	}
+	for _, c := range codecs {
+		tr.codecs[c.ContentType()] = c
+	}
+	return tr
+}
+
+// ReadMessage 读取并解码消息.
+// 解码失败的消息不会出现在返回的消息中, 每条这样的消息对应一个 *DecodeError,
+// 可以通过 errors.As 或者 multierr.Errors 获取. 所以返回的error不为nil时也可能返回了消息.
+func (tr *TypedReader[T]) ReadMessage(ctx context.Context) ([]TypedMessage[T], error) {
+	msgs, err := tr.r.ReadClusterMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	typed := make([]TypedMessage[T], 0, len(msgs))
+	var errs error
+	for _, msg := range msgs {
+		tm, err := tr.decode(msg)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		typed = append(typed, tm)
+	}
+
+	return typed, errs
+}
+
+func (tr *TypedReader[T]) decode(msg Message) (TypedMessage[T], error) {
+	tm := TypedMessage[T]{
+		Topic:   msg.Topic,
+		Key:     msg.Key,
+		Headers: msg.Headers,
+		Raw:     msg,
+	}
+
+	codec := tr.fallback
+	contentType := contentType(msg.Message)
+	if contentType != "" {
+		var ok bool
+		if codec, ok = tr.codecs[contentType]; !ok {
+			return tm, &DecodeError{Message: msg, ContentType: contentType, Err: ErrUnexpectedContentType}
+		}
+	}
+
+	if err := codec.Unmarshal(msg.Value, &tm.Value); err != nil {
+		return tm, &DecodeError{Message: msg, ContentType: contentType, Err: err}
+	}
+	return tm, nil
+}
+
+// Close 关闭底层的 Reader.
+func (tr *TypedReader[T]) Close() error {
+	return tr.r.Close()
+}
+
+func contentType(msg kafka.Message) string {
+	for _, h := range msg.Headers {
+		if h.Key == HeaderContentType {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
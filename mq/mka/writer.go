@@ -2,11 +2,14 @@ package mka
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/gammazero/workerpool"
 	"github.com/segmentio/kafka-go"
-	"go.uber.org/multierr"
 )
 
 // RWMode 支持多写还是主备模式.
@@ -17,64 +20,258 @@ const (
 	RWModeMultiRW RWMode = iota
 	// RWModeBackup 主从模式，正常情况下写入主，主有问题时随机选择一个从.
 	RWModeBackup
+	// RWModeMirror 镜像模式, 每批消息并发写入所有集群, 按照 AckPolicy 判断是否写入成功.
+	RWModeMirror
 )
 
+func (m RWMode) String() string {
+	switch m {
+	case RWModeMultiRW:
+		return "multi-rw"
+	case RWModeBackup:
+		return "backup"
+	case RWModeMirror:
+		return "mirror"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrNoAvailableCluster 表示所有kafka集群的熔断器都处于打开状态, 没有可以写入的集群.
+	ErrNoAvailableCluster = errors.New("mka: no available kafka cluster")
+	// ErrBreakerOpen 表示kafka集群的熔断器处于打开状态, 本次没有向它写入.
+	ErrBreakerOpen = errors.New("mka: circuit breaker is open")
+	// ErrNoCluster 表示创建 Writer 或者 Reader 时没有设置kafka集群.
+	ErrNoCluster = errors.New("mka: must set at least one kafka cluster")
+)
+
+// ClusterWriter 是单个kafka集群的writer, *kafka.Writer 实现了这个接口.
+// 测试时可以使用 mkatest 包中的假集群代替真实的kafka集群.
+type ClusterWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+	Stats() kafka.WriterStats
+}
+
+// WriterOption 是 Writer 的可选配置.
+type WriterOption func(*Writer)
+
+// WithWriterClusterNames 设置每个kafka集群的名字, 用于统计数据和错误信息.
+// 没有设置名字的集群使用 "cluster-<索引>" 作为名字.
+func WithWriterClusterNames(names ...string) WriterOption {
+	return func(w *Writer) {
+		copy(w.names, names)
+	}
+}
+
+// WithBreaker 设置每个kafka集群熔断器的配置.
+func WithBreaker(config BreakerConfig) WriterOption {
+	return func(w *Writer) {
+		w.breakerConfig = config
+	}
+}
+
+// WithAckPolicy 设置镜像模式下的确认策略, 默认为 AckAll.
+// 写入成功的集群数达到要求时 WriteMessages 立即返回, 其余集群的写入在后台完成.
+func WithAckPolicy(policy AckPolicy) WriterOption {
+	return func(w *Writer) {
+		w.ackPolicy = policy
+	}
+}
+
+// WithKeyAffinity 开启多写模式下按照消息key选择集群.
+// 开启后消息的key通过rendezvous hash映射到固定的集群, 这个集群不可用时按照hash的排序
+// 确定性地选择下一个集群, 所以除了切换集群期间, 同一个key的消息总是写入同一个集群, 保证了顺序.
+// 一批消息中不同key的消息会按照目标集群拆分后分别写入. 没有key的消息仍然使用 ClusterSelector 选择集群.
+func WithKeyAffinity() WriterOption {
+	return func(w *Writer) {
+		w.keyAffinity = true
+	}
+}
+
+// WithRetryPolicy 设置写入失败时切换集群重试的策略.
+func WithRetryPolicy(policy RetryPolicy) WriterOption {
+	return func(w *Writer) {
+		w.retry = policy
+	}
+}
+
 // Writer 支持多写Kafka集群.
-// 可以选择多写模式还是主备模式.
+// 可以选择多写模式、主备模式还是镜像模式.
 // - 多写模式下: 轮询选择一个kafka集群进行写入
 // - 主备模式: 优先写入主, 主失败的情况下写入从
+// - 镜像模式: 并发写入所有集群, 写入成功的集群数满足 AckPolicy 即认为成功
+//
+// 通过 WithSelector 可以使用自定义的集群选择策略代替多写模式和主备模式默认的选择方式.
+//
+// Writer 会记录每个集群的写入成功率和延迟, 连续失败的集群会被熔断,
+// 熔断期间选择集群时跳过它, 超时后通过试探写入判断它是否恢复.
 type Writer struct {
-	rwmode  RWMode
-	configs []kafka.WriterConfig
+	rwmode RWMode
+
+	// mu 保护集群列表的替换, set 是当前的集群列表. closed 之后不再接受新的写入, 也不能再增删集群.
+	mu     sync.RWMutex
+	set    *writerSet
+	closed bool
+
+	// names 是创建时各个集群的名字.
+	names []string
+
+	// failovers 记录需要切换集群的写入次数.
+	failovers int64
+
+	breakerConfig BreakerConfig
+	ackPolicy     AckPolicy
+	retry         RetryPolicy
+	keyAffinity   bool
+	selector      ClusterSelector
+
+	failbackConfig *FailbackConfig
+	failback       *failback
+
+	producerID string
+	seq        uint64
+
+	spoolConfig *SpoolConfig
+	spool       *spool
+
+	deadLetter DeadLetterSink
+
+	tracing *tracing
+
+	hedge      *HedgeConfig
+	hedgeStats hedgeStats
 
-	idx     uint64
-	n       int
-	writers []*kafka.Writer
+	// done 在关闭时被关闭, 通知后台的goroutine退出, wg 等待它们退出.
+	done     chan struct{}
+	wg       sync.WaitGroup
+	shutdown shutdown
+}
 
-	wp *workerpool.WorkerPool
+// NewWriter 返回一个支持多Kafka集群的writer.
+//
+// configs 为空, WithWriterClusterNames 设置了重复的名字, 或者开启了spool但是无法打开spool目录时会panic.
+// 需要处理这些错误时使用 NewWriterFromConfig 或者 NewWriterFromClusters.
+func NewWriter(rwmode RWMode, configs []kafka.WriterConfig, opts ...WriterOption) *Writer {
+	w, err := newKafkaWriter(rwmode, configs, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return w
 }
 
-// NewReNewWriterader 返回一个支持多Kafka集群的writer.
-func NewWriter(rwmode RWMode, configs []kafka.WriterConfig) *Writer {
+// newKafkaWriter 为每个配置创建kafka-go的writer并创建 Writer, 失败时关闭已经创建的writer.
+func newKafkaWriter(rwmode RWMode, configs []kafka.WriterConfig, opts ...WriterOption) (*Writer, error) {
 	if len(configs) == 0 {
-		panic("must set at least one kafka cluster")
+		return nil, ErrNoCluster
+	}
+
+	writers := make([]ClusterWriter, len(configs))
+	for i, config := range configs {
+		writers[i] = kafka.NewWriter(config)
 	}
 
-	var writers []*kafka.Writer
-	for _, config := range configs {
-		writers = append(writers, kafka.NewWriter(config))
+	w, err := newWriter(rwmode, configs, writers, opts...)
+	if err != nil {
+		for _, writer := range writers {
+			writer.Close()
+		}
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewWriterFromClusters 使用给定的 ClusterWriter 创建 Writer, 每个 ClusterWriter 代表一个kafka集群.
+func NewWriterFromClusters(rwmode RWMode, writers []ClusterWriter, opts ...WriterOption) (*Writer, error) {
+	if len(writers) == 0 {
+		return nil, ErrNoCluster
 	}
+	return newWriter(rwmode, make([]kafka.WriterConfig, len(writers)), writers, opts...)
+}
+
+func newWriter(rwmode RWMode, configs []kafka.WriterConfig, writers []ClusterWriter, opts ...WriterOption) (*Writer, error) {
+	n := len(writers)
 
-	n := len(configs)
+	w := &Writer{
+		rwmode: rwmode,
+		names:  defaultClusterNames(n),
 
-	return &Writer{
-		rwmode:  rwmode,
-		configs: configs,
+		ackPolicy: AckAll,
 
-		idx:     0,
-		n:       n,
-		writers: writers,
+		done: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
 
-		wp: workerpool.New(n),
+	if w.selector == nil {
+		if rwmode == RWModeBackup {
+			w.selector = NewBackupSelector()
+		} else {
+			w.selector = NewRoundRobinSelector()
+		}
+	}
+
+	if w.spoolConfig != nil {
+		s, err := openSpool(*w.spoolConfig)
+		if err != nil {
+			return nil, err
+		}
+		w.spool = s
 	}
+
+	seen := make(map[string]bool, n)
+	clusters := make([]*writerCluster, n)
+	for i := range clusters {
+		if seen[w.names[i]] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateCluster, w.names[i])
+		}
+		seen[w.names[i]] = true
+		clusters[i] = &writerCluster{
+			name:      w.names[i],
+			config:    configs[i],
+			writer:    writers[i],
+			breaker:   newBreaker(w.breakerConfig),
+			latencies: w.hedge.newLatencyWindow(),
+		}
+	}
+	w.set = newWriterSet(clusters)
+
+	if w.failbackConfig != nil && rwmode == RWModeBackup {
+		config := *w.failbackConfig
+		if config.Probe == nil {
+			config.Probe = defaultProbe(clusters[0])
+		}
+		available := func() []bool {
+			s := w.current()
+			available := make([]bool, len(s.clusters))
+			for i, c := range s.clusters {
+				available[i] = c.breaker.available()
+			}
+			return available
+		}
+		w.failback = newFailback(config, n, available, w.done, &w.wg)
+		w.selector = w.failback
+	}
+
+	if w.spool != nil {
+		w.wg.Add(1)
+		go w.replay()
+	}
+
+	return w, nil
 }
 
 // Close flushes pending writes, and waits for all writes to complete before
 // returning. Calling Close also prevents new writes from being submitted to
 // the writer, further calls to WriteMessages and the like will fail with
 // io.ErrClosedPipe.
+//
+// Close 等同于没有截止时间的 Shutdown.
 func (w *Writer) Close() error {
-	var err error
-	for _, w := range w.writers {
-		e := w.Close()
-		if e != nil {
-			err = multierr.Append(err, e)
-		}
-	}
-
-	w.wp.Stop()
-
-	return err
+	return w.Shutdown(context.Background())
 }
 
 // Stats returns a snapshot of the selected writer stats since the last time the method
@@ -85,11 +282,22 @@ func (w *Writer) Close() error {
 // call Stats on a kafka writer and report the metrics to a stats collection
 // system.
 func (w *Writer) Stats(i int) kafka.WriterStats {
-	if i >= w.n {
+	s := w.current()
+	if i < 0 || i >= len(s.clusters) {
 		return kafka.WriterStats{}
 	}
 
-	return w.writers[i].Stats()
+	return s.clusters[i].writer.Stats()
+}
+
+// Health 返回第i个kafka集群的健康状况, 包括熔断器的状态.
+func (w *Writer) Health(i int) ClusterHealth {
+	s := w.current()
+	if i < 0 || i >= len(s.clusters) {
+		return ClusterHealth{}
+	}
+
+	return s.health(i)
 }
 
 // / WriteMessages writes a batch of messages to the kafka topic configured on this
@@ -116,37 +324,236 @@ func (w *Writer) Stats(i int) kafka.WriterStats {
 // whether messages were written to kafka. The program should assume that the
 // whole batch failed and re-write the messages later (which could then cause
 // duplicates).
+//
+// If the selected cluster fails, the method walks through the other clusters
+// according to the RetryPolicy, and only the messages which have not been
+// written are re-sent. When some messages still fail after the failover, the
+// method returns a *FailoverError which maps each message to the cluster it has
+// been written to, or to its final error, and records the error of every
+// attempt.
+//
+// In RWModeMirror the messages are written to all clusters concurrently, and
+// the method returns a *MirrorError if fewer clusters than the AckPolicy
+// requires have acknowledged the messages.
+//
+// If the spool is enabled and the messages cannot be written to any cluster,
+// they are appended to the local spool and the method returns ErrSpooled.
 func (w *Writer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
-	var writer *kafka.Writer
-	var idx uint64
+	if w.producerID != "" {
+		msgs = w.stamp(msgs)
+	}
 
-	if w.rwmode == RWModeBackup {
-		writer = w.writers[0]
-	} else {
-		idx = atomic.AddUint64(&w.idx, 1) % uint64(w.n)
-		writer = w.writers[idx]
+	if w.tracing == nil {
+		return w.writeMessages(ctx, msgs)
 	}
 
-	err := writer.WriteMessages(ctx, msgs...)
+	ctx, msgs, wt := w.startWriteSpan(ctx, msgs)
+	err := w.writeMessages(ctx, msgs)
+	wt.end(err)
+	return err
+}
+
+func (w *Writer) writeMessages(ctx context.Context, msgs []kafka.Message) error {
+	err := w.send(ctx, msgs)
 	if err == nil {
 		return nil
 	}
 
-	if err1, ok := err.(kafka.WriteErrors); ok {
-		err = (WriteErrors)(err1)
+	if err = w.spoolMessages(ctx, msgs, err); err == ErrSpooled {
+		return err
 	}
+	return w.deadLetterMessages(ctx, msgs, err)
+}
 
-	if w.n == 1 {
-		return err
+// send 按照 RWMode 把消息写入当前的kafka集群.
+func (w *Writer) send(ctx context.Context, msgs []kafka.Message) error {
+	s := w.acquire()
+	if s == nil {
+		return io.ErrClosedPipe
+	}
+	defer s.release()
+
+	if w.rwmode == RWModeMirror {
+		return w.mirror(ctx, s, msgs)
+	}
+
+	if w.rwmode == RWModeMultiRW && w.keyAffinity {
+		return w.sendByKey(ctx, s, msgs)
+	}
+
+	_, err := w.failover(ctx, s, msgs, w.retry.filter(w.candidates(s, msgs)))
+	return err
+}
+
+// failover 按照candidates的顺序写入消息, 失败时切换集群, 只重新发送没有写入成功的消息.
+// 返回的 *FailoverError 记录了每条消息的结果和每次失败的尝试. 写入失败时,
+// 如果只尝试了一次, 返回的error是这次尝试的错误, 否则就是这个 *FailoverError.
+func (w *Writer) failover(ctx context.Context, s *writerSet, msgs []kafka.Message, candidates []int) (*FailoverError, error) {
+	err := ErrNoAvailableCluster
+
+	// pending 是还没有写入成功的消息的索引, 切换集群时只重新发送这些消息.
+	pending := make([]int, len(msgs))
+	results := make([]MessageError, len(msgs))
+	for j := range pending {
+		pending[j] = j
+		results[j] = MessageError{Cluster: -1, Err: err}
+	}
+
+	maxAttempts := w.retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = len(candidates)
+	}
+
+	// 按照顺序依次尝试各个集群, 熔断的集群会被跳过.
+	// 所有集群都被熔断时停止尝试.
+	var attemptErrs []ClusterError
+	attempts, skipped := 0, 0
+	for k := 0; attempts < maxAttempts && skipped < len(candidates); k++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		i := candidates[k%len(candidates)]
+		c := s.clusters[i]
+		trial, ok := c.breaker.allow()
+		if !ok {
+			skipped++
+			continue
+		}
+		skipped = 0
+
+		if attempts > 0 {
+			if w.retry.wait(ctx, attempts) != nil {
+				c.breaker.release(trial)
+				break
+			}
+		}
+
+		batch := msgs
+		if len(pending) < len(msgs) {
+			batch = make([]kafka.Message, 0, len(pending))
+			for _, j := range pending {
+				batch = append(batch, msgs[j])
+			}
+		}
+
+		attempts++
+		w.countAttempt(c, attempts)
+		timeout := w.retry.attemptTimeout(ctx, maxAttempts-attempts+1)
+
+		var tries []attemptResult
+		if w.hedge != nil && attempts < maxAttempts {
+			// 对冲时选择candidates中下一个可用的集群, 之后的切换从它后面的集群开始
+			next := func() (int, int, bool) {
+				for m := 1; m < len(candidates); m++ {
+					h := candidates[(k+m)%len(candidates)]
+					if h == i {
+						continue
+					}
+					if htrial, ok := s.clusters[h].breaker.allow(); ok {
+						k += m
+						attempts++
+						w.countAttempt(s.clusters[h], attempts)
+						return h, attempts, htrial
+					}
+				}
+				return -1, 0, false
+			}
+			tries = w.hedgedWrite(ctx, s, i, trial, attempts, batch, timeout, next)
+		} else {
+			tries = []attemptResult{{cluster: i, attempt: attempts, err: w.write(ctx, s, i, trial, batch, timeout)}}
+		}
+
+		for _, t := range tries {
+			if t.err != nil {
+				attemptErrs = append(attemptErrs, ClusterError{
+					Cluster:  t.cluster,
+					Name:     s.clusters[t.cluster].name,
+					Attempt:  t.attempt,
+					Messages: append([]int(nil), pending...),
+					Err:      t.err,
+				})
+			}
+			err = t.err
+		}
+
+		pending = w.trackAttempts(s, results, pending, tries)
+		if len(pending) == 0 {
+			return &FailoverError{Messages: results, Attempts: attemptErrs}, nil
+		}
 	}
 
-	if w.rwmode == RWModeBackup {
-		idx := atomic.AddUint64(&w.idx, 1) % uint64(w.n-1)
-		writer = w.writers[1:][idx]
+	ferr := &FailoverError{Messages: results, Attempts: attemptErrs}
+	if attempts < 2 {
+		return ferr, err
+	}
+	return ferr, ferr
+}
+
+// countAttempt 记录第attempt次尝试写入集群c, 第二次尝试开始算作切换集群.
+func (w *Writer) countAttempt(c *writerCluster, attempt int) {
+	if attempt == 2 {
+		atomic.AddInt64(&w.failovers, 1)
+	}
+	if attempt > 1 {
+		atomic.AddInt64(&c.fallbacks, 1)
+	}
+}
+
+// candidates 返回 ClusterSelector 为本批消息选择的集群, 忽略无效和重复的索引.
+func (w *Writer) candidates(s *writerSet, msgs []kafka.Message) []int {
+	n := len(s.clusters)
+	healths := make([]ClusterHealth, n)
+	for i := range healths {
+		healths[i] = s.health(i)
+	}
+
+	selected := make([]bool, n)
+	order := make([]int, 0, n)
+	for _, i := range w.selector.Select(msgs, healths) {
+		if i >= 0 && i < n && !selected[i] {
+			selected[i] = true
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// write 向第i个集群写入消息, 并记录该集群的健康状况, trial 是 breaker.allow 返回的试探写入标记.
+// timeout 大于0时, 本次写入的超时时间不超过timeout.
+func (w *Writer) write(ctx context.Context, s *writerSet, i int, trial bool, msgs []kafka.Message, timeout time.Duration) error {
+	c := s.clusters[i]
+
+	wctx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := c.writer.WriteMessages(wctx, msgs...)
+	if err != nil && ctx.Err() != nil {
+		// 调用方取消了写入, 不能算作集群的失败
+		c.breaker.release(trial)
 	} else {
-		idx := (idx + 1) % uint64(w.n)
-		writer = w.writers[idx]
+		latency := time.Since(start)
+		c.breaker.record(trial, err, latency)
+		if err == nil && c.latencies != nil {
+			c.latencies.record(latency)
+		}
+		if o, ok := w.selector.(ClusterObserver); ok {
+			o.Observe(i, err, latency)
+		}
+	}
+
+	if w.tracing != nil {
+		w.traceAttempt(ctx, i, c.name, len(msgs), err)
+	}
+
+	if err1, ok := err.(kafka.WriteErrors); ok {
+		err = (WriteErrors)(err1)
 	}
 
-	return writer.WriteMessages(ctx, msgs...)
+	return err
 }
@@ -0,0 +1,215 @@
+package mka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWriter 是测试用的单集群writer, 把消息保存在内存中.
+type fakeWriter struct {
+	mu     sync.Mutex
+	err    error
+	fail   func(msg kafka.Message) error // 不为nil时按消息返回 kafka.WriteErrors
+	writes int
+	msgs   []kafka.Message
+	closed bool
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writes++
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.fail != nil {
+		werr := make(kafka.WriteErrors, len(msgs))
+		for i, msg := range msgs {
+			if werr[i] = w.fail(msg); werr[i] == nil {
+				w.msgs = append(w.msgs, msg)
+			}
+		}
+		if werr.Count() > 0 {
+			return werr
+		}
+		return nil
+	}
+
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *fakeWriter) Stats() kafka.WriterStats {
+	return kafka.WriterStats{}
+}
+
+func (w *fakeWriter) setErr(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
+
+func (w *fakeWriter) written() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.msgs)
+}
+
+func (w *fakeWriter) attempts() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes
+}
+
+func newFakeWriters(n int) []*fakeWriter {
+	var fakes []*fakeWriter
+	for i := 0; i < n; i++ {
+		fakes = append(fakes, &fakeWriter{})
+	}
+	return fakes
+}
+
+func newTestWriter(rwmode RWMode, fakes []*fakeWriter, opts ...WriterOption) *Writer {
+	var writers []ClusterWriter
+	for _, f := range fakes {
+		writers = append(writers, f)
+	}
+	w, err := newWriter(rwmode, make([]kafka.WriterConfig, len(fakes)), writers, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+func TestWriter_SkipOpenCluster(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("primary is down"))
+
+	w := newTestWriter(RWModeBackup, fakes, WithBreaker(BreakerConfig{FailureThreshold: 2}))
+	defer w.Close()
+
+	msg := kafka.Message{Value: []byte("hello")}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, w.WriteMessages(context.Background(), msg))
+	}
+
+	assert.Equal(t, 2, fakes[0].attempts())
+	assert.Equal(t, 5, fakes[1].written())
+	assert.Equal(t, BreakerOpen, w.Health(0).State)
+	assert.Equal(t, BreakerClosed, w.Health(1).State)
+	assert.Equal(t, int64(5), w.Health(1).Successes)
+}
+
+func TestWriter_NoAvailableCluster(t *testing.T) {
+	fakes := newFakeWriters(1)
+	fakes[0].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeMultiRW, fakes, WithBreaker(BreakerConfig{FailureThreshold: 1}))
+	defer w.Close()
+
+	err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+	assert.EqualError(t, err, "cluster is down")
+
+	err = w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+	assert.ErrorIs(t, err, ErrNoAvailableCluster)
+	assert.Equal(t, 1, fakes[0].attempts())
+}
+
+func TestWriter_FailoverOnlyFailedMessages(t *testing.T) {
+	errPartition := errors.New("leader not available")
+
+	fakes := newFakeWriters(2)
+	fakes[0].fail = func(msg kafka.Message) error {
+		if string(msg.Key) == "odd" {
+			return errPartition
+		}
+		return nil
+	}
+
+	w := newTestWriter(RWModeBackup, fakes)
+	defer w.Close()
+
+	msgs := []kafka.Message{
+		{Key: []byte("even"), Value: []byte("0")},
+		{Key: []byte("odd"), Value: []byte("1")},
+		{Key: []byte("even"), Value: []byte("2")},
+		{Key: []byte("odd"), Value: []byte("3")},
+	}
+	assert.NoError(t, w.WriteMessages(context.Background(), msgs...))
+	assert.Equal(t, 2, fakes[0].written())
+	assert.Equal(t, 2, fakes[1].written())
+	assert.Equal(t, []byte("1"), fakes[1].msgs[0].Value)
+	assert.Equal(t, []byte("3"), fakes[1].msgs[1].Value)
+
+	// 两个集群都失败的消息
+	fakes[1].setErr(errors.New("backup is down"))
+	err := w.WriteMessages(context.Background(), msgs...)
+
+	var ferr *FailoverError
+	assert.True(t, errors.As(err, &ferr))
+	assert.Equal(t, 2, ferr.Count())
+	assert.Equal(t, MessageError{Cluster: 0, Name: "cluster-0"}, ferr.Messages[0])
+	assert.Equal(t, 1, ferr.Messages[1].Cluster)
+	assert.EqualError(t, ferr.Messages[1].Err, "backup is down")
+	assert.Equal(t, MessageError{Cluster: 0, Name: "cluster-0"}, ferr.Messages[2])
+	assert.Equal(t, "kafka failover write errors (2/4) after 2 attempts, the first error: cluster 1 (cluster-1): backup is down", err.Error())
+}
+
+func TestWriter_WalkAllClusters(t *testing.T) {
+	fakes := newFakeWriters(3)
+	fakes[0].setErr(errors.New("primary is down"))
+	fakes[1].setErr(errors.New("backup is down"))
+	fakes[2].setErr(errors.New("backup is down"))
+
+	w := newTestWriter(RWModeBackup, fakes)
+	defer w.Close()
+
+	err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+
+	var ferr *FailoverError
+	assert.True(t, errors.As(err, &ferr))
+	assert.Len(t, ferr.Attempts, 3)
+	assert.Equal(t, 0, ferr.Attempts[0].Cluster)
+	assert.Equal(t, 1, ferr.Attempts[0].Attempt)
+	assert.Equal(t, 3, ferr.Attempts[2].Attempt)
+	assert.ElementsMatch(t, []int{1, 2}, []int{ferr.Attempts[1].Cluster, ferr.Attempts[2].Cluster})
+
+	fakes[2].setErr(nil)
+	assert.NoError(t, w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")}))
+	assert.Equal(t, 1, fakes[2].written())
+}
+
+func TestWriter_RetryPolicy(t *testing.T) {
+	fakes := newFakeWriters(2)
+	fakes[0].setErr(errors.New("cluster is down"))
+
+	w := newTestWriter(RWModeMultiRW, fakes, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		Clusters:    []int{0},
+		Backoff:     time.Millisecond,
+	}))
+	defer w.Close()
+
+	err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("hello")})
+
+	var ferr *FailoverError
+	assert.True(t, errors.As(err, &ferr))
+	assert.Len(t, ferr.Attempts, 3)
+	assert.Equal(t, 3, fakes[0].attempts())
+	assert.Equal(t, 0, fakes[1].attempts())
+}